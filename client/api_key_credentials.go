@@ -0,0 +1,23 @@
+package client
+
+import "context"
+
+// APIKeyCredentials 在每个请求的 x-api-key metadata 中附加 API key, 代替用户名和密码登录
+type APIKeyCredentials struct {
+	apiKey string
+}
+
+// NewAPIKeyCredentials 创建实例
+func NewAPIKeyCredentials(apiKey string) *APIKeyCredentials {
+	return &APIKeyCredentials{apiKey: apiKey}
+}
+
+// GetRequestMetadata 实现 credentials.PerRPCCredentials
+func (creds *APIKeyCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"x-api-key": creds.apiKey}, nil
+}
+
+// RequireTransportSecurity 与 access token 一样, 允许不使用 TLS 的连接
+func (creds *APIKeyCredentials) RequireTransportSecurity() bool {
+	return false
+}
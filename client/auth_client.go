@@ -3,9 +3,12 @@ package client
 import (
 	"context"
 	"go-pcbook-micro/pb"
+	"log"
+	"sync"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 //AuthClient 授权客户端
@@ -13,12 +16,19 @@ type AuthClient struct {
 	service  pb.AuthServiceClient
 	username string
 	password string
+
+	mutex        sync.Mutex
+	refreshToken string // 最近一次登录或刷新得到的 refresh token
 }
 
 //NewAuthClient  创建授权客户端
 func NewAuthClient(cc *grpc.ClientConn, username string, password string) *AuthClient {
 	service := pb.NewAuthServiceClient(cc)
-	return &AuthClient{service, username, password}
+	return &AuthClient{
+		service:  service,
+		username: username,
+		password: password,
+	}
 }
 
 // Login 登录
@@ -37,5 +47,71 @@ func (client *AuthClient) Login() (string, error) {
 		return "", err
 	}
 
+	client.mutex.Lock()
+	client.refreshToken = res.GetRefreshToken()
+	client.mutex.Unlock()
+
 	return res.GetAccessToken(), nil
 }
+
+// Refresh 使用 refresh token 换取新的 access token, 没有 refresh token 或刷新失败时重新登录
+func (client *AuthClient) Refresh() (string, error) {
+	client.mutex.Lock()
+	refreshToken := client.refreshToken
+	client.mutex.Unlock()
+
+	if len(refreshToken) == 0 {
+		return client.Login()
+	}
+
+	// 设置超时
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.service.RefreshToken(ctx, &pb.RefreshTokenRequest{RefreshToken: refreshToken})
+	if err != nil {
+		log.Printf("cannot refresh token, login again: %v", err)
+		return client.Login()
+	}
+
+	client.mutex.Lock()
+	client.refreshToken = res.GetRefreshToken()
+	client.mutex.Unlock()
+
+	return res.GetAccessToken(), nil
+}
+
+// Logout 吊销 access token 和 refresh token
+func (client *AuthClient) Logout(accessToken string) error {
+	// 设置超时
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client.mutex.Lock()
+	refreshToken := client.refreshToken
+	client.refreshToken = ""
+	client.mutex.Unlock()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", accessToken)
+	_, err := client.service.Logout(ctx, &pb.LogoutRequest{RefreshToken: refreshToken})
+	return err
+}
+
+// Register 使用客户端的用户名和密码注册新用户
+func (client *AuthClient) Register() (*pb.Profile, error) {
+	// 设置超时
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.RegisterRequest{
+		Username: client.username,
+		Password: client.password,
+	}
+
+	res, err := client.service.Register(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.GetProfile(), nil
+}
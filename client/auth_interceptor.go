@@ -52,8 +52,9 @@ func (ai *AuthInterceptor) scheduleRefreshToken(refreshDuration time.Duration) e
 	return nil
 }
 
+// refreshToken 只在第一次和 refresh token 失效时发送密码
 func (ai *AuthInterceptor) refreshToken() error {
-	accessToken, err := ai.authClient.Login()
+	accessToken, err := ai.authClient.Refresh()
 	if err != nil {
 		return err
 	}
@@ -63,6 +64,11 @@ func (ai *AuthInterceptor) refreshToken() error {
 	return nil
 }
 
+// Logout 吊销当前的 access token 和 refresh token
+func (ai *AuthInterceptor) Logout() error {
+	return ai.authClient.Logout(ai.accessToken)
+}
+
 // Unary 创建一元rpc拦截器
 func (ai *AuthInterceptor) Unary() grpc.UnaryClientInterceptor {
 	return func(
@@ -111,6 +111,11 @@ func (client *LaptopClient) RateLaptop(laptopIDs []string, scores []float64) err
 				return
 			}
 
+			if res.GetError() != nil {
+				// 单次评分被拒绝, 流继续
+				log.Print("rating rejected: ", status.FromProto(res.GetError()).Err())
+				continue
+			}
 			log.Print("received response: ", res)
 		}
 	}()
@@ -137,6 +142,105 @@ func (client *LaptopClient) RateLaptop(laptopIDs []string, scores []float64) err
 	return err
 }
 
+// RemoveRating 撤回评分 rpc
+func (client *LaptopClient) RemoveRating(laptopID string) (*pb.RemoveRatingResponse, error) {
+	// 设置超时
+	ctx, cancle := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancle()
+
+	req := &pb.RemoveRatingRequest{LaptopId: laptopID}
+
+	return client.service.RemoveRating(ctx, req)
+}
+
+// CompareLaptops 逐项比较多台 laptop 规格 rpc
+func (client *LaptopClient) CompareLaptops(laptopIDs []string) (*pb.CompareLaptopsResponse, error) {
+	// 设置超时
+	ctx, cancle := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancle()
+
+	req := &pb.CompareLaptopsRequest{LaptopIds: laptopIDs}
+
+	return client.service.CompareLaptops(ctx, req)
+}
+
+// SimilarLaptops 推荐规格相似的 laptop rpc
+func (client *LaptopClient) SimilarLaptops(laptopID string, k uint32, filter *pb.Filter) (*pb.SimilarLaptopsResponse, error) {
+	// 设置超时
+	ctx, cancle := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancle()
+
+	req := &pb.SimilarLaptopsRequest{
+		LaptopId: laptopID,
+		K:        k,
+		Filter:   filter,
+	}
+
+	return client.service.SimilarLaptops(ctx, req)
+}
+
+// UpdateLaptopPrice 修改 laptop 价格 rpc
+func (client *LaptopClient) UpdateLaptopPrice(laptopID string, price float64) (*pb.UpdateLaptopPriceResponse, error) {
+	// 设置超时
+	ctx, cancle := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancle()
+
+	req := &pb.UpdateLaptopPriceRequest{
+		LaptopId: laptopID,
+		PriceUsd: price,
+	}
+
+	return client.service.UpdateLaptopPrice(ctx, req)
+}
+
+// GetPriceHistory 获取 laptop 价格变更历史 rpc
+func (client *LaptopClient) GetPriceHistory(laptopID string) (*pb.GetPriceHistoryResponse, error) {
+	// 设置超时
+	ctx, cancle := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancle()
+
+	req := &pb.GetPriceHistoryRequest{LaptopId: laptopID}
+
+	return client.service.GetPriceHistory(ctx, req)
+}
+
+// SetPriceAlert 设置降价提醒 rpc, targetPrice 为 0 时删除提醒
+func (client *LaptopClient) SetPriceAlert(laptopID string, targetPrice float64) (*pb.SetPriceAlertResponse, error) {
+	// 设置超时
+	ctx, cancle := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancle()
+
+	req := &pb.SetPriceAlertRequest{
+		LaptopId:       laptopID,
+		TargetPriceUsd: targetPrice,
+	}
+
+	return client.service.SetPriceAlert(ctx, req)
+}
+
+// WatchAlerts 接收降价通知 rpc, 直到 ctx 取消
+func (client *LaptopClient) WatchAlerts(ctx context.Context, received func(notification *pb.PriceNotification)) error {
+	stream, err := client.service.WatchAlerts(ctx, &pb.WatchAlertsRequest{})
+	if err != nil {
+		return fmt.Errorf("cannot watch alerts: %w", err)
+	}
+
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot receive notification: %w", err)
+		}
+
+		notification := res.GetNotification()
+		log.Printf("laptop %s price dropped: %.2f -> %.2f (target %.2f)",
+			notification.GetLaptopId(), notification.GetOldPriceUsd(), notification.GetNewPriceUsd(), notification.GetTargetPriceUsd())
+		received(notification)
+	}
+}
+
 // UploadImage 图片上传 rpc
 func (client *LaptopClient) UploadImage(laptopID string, imagePath string) {
 	file, err := os.Open(imagePath)
@@ -196,5 +300,93 @@ func (client *LaptopClient) UploadImage(laptopID string, imagePath string) {
 		log.Fatal("cannot receive response: ", err)
 	}
 
-	log.Printf("image upload with id: %s, size: %d", res.GetId(), res.GetSize())
+	log.Printf("image upload with id: %s, size: %d, checksum: %s", res.GetId(), res.GetSize(), res.GetChecksum())
+}
+
+// DownloadImage 图片下载 rpc, variant 为空时下载原图
+func (client *LaptopClient) DownloadImage(imageID string, variant string, imageFolder string) {
+	// 设置超时
+	ctx, cancle := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancle()
+
+	req := &pb.DownloadImageRequest{
+		ImageId: imageID,
+		Variant: variant,
+	}
+
+	stream, err := client.service.DownloadImage(ctx, req)
+	if err != nil {
+		log.Fatal("cannot download image: ", err)
+	}
+
+	res, err := stream.Recv()
+	if err != nil {
+		log.Fatal("cannot receive image info: ", err)
+	}
+
+	imagePath := filepath.Join(imageFolder, imageID+res.GetInfo().GetImageType())
+	if len(variant) > 0 {
+		imagePath = filepath.Join(imageFolder, imageID+"_"+variant+res.GetInfo().GetImageType())
+	}
+
+	file, err := os.Create(imagePath)
+	if err != nil {
+		log.Fatal("cannot create image file: ", err)
+	}
+	defer file.Close()
+
+	size := 0
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal("cannot receive chunk data: ", err)
+		}
+
+		n, err := file.Write(res.GetChunkData())
+		if err != nil {
+			log.Fatal("cannot write chunk data: ", err)
+		}
+		size += n
+	}
+
+	log.Printf("image download to %s, size: %d", imagePath, size)
+}
+
+// CheckImages 检查图片存储一致性 rpc, repair 为 true 时修复发现的问题
+func (client *LaptopClient) CheckImages(repair bool) (*pb.CheckImagesResponse, error) {
+	// 设置超时
+	ctx, cancle := context.WithTimeout(context.Background(), time.Minute)
+	defer cancle()
+
+	req := &pb.CheckImagesRequest{Repair: repair}
+
+	return client.service.CheckImages(ctx, req)
+}
+
+// ListRatingEvents 分页获取评分事件历史 rpc
+func (client *LaptopClient) ListRatingEvents(laptopID string, username string, pageSize int32, pageToken string) (*pb.ListRatingEventsResponse, error) {
+	// 设置超时
+	ctx, cancle := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancle()
+
+	req := &pb.ListRatingEventsRequest{
+		LaptopId:  laptopID,
+		Username:  username,
+		PageSize:  pageSize,
+		PageToken: pageToken,
+	}
+
+	return client.service.ListRatingEvents(ctx, req)
+}
+
+// RebuildRatingAggregates 从事件日志重新计算评分汇总 rpc
+func (client *LaptopClient) RebuildRatingAggregates() (*pb.RebuildRatingAggregatesResponse, error) {
+	// 设置超时
+	ctx, cancle := context.WithTimeout(context.Background(), time.Minute)
+	defer cancle()
+
+	return client.service.RebuildRatingAggregates(ctx, &pb.RebuildRatingAggregatesRequest{})
 }
@@ -10,12 +10,12 @@ import (
 	"go-pcbook-micro/sample"
 	"io/ioutil"
 	"log"
+	"os"
 	"strings"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
-
 )
 
 func testCreateLaptop(laptopClient *client.LaptopClient) {
@@ -86,9 +86,19 @@ const (
 func authMethods() map[string]bool {
 	const laptopServicePath = "/pcbook.LaptopService/"
 	return map[string]bool{
-		laptopServicePath + "CreateLaptop": true,
-		laptopServicePath + "UploadImage":  true,
-		laptopServicePath + "RateLaptop":   true,
+		// 公开的 rpc 也发送 token, 服务器据此返回用户所属组织的 laptop
+		laptopServicePath + "SearchLaptop":  true,
+		laptopServicePath + "CreateLaptop":  true,
+		laptopServicePath + "UploadImage":   true,
+		laptopServicePath + "DeleteImage":   true,
+		laptopServicePath + "GetQuotaUsage": true,
+		laptopServicePath + "RateLaptop":    true,
+		laptopServicePath + "RemoveRating":  true,
+		laptopServicePath + "GetMyRating":   true,
+
+		laptopServicePath + "UpdateLaptopPrice": true,
+		laptopServicePath + "SetPriceAlert":     true,
+		laptopServicePath + "WatchAlerts":       true,
 	}
 }
 
@@ -121,6 +131,7 @@ func loadTLSCredentials() (credentials.TransportCredentials, error) {
 func main() {
 	serverAddress := flag.String("address", "", "the server address")
 	enableTLS := flag.Bool("tls", false, "enable SSL/TLS")
+	apiKey := flag.String("api-key", os.Getenv("PCBOOK_API_KEY"), "API key used instead of logging in (default $PCBOOK_API_KEY)")
 
 	flag.Parse()
 	log.Printf("dial server %s, TLS = %t", *serverAddress, *enableTLS)
@@ -136,23 +147,28 @@ func main() {
 		transportOption = grpc.WithTransportCredentials(tlsCredentials)
 	}
 
-	conn1, err := grpc.Dial(*serverAddress, transportOption)
-	if err != nil {
-		log.Fatal("cannot dial server: ", err)
-	}
+	dialOptions := []grpc.DialOption{transportOption}
+	if len(*apiKey) > 0 {
+		// CI 等非交互的任务使用 API key, 不需要登录
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(client.NewAPIKeyCredentials(*apiKey)))
+	} else {
+		conn1, err := grpc.Dial(*serverAddress, transportOption)
+		if err != nil {
+			log.Fatal("cannot dial server: ", err)
+		}
 
-	authClient := client.NewAuthClient(conn1, username, password)
-	interceptor, err := client.NewAuthInterceptor(authClient, authMethods(), refreshDuration)
-	if err != nil {
-		log.Fatal("cannot create auth interceptor: ", err)
+		authClient := client.NewAuthClient(conn1, username, password)
+		interceptor, err := client.NewAuthInterceptor(authClient, authMethods(), refreshDuration)
+		if err != nil {
+			log.Fatal("cannot create auth interceptor: ", err)
+		}
+		dialOptions = append(dialOptions,
+			grpc.WithUnaryInterceptor(interceptor.Unary()),
+			grpc.WithStreamInterceptor(interceptor.Stream()),
+		)
 	}
 
-	conn2, err := grpc.Dial(
-		*serverAddress,
-		transportOption,
-		grpc.WithUnaryInterceptor(interceptor.Unary()),
-		grpc.WithStreamInterceptor(interceptor.Stream()),
-	)
+	conn2, err := grpc.Dial(*serverAddress, dialOptions...)
 	if err != nil {
 		log.Fatal("cannot dial server: ", err)
 	}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"go-pcbook-micro/client"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const refreshDuration = 30 * time.Second
+
+func authMethods() map[string]bool {
+	const laptopServicePath = "/pcbook.LaptopService/"
+	return map[string]bool{
+		laptopServicePath + "CheckImages": true,
+	}
+}
+
+func loadTLSCredentials() (credentials.TransportCredentials, error) {
+	// 加载签署服务器证书的CA的证书
+	pemServerCA, err := ioutil.ReadFile("cert/ca-cert.pem")
+	if err != nil {
+		return nil, err
+	}
+	// 创建 x509证书池
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(pemServerCA) {
+		return nil, fmt.Errorf("failed to add server CA's certificate")
+	}
+	// 加载客户端证书和私钥
+	clientCert, err := tls.LoadX509KeyPair("cert/client-cert.pem", "cert/client-key.pem")
+	if err != nil {
+		return nil, err
+	}
+
+	// 创建凭据并返回
+	config := &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      certPool,
+	}
+
+	return credentials.NewTLS(config), nil
+}
+
+// fsck 检查服务器图片存储的一致性
+func main() {
+	serverAddress := flag.String("address", "", "the server address")
+	enableTLS := flag.Bool("tls", false, "enable SSL/TLS")
+	username := flag.String("username", "admin1", "admin username")
+	password := flag.String("password", "secret", "admin password")
+	repair := flag.Bool("repair", false, "repair issues found")
+
+	flag.Parse()
+	log.Printf("dial server %s, TLS = %t", *serverAddress, *enableTLS)
+
+	transportOption := grpc.WithInsecure()
+
+	if *enableTLS {
+		// 获取凭据对象
+		tlsCredentials, err := loadTLSCredentials()
+		if err != nil {
+			log.Fatal("cannot load TLS credentials: ", err)
+		}
+		transportOption = grpc.WithTransportCredentials(tlsCredentials)
+	}
+
+	conn1, err := grpc.Dial(*serverAddress, transportOption)
+	if err != nil {
+		log.Fatal("cannot dial server: ", err)
+	}
+
+	authClient := client.NewAuthClient(conn1, *username, *password)
+	interceptor, err := client.NewAuthInterceptor(authClient, authMethods(), refreshDuration)
+	if err != nil {
+		log.Fatal("cannot create auth interceptor: ", err)
+	}
+
+	conn2, err := grpc.Dial(
+		*serverAddress,
+		transportOption,
+		grpc.WithUnaryInterceptor(interceptor.Unary()),
+	)
+	if err != nil {
+		log.Fatal("cannot dial server: ", err)
+	}
+
+	laptopClient := client.NewLaptopClient(conn2)
+
+	res, err := laptopClient.CheckImages(*repair)
+	if err != nil {
+		log.Fatal("cannot check images: ", err)
+	}
+
+	fmt.Printf("checked %d images and %d files, found %d issues\n", res.GetCheckedImages(), res.GetCheckedFiles(), len(res.GetIssues()))
+	for _, issue := range res.GetIssues() {
+		fmt.Printf("- %s: image = %q, variant = %q, path = %s, %s, repaired = %t\n",
+			issue.GetKind(), issue.GetImageId(), issue.GetVariant(), issue.GetPath(), issue.GetDetail(), issue.GetRepaired())
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"go-pcbook-micro/client"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const refreshDuration = 30 * time.Second
+
+func authMethods() map[string]bool {
+	const laptopServicePath = "/pcbook.LaptopService/"
+	return map[string]bool{
+		laptopServicePath + "ListRatingEvents":        true,
+		laptopServicePath + "RebuildRatingAggregates": true,
+	}
+}
+
+func loadTLSCredentials() (credentials.TransportCredentials, error) {
+	// 加载签署服务器证书的CA的证书
+	pemServerCA, err := ioutil.ReadFile("cert/ca-cert.pem")
+	if err != nil {
+		return nil, err
+	}
+	// 创建 x509证书池
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(pemServerCA) {
+		return nil, fmt.Errorf("failed to add server CA's certificate")
+	}
+	// 加载客户端证书和私钥
+	clientCert, err := tls.LoadX509KeyPair("cert/client-cert.pem", "cert/client-key.pem")
+	if err != nil {
+		return nil, err
+	}
+
+	// 创建凭据并返回
+	config := &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      certPool,
+	}
+
+	return credentials.NewTLS(config), nil
+}
+
+// ratingadmin 查看评分事件历史, 或从事件日志重新计算评分汇总
+func main() {
+	serverAddress := flag.String("address", "", "the server address")
+	enableTLS := flag.Bool("tls", false, "enable SSL/TLS")
+	username := flag.String("username", "admin1", "admin username")
+	password := flag.String("password", "secret", "admin password")
+	rebuild := flag.Bool("rebuild", false, "rebuild rating aggregates from the event log")
+	laptopID := flag.String("laptop", "", "only list events of this laptop")
+	user := flag.String("user", "", "only list events of this user")
+	pageSize := flag.Int("page-size", 100, "number of events per page")
+
+	flag.Parse()
+	log.Printf("dial server %s, TLS = %t", *serverAddress, *enableTLS)
+
+	transportOption := grpc.WithInsecure()
+
+	if *enableTLS {
+		// 获取凭据对象
+		tlsCredentials, err := loadTLSCredentials()
+		if err != nil {
+			log.Fatal("cannot load TLS credentials: ", err)
+		}
+		transportOption = grpc.WithTransportCredentials(tlsCredentials)
+	}
+
+	conn1, err := grpc.Dial(*serverAddress, transportOption)
+	if err != nil {
+		log.Fatal("cannot dial server: ", err)
+	}
+
+	authClient := client.NewAuthClient(conn1, *username, *password)
+	interceptor, err := client.NewAuthInterceptor(authClient, authMethods(), refreshDuration)
+	if err != nil {
+		log.Fatal("cannot create auth interceptor: ", err)
+	}
+
+	conn2, err := grpc.Dial(
+		*serverAddress,
+		transportOption,
+		grpc.WithUnaryInterceptor(interceptor.Unary()),
+	)
+	if err != nil {
+		log.Fatal("cannot dial server: ", err)
+	}
+
+	laptopClient := client.NewLaptopClient(conn2)
+
+	if *rebuild {
+		res, err := laptopClient.RebuildRatingAggregates()
+		if err != nil {
+			log.Fatal("cannot rebuild rating aggregates: ", err)
+		}
+
+		fmt.Printf("replayed %d events, %d laptops rated, %d laptops changed\n", res.GetEvents(), res.GetLaptops(), res.GetChangedLaptops())
+		return
+	}
+
+	pageToken := ""
+	for {
+		res, err := laptopClient.ListRatingEvents(*laptopID, *user, int32(*pageSize), pageToken)
+		if err != nil {
+			log.Fatal("cannot list rating events: ", err)
+		}
+
+		for _, event := range res.GetEvents() {
+			previous := "-"
+			if event.GetHasPreviousScore() {
+				previous = fmt.Sprint(event.GetPreviousScore())
+			}
+			fmt.Printf("%d %s %s laptop = %s, user = %s, score = %v, previous = %s\n",
+				event.GetSequence(), event.GetTimestamp().AsTime().Format(time.RFC3339), event.GetType(),
+				event.GetLaptopId(), event.GetUsername(), event.GetScore(), previous)
+		}
+
+		pageToken = res.GetNextPageToken()
+		if len(pageToken) == 0 {
+			return
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"go-pcbook-micro/pb"
@@ -12,6 +13,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
@@ -21,7 +23,11 @@ import (
 )
 
 func seedUsers(userStore service.UserStore) error {
-	err := createUser(userStore, "admin1", "secret", "admin")
+	err := createUser(userStore, "superadmin1", "secret", service.RoleSuperAdmin)
+	if err != nil {
+		return err
+	}
+	err = createUser(userStore, "admin1", "secret", "admin")
 	if err != nil {
 		return err
 	}
@@ -48,13 +54,15 @@ const (
 	clientCACertFile = "cert/ca-cert.pem"
 )
 
-func accessibleRoles() map[string][]string {
-	const laptopServicePath = "/pcbook.LaptopService/"
-	return map[string][]string{
-		laptopServicePath + "CreateLaptop": {"admin"},
-		laptopServicePath + "UploadImage":  {"admin"},
-		laptopServicePath + "RateLaptop":   {"admin", "user"},
+// registeredMethods 返回服务器注册的所有 rpc
+func registeredMethods(grpcServer *grpc.Server) []string {
+	var methods []string
+	for name, info := range grpcServer.GetServiceInfo() {
+		for _, method := range info.Methods {
+			methods = append(methods, "/"+name+"/"+method.Name)
+		}
 	}
+	return methods
 }
 
 func loadTLSCredentials() (credentials.TransportCredentials, error) {
@@ -86,12 +94,26 @@ func loadTLSCredentials() (credentials.TransportCredentials, error) {
 func runGRPCServer(
 	authService pb.AuthServiceServer,
 	laptopServer pb.LaptopServiceServer,
+	reviewServer pb.ReviewServiceServer,
 	jwtManager *service.JWTManager,
+	userStore service.UserStore,
+	revocations *service.RevocationList,
+	apiKeys service.APIKeyStore,
+	peers service.PeerIdentities,
+	policy *service.RBACPolicyFile,
 	enableTLS bool,
 	listener net.Listener,
 ) error {
 	// 拦截器
-	interceptor := service.NewAuthInterceptor(jwtManager, accessibleRoles())
+	interceptor := service.NewAuthInterceptor(
+		jwtManager,
+		nil,
+		service.WithAccessPolicy(policy),
+		service.WithUserStore(userStore),
+		service.WithRevocationList(revocations),
+		service.WithAPIKeyStore(apiKeys),
+		service.WithPeerIdentities(peers),
+	)
 	serverOptions := []grpc.ServerOption{
 		grpc.UnaryInterceptor(interceptor.Unary()),   // 一元rpc拦截器
 		grpc.StreamInterceptor(interceptor.Stream()), // 流式rpc拦截器
@@ -111,9 +133,16 @@ func runGRPCServer(
 	// 注册服务
 	pb.RegisterAuthServiceServer(grpcServer, authService)
 	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+	pb.RegisterReviewServiceServer(grpcServer, reviewServer)
 	// 反射
 	reflection.Register(grpcServer)
 
+	// 没有出现在策略中的 rpc 会被拒绝访问, 启动时发现遗漏
+	err := policy.Require(registeredMethods(grpcServer))
+	if err != nil {
+		return err
+	}
+
 	log.Printf("Start GRPC server at %s, TLS = %t", listener.Addr().String(), enableTLS)
 	return grpcServer.Serve(listener)
 }
@@ -121,6 +150,7 @@ func runGRPCServer(
 func runRESTServer(
 	authService pb.AuthServiceServer,
 	laptopServer pb.LaptopServiceServer,
+	reviewServer pb.ReviewServiceServer,
 	jwtManager *service.JWTManager,
 	enableTLS bool,
 	listener net.Listener,
@@ -145,6 +175,35 @@ func runRESTServer(
 		return err
 	}
 
+	err = pb.RegisterReviewServiceHandlerFromEndpoint(ctx, mux, grpcEndpoint, dialOptons)
+	if err != nil {
+		return err
+	}
+
+	// 下载图片直接返回图片内容, 后注册的 handler 优先匹配, 替换网关生成的流式 JSON 响应
+	conn, err := grpc.DialContext(ctx, grpcEndpoint, dialOptons...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = mux.HandlePath("GET", service.ImageDownloadPath, service.NewImageDownloadHandler(mux, pb.NewLaptopServiceClient(conn)))
+	if err != nil {
+		return err
+	}
+
+	// 公开验证 token 的公钥, 其他服务据此验证 token
+	err = mux.HandlePath("GET", "/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		err := json.NewEncoder(w).Encode(jwtManager.JWKS())
+		if err != nil {
+			log.Print("cannot write jwks: ", err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
 	log.Printf("Start REST server at %s, TLS = %t", listener.Addr().String(), enableTLS)
 
 	if enableTLS {
@@ -158,6 +217,38 @@ func main() {
 	enableTLS := flag.Bool("tls", false, "enable SSL/TLS")
 	serverType := flag.String("type", "grpc", "type of server (grpc/rest)")
 	endPoint := flag.String("endpoint", "", "gRPC endpoint")
+	imageStoreType := flag.String("image-store", "disk", "type of image store (disk/s3)")
+	s3Endpoint := flag.String("s3-endpoint", "", "S3 endpoint, e.g. http://127.0.0.1:9000")
+	s3Region := flag.String("s3-region", "us-east-1", "S3 region")
+	s3Bucket := flag.String("s3-bucket", "", "S3 bucket of images")
+	s3Prefix := flag.String("s3-prefix", "", "S3 key prefix of images")
+	s3PartSize := flag.Int("s3-part-size", 5<<20, "S3 multipart upload part size in bytes")
+	imageVariants := flag.String("image-variants", "small=160x160,medium=480x480,large=1024x1024", "resized image variants (name=WxH,...)")
+	resizeWorkers := flag.Int("resize-workers", 4, "number of image resize workers")
+	maxImagePixels := flag.Int64("max-image-pixels", service.DefaultMaxImagePixels, "max width x height of images to resize (0 for unlimited)")
+	maxImagesPerLaptop := flag.Int64("max-images-per-laptop", 50, "max number of images per laptop (0 for unlimited)")
+	maxBytesPerLaptop := flag.Int64("max-bytes-per-laptop", 50<<20, "max total bytes of images per laptop (0 for unlimited)")
+	maxBytesPerUser := flag.Int64("max-bytes-per-user", 500<<20, "max total bytes of images uploaded by a user (0 for unlimited)")
+	imageCheckInterval := flag.Duration("image-check-interval", time.Hour, "interval of background image consistency check (0 to disable)")
+	imageCheckRepair := flag.Bool("image-check-repair", false, "repair issues found by background image consistency check")
+	ratingLog := flag.String("rating-log", "ratings.log", "append-only log file of rating events (empty to keep ratings in memory)")
+	maxRatingsPerUser := flag.Int("max-ratings-per-user", 30, "max number of ratings a user can submit per rating-rate-window (0 for unlimited)")
+	ratingRateWindow := flag.Duration("rating-rate-window", time.Minute, "window of per-user rating rate limit")
+	ratingBurstThreshold := flag.Int("rating-burst-threshold", 10, "number of extreme scores on a laptop within rating-burst-window to flag (0 to disable)")
+	ratingBurstWindow := flag.Duration("rating-burst-window", 10*time.Minute, "window of extreme score burst detection")
+	ratingExtremeMargin := flag.Float64("rating-extreme-margin", 0, "scores within this margin of the min or max score are extreme")
+	ratingAutoExclude := flag.Bool("rating-auto-exclude", false, "exclude flagged ratings from the aggregate without admin review")
+	ratingScale := flag.String("rating-scale", "1-10/1", "rating scale (min-max/step), e.g. 1-5/0.5 for 5 stars with half steps")
+	ratingPrior := flag.String("rating-prior", "", "prior of bayesian average rating (mean:weight), defaults to the middle of rating scale with weight 5")
+	refreshTokenDuration := flag.Duration("refresh-token-duration", 7*24*time.Hour, "lifetime of refresh tokens")
+	jwtKeys := flag.String("jwt-keys", "", "asymmetric JWT signing keys (kid=pem-file[@activate-at],...), rotated by RFC 3339 activation time, empty to sign with HS256 secret")
+	jwtIssuer := flag.String("jwt-issuer", "pcbook", "issuer (iss) of access tokens, verified tokens must match (empty to skip)")
+	jwtAudience := flag.String("jwt-audience", "pcbook", "audience (aud) of access tokens, verified tokens must match (empty to skip)")
+	jwtLeeway := flag.Duration("jwt-leeway", 30*time.Second, "allowed clock skew when checking exp, nbf and iat of access tokens")
+	rbacPolicy := flag.String("rbac-policy", "policy/rbac.yaml", "RBAC policy file (YAML or JSON) of gRPC methods")
+	mtlsIdentities := flag.String("mtls-identities", "", "roles of mTLS client certificate identities (identity=role[@org],...), identity: URI SAN such as spiffe://domain/path, dns:name or cn:name, requires -tls")
+	rbacReloadInterval := flag.Duration("rbac-reload-interval", 5*time.Second, "interval of checking the RBAC policy file for changes (0 to disable)")
+	similarityWeights := flag.String("similarity-weights", "", "weights of similar laptop recommendations (name=weight,...), names: cpu_cores, cpu_ghz, ram, storage, gpu_memory, screen_size, price, weight")
 
 	flag.Parse()
 	log.Printf("start server on port %d, TLS = %t", *port, *enableTLS)
@@ -169,13 +260,126 @@ func main() {
 	if err != nil {
 		log.Fatal("cannot seed users")
 	}
-	jwtManager := service.NewJWTManager(secretKey, tokenDuration)
-	authService := service.NewAuthService(userStore, jwtManager)
+	jwtOptions := []service.JWTManagerOption{
+		service.WithTokenIssuer(*jwtIssuer),
+		service.WithTokenAudience(*jwtAudience),
+		service.WithTokenLeeway(*jwtLeeway),
+	}
+	if len(*jwtKeys) > 0 {
+		signingKeys, err := service.ParseSigningKeys(*jwtKeys)
+		if err != nil {
+			log.Fatal("cannot load jwt keys: ", err)
+		}
+		// 被替换的密钥在 access token 有效期内仍可验证
+		keyRing, err := service.NewKeyRing(signingKeys, tokenDuration)
+		if err != nil {
+			log.Fatal("cannot load jwt keys: ", err)
+		}
+		jwtOptions = append(jwtOptions, service.WithSigningKeys(keyRing))
+	}
+	jwtManager := service.NewJWTManager(secretKey, tokenDuration, jwtOptions...)
+	revocations := service.NewRevocationList()
+	apiKeys := service.NewInMemoryAPIKeyStore()
+	authOptions := []service.AuthServiceOption{
+		service.WithRefreshTokenStore(service.NewInMemoryRefreshTokenStore(), *refreshTokenDuration),
+		service.WithTokenRevocation(revocations),
+		service.WithOrganizationStore(service.NewInMemoryOrganizationStore()),
+	}
+	// 只有 gRPC 服务器鉴权, REST 服务器转发到 gRPC 服务器
+	var policy *service.RBACPolicyFile
+	if *serverType == "grpc" {
+		policy, err = service.NewRBACPolicyFile(*rbacPolicy, *rbacReloadInterval)
+		if err != nil {
+			log.Fatal("cannot load rbac policy: ", err)
+		}
+		if *rbacReloadInterval > 0 {
+			policy.Start()
+			defer policy.Stop()
+		}
+		// API key 的权限范围使用 RBAC 策略中的权限
+		authOptions = append(authOptions, service.WithAPIKeys(apiKeys, policy))
+	}
+	authService := service.NewAuthService(userStore, jwtManager, authOptions...)
 	// laptopServer
 	laptopStore := service.NewInMemoryLaptopStore()
-	imageStore := service.NewDiskImageStore("images")
-	ratingStore := service.NewInMemoryRatingStore()
-	laptopServer := service.NewLaptopServer(laptopStore, imageStore, ratingStore)
+	variants, err := service.ParseImageVariants(*imageVariants)
+	if err != nil {
+		log.Fatal("cannot parse image variants: ", err)
+	}
+	var baseImageStore service.ImageStore = service.NewDiskImageStore("images")
+	if *imageStoreType == "s3" {
+		// 访问密钥从环境变量读取, 避免出现在命令行中
+		baseImageStore, err = service.NewS3ImageStore(service.S3Config{
+			Endpoint:  *s3Endpoint,
+			Region:    *s3Region,
+			Bucket:    *s3Bucket,
+			Prefix:    *s3Prefix,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			PartSize:  *s3PartSize,
+		})
+		if err != nil {
+			log.Fatal("cannot create s3 image store: ", err)
+		}
+	}
+	imageStore := service.NewResizingImageStore(baseImageStore, variants, *resizeWorkers, 100, service.WithMaxImagePixels(*maxImagePixels))
+	var ratingStore service.RatingStore = service.NewInMemoryRatingStore()
+	// REST 代理进程不保存评分, 只有 gRPC 服务器写评分日志
+	if *serverType == "grpc" && len(*ratingLog) > 0 {
+		fileRatingStore, err := service.NewFileRatingStore(*ratingLog)
+		if err != nil {
+			log.Fatal("cannot open rating log: ", err)
+		}
+		defer fileRatingStore.Close()
+		ratingStore = fileRatingStore
+	}
+	ratingPolicy, err := service.ParseRatingPolicy(*ratingScale)
+	if err != nil {
+		log.Fatal("cannot parse rating scale: ", err)
+	}
+	bayesianPrior := service.DefaultBayesianPrior(ratingPolicy)
+	if len(*ratingPrior) > 0 {
+		bayesianPrior, err = service.ParseBayesianPrior(*ratingPrior)
+		if err != nil {
+			log.Fatal("cannot parse rating prior: ", err)
+		}
+	}
+	ratingGuard := service.NewRatingGuard(service.RatingGuardConfig{
+		MaxRatingsPerUser: *maxRatingsPerUser,
+		RateWindow:        *ratingRateWindow,
+		BurstThreshold:    *ratingBurstThreshold,
+		BurstWindow:       *ratingBurstWindow,
+		ExtremeMargin:     *ratingExtremeMargin,
+		AutoExclude:       *ratingAutoExclude,
+	}, ratingPolicy)
+	weights, err := service.ParseSimilarityWeights(*similarityWeights)
+	if err != nil {
+		log.Fatal("cannot parse similarity weights: ", err)
+	}
+	imageQuota := service.NewImageQuota(service.QuotaConfig{
+		MaxImagesPerLaptop: *maxImagesPerLaptop,
+		MaxBytesPerLaptop:  *maxBytesPerLaptop,
+		MaxBytesPerUser:    *maxBytesPerUser,
+	})
+	laptopServer := service.NewLaptopServer(
+		laptopStore,
+		imageStore,
+		ratingStore,
+		service.WithImageQuota(imageQuota),
+		service.WithRatingPolicy(ratingPolicy),
+		service.WithBayesianPrior(bayesianPrior),
+		service.WithRatingGuard(ratingGuard),
+		service.WithSimilarityWeights(weights),
+	)
+	reviewStore := service.NewInMemoryReviewStore()
+	reviewServer := service.NewReviewServer(reviewStore, laptopStore, ratingStore, ratingPolicy, ratingGuard)
+
+	if _, ok := baseImageStore.(service.ImageChecker); ok && *serverType == "grpc" && *imageCheckInterval > 0 {
+		// 后台检查图片存储一致性, REST 代理进程没有 laptop 数据, 不能检查
+		reconciler := service.NewImageReconciler(imageStore, laptopStore, imageQuota, *imageCheckInterval, *imageCheckRepair)
+		reconciler.Start()
+		defer reconciler.Stop()
+	}
 
 	address := fmt.Sprintf("0.0.0.0:%d", *port)
 	listener, err := net.Listen("tcp", address)
@@ -184,12 +388,20 @@ func main() {
 	}
 
 	if *serverType == "grpc" {
-		err = runGRPCServer(authService, laptopServer, jwtManager, *enableTLS, listener)
+		peers, err := service.ParsePeerIdentities(*mtlsIdentities)
+		if err != nil {
+			log.Fatal("cannot parse mtls identities: ", err)
+		}
+		if len(peers) > 0 && !*enableTLS {
+			log.Print("mtls identities are ignored without -tls")
+		}
+
+		err = runGRPCServer(authService, laptopServer, reviewServer, jwtManager, userStore, revocations, apiKeys, peers, policy, *enableTLS, listener)
 		if err != nil {
 			log.Fatal("cannot start server - runGRPCServer: %w", err)
 		}
 	} else {
-		err = runRESTServer(authService, laptopServer, jwtManager, *enableTLS, listener, *endPoint)
+		err = runRESTServer(authService, laptopServer, reviewServer, jwtManager, *enableTLS, listener, *endPoint)
 		if err != nil {
 			log.Fatal("cannot start server - runRESTServer: %w", err)
 		}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrAPIKeyNotFound API key 不存在返回此错误
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// API key 明文的前缀, 方便在日志和代码中发现泄漏的 key
+const apiKeyPrefix = "pcb_"
+
+// APIKey 保存的 API key, 只保存 key 的哈希
+//
+// API key 代表创建它的用户, 只能访问 Scopes 中的权限包含的 rpc, 并且不能超过用户角色的权限
+type APIKey struct {
+	ID         string
+	Hash       string
+	Prefix     string // 明文的前几个字符, 用于辨认 key
+	Username   string
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time // 为零值表示不过期
+	LastUsedAt time.Time // 为零值表示没有使用过
+}
+
+// Expired key 已经过期
+func (key *APIKey) Expired(now time.Time) bool {
+	return !key.ExpiresAt.IsZero() && now.After(key.ExpiresAt)
+}
+
+func (key *APIKey) Clone() *APIKey {
+	other := *key
+	other.Scopes = append([]string(nil), key.Scopes...)
+	return &other
+}
+
+type APIKeyStore interface {
+	// 保存新的 key
+	Save(key *APIKey) error
+	// 通过哈希查找 key, 没有时返回 nil
+	FindByHash(hash string) (*APIKey, error)
+	// 按创建时间返回用户的所有 key
+	List(username string) ([]*APIKey, error)
+	// 删除用户的 key, 不存在或属于其他用户时返回 ErrAPIKeyNotFound
+	Delete(username string, id string) error
+	// 删除用户的所有 key
+	DeleteByUser(username string) error
+	// 记录 key 最后一次使用的时间
+	Touch(id string, usedAt time.Time) error
+}
+
+// NewAPIKey 生成随机的 API key, 返回明文和需要保存的记录
+func NewAPIKey(username string, name string, scopes []string, expiresAt time.Time) (string, *APIKey, error) {
+	data := make([]byte, 32)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot generate api key: %w", err)
+	}
+
+	plaintext := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(data)
+	key := &APIKey{
+		ID:        uuid.New().String(),
+		Hash:      HashAPIKey(plaintext),
+		Prefix:    plaintext[:len(apiKeyPrefix)+6],
+		Username:  username,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	return plaintext, key, nil
+}
+
+// HashAPIKey 计算 API key 的 SHA-256
+func HashAPIKey(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+type InMemoryAPIKeyStore struct {
+	mutex sync.RWMutex
+	keys  map[string]*APIKey // id -> key
+	ids   map[string]string  // hash -> id
+}
+
+// NewInMemoryAPIKeyStore 创建 InMemoryAPIKeyStore 实例
+func NewInMemoryAPIKeyStore() *InMemoryAPIKeyStore {
+	return &InMemoryAPIKeyStore{
+		keys: make(map[string]*APIKey),
+		ids:  make(map[string]string),
+	}
+}
+
+func (store *InMemoryAPIKeyStore) Save(key *APIKey) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.keys[key.ID] != nil || len(store.ids[key.Hash]) > 0 {
+		return ErrAlreadyExits
+	}
+
+	store.keys[key.ID] = key.Clone()
+	store.ids[key.Hash] = key.ID
+	return nil
+}
+
+func (store *InMemoryAPIKeyStore) FindByHash(hash string) (*APIKey, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	key := store.keys[store.ids[hash]]
+	if key == nil {
+		return nil, nil
+	}
+	return key.Clone(), nil
+}
+
+func (store *InMemoryAPIKeyStore) List(username string) ([]*APIKey, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var keys []*APIKey
+	for _, key := range store.keys {
+		if key.Username == username {
+			keys = append(keys, key.Clone())
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (store *InMemoryAPIKeyStore) Delete(username string, id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	key := store.keys[id]
+	if key == nil || key.Username != username {
+		return ErrAPIKeyNotFound
+	}
+
+	delete(store.ids, key.Hash)
+	delete(store.keys, id)
+	return nil
+}
+
+func (store *InMemoryAPIKeyStore) DeleteByUser(username string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for id, key := range store.keys {
+		if key.Username == username {
+			delete(store.ids, key.Hash)
+			delete(store.keys, id)
+		}
+	}
+	return nil
+}
+
+func (store *InMemoryAPIKeyStore) Touch(id string, usedAt time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	key := store.keys[id]
+	if key == nil {
+		return ErrAPIKeyNotFound
+	}
+	key.LastUsedAt = usedAt
+	return nil
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, other := range scopes {
+		if other == scope {
+			return true
+		}
+	}
+	return false
+}
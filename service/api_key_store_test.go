@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"go-pcbook-micro/pb"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const testAPIKeyPolicy = `
+permissions:
+  apikey:
+    - /pcbook.AuthService/CreateApiKey
+  laptop.rate:
+    - /pcbook.LaptopService/RateLaptop
+  laptop.manage:
+    - /pcbook.LaptopService/CreateLaptop
+roles:
+  user:
+    permissions: [apikey, laptop.rate]
+  admin:
+    inherits: [user]
+    permissions: [laptop.manage]
+`
+
+func TestAPIKeys(t *testing.T) {
+	t.Parallel()
+
+	policy, err := ParseRBACPolicy([]byte(testAPIKeyPolicy))
+	require.NoError(t, err)
+
+	userStore := NewInMemoryUserStore()
+	user, err := NewUser("alice", "password1", "user")
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(user))
+
+	apiKeys := NewInMemoryAPIKeyStore()
+	jwtManager := NewJWTManager("secret", time.Minute)
+	server := NewAuthService(userStore, jwtManager, WithAPIKeys(apiKeys, policy))
+	interceptor := NewAuthInterceptor(jwtManager, nil, WithAccessPolicy(policy), WithUserStore(userStore), WithAPIKeyStore(apiKeys))
+
+	alice := contextWithClaims(context.Background(), &UserClaims{Username: "alice", Role: "user"})
+	create := func(ctx context.Context, scopes ...string) (*pb.CreateApiKeyResponse, error) {
+		return server.CreateApiKey(ctx, &pb.CreateApiKeyRequest{Name: "ci", Scopes: scopes})
+	}
+
+	_, err = create(alice)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = create(alice, "unknown")
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = server.CreateApiKey(alice, &pb.CreateApiKeyRequest{Name: "ci", Scopes: []string{"laptop.rate"}, ExpiresAt: timestamppb.New(time.Now().Add(-time.Minute))})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// 不能超过用户角色拥有的权限, 以后升级角色也不会获得
+	_, err = create(alice, "laptop.rate", "laptop.manage")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// 只保存哈希
+	res, err := create(alice, "laptop.rate")
+	require.NoError(t, err)
+	require.Contains(t, res.GetKey(), res.GetApiKey().GetPrefix())
+	stored, err := apiKeys.FindByHash(res.GetKey())
+	require.NoError(t, err)
+	require.Nil(t, stored)
+
+	withKey := func(key string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", key))
+	}
+
+	claims, err := interceptor.authorize(withKey(res.GetKey()), "/pcbook.LaptopService/RateLaptop")
+	require.NoError(t, err)
+	require.Equal(t, "alice", claims.Username)
+	require.Equal(t, res.GetApiKey().GetId(), claims.APIKeyID)
+
+	// 不能超过 key 的权限范围
+	_, err = interceptor.authorize(withKey(res.GetKey()), "/pcbook.LaptopService/CreateLaptop")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = interceptor.authorize(withKey(res.GetKey()), "/pcbook.AuthService/CreateApiKey")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = interceptor.authorize(withKey("pcb_unknown"), "/pcbook.LaptopService/RateLaptop")
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// 使用 key 创建的 key 不能超过当前 key 的权限范围
+	_, err = create(contextWithClaims(context.Background(), claims), "apikey")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	list, err := server.ListApiKeys(alice, &pb.ListApiKeysRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.GetApiKeys(), 1)
+	require.NotNil(t, list.GetApiKeys()[0].GetLastUsedAt())
+	require.Nil(t, list.GetApiKeys()[0].GetExpiresAt())
+
+	// 其他用户的 key 视为不存在
+	bob := contextWithClaims(context.Background(), &UserClaims{Username: "bob", Role: "user"})
+	_, err = server.RevokeApiKey(bob, &pb.RevokeApiKeyRequest{Id: res.GetApiKey().GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = server.RevokeApiKey(alice, &pb.RevokeApiKeyRequest{Id: res.GetApiKey().GetId()})
+	require.NoError(t, err)
+	_, err = interceptor.authorize(withKey(res.GetKey()), "/pcbook.LaptopService/RateLaptop")
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// 过期的 key 和禁用的用户
+	plaintext, key, err := NewAPIKey("alice", "expired", []string{"laptop.rate"}, time.Now().Add(-time.Second))
+	require.NoError(t, err)
+	require.NoError(t, apiKeys.Save(key))
+	_, err = interceptor.authorize(withKey(plaintext), "/pcbook.LaptopService/RateLaptop")
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	res, err = create(alice, "laptop.rate")
+	require.NoError(t, err)
+	user.Disabled = true
+	require.NoError(t, userStore.Update(user))
+	_, err = interceptor.authorize(withKey(res.GetKey()), "/pcbook.LaptopService/RateLaptop")
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
@@ -2,23 +2,114 @@ package service
 
 import (
 	"context"
+	"errors"
 	"log"
+	"time"
 
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
+// AccessPolicy 决定哪些角色可以访问 rpc
+type AccessPolicy interface {
+	// IsPublic 不需要登录就能访问
+	IsPublic(method string) bool
+	// Allow 角色可以访问 rpc
+	Allow(role string, method string) bool
+}
+
+// ScopedAccessPolicy 可以按权限限定 API key 访问范围的策略, 例如 RBACPolicyFile
+type ScopedAccessPolicy interface {
+	AccessPolicy
+	// HasPermission 策略中定义了权限
+	HasPermission(permission string) bool
+	// RoleHasPermission 角色拥有权限, 包括继承的
+	RoleHasPermission(role string, permission string) bool
+	// AllowScopes 角色可以访问 rpc, 并且 rpc 属于 scopes 中的某个权限
+	AllowScopes(role string, scopes []string, method string) bool
+}
+
+// API key 使用的 metadata, 代替 authorization 中的 access token
+const apiKeyHeader = "x-api-key"
+
+// accessibleRoleMap rpc -> 可以访问的角色, 没有列出的 rpc 每个人都可以访问
+type accessibleRoleMap map[string][]string
+
+func (roles accessibleRoleMap) IsPublic(method string) bool {
+	_, ok := roles[method]
+	return !ok
+}
+
+func (roles accessibleRoleMap) Allow(role string, method string) bool {
+	for _, accessibleRole := range roles[method] {
+		if accessibleRole == role {
+			return true
+		}
+	}
+	return false
+}
+
 // AuthInterceptor 授权拦截器
 type AuthInterceptor struct {
-	jwtManager      *JWTManager
-	accessibleRoles map[string][]string // 角色列表
+	jwtManager  *JWTManager
+	policy      AccessPolicy
+	userStore   UserStore       // 为 nil 时只验证 token
+	revocations *RevocationList // 为 nil 时不检查吊销
+	apiKeys     APIKeyStore     // 为 nil 时不接受 API key
+	peers       PeerIdentities  // 为 nil 时不使用客户端证书的身份
+}
+
+// AuthInterceptorOption AuthInterceptor 的可选配置
+type AuthInterceptorOption func(ai *AuthInterceptor)
+
+// WithUserStore 拒绝已删除或禁用的用户, 并使用用户当前的角色鉴权
+func WithUserStore(userStore UserStore) AuthInterceptorOption {
+	return func(ai *AuthInterceptor) {
+		ai.userStore = userStore
+	}
+}
+
+// WithRevocationList 拒绝被吊销的 access token
+func WithRevocationList(revocations *RevocationList) AuthInterceptorOption {
+	return func(ai *AuthInterceptor) {
+		ai.revocations = revocations
+	}
+}
+
+// WithAPIKeyStore 接受 x-api-key 中的 API key, 需要同时使用 WithUserStore 和 ScopedAccessPolicy
+func WithAPIKeyStore(apiKeys APIKeyStore) AuthInterceptorOption {
+	return func(ai *AuthInterceptor) {
+		ai.apiKeys = apiKeys
+	}
+}
+
+// WithPeerIdentities 没有 access token 和 API key 时, 使用 mTLS 客户端证书的身份对应的角色鉴权
+func WithPeerIdentities(peers PeerIdentities) AuthInterceptorOption {
+	return func(ai *AuthInterceptor) {
+		ai.peers = peers
+	}
+}
+
+// WithAccessPolicy 使用策略代替 accessibleRoles 鉴权, 例如 RBACPolicyFile
+func WithAccessPolicy(policy AccessPolicy) AuthInterceptorOption {
+	return func(ai *AuthInterceptor) {
+		ai.policy = policy
+	}
 }
 
-// NewAuthInterceptor 创建实例
-func NewAuthInterceptor(jwtManager *JWTManager, accessibleRoles map[string][]string) *AuthInterceptor {
-	return &AuthInterceptor{jwtManager, accessibleRoles}
+// NewAuthInterceptor 创建实例, accessibleRoles 中没有列出的 rpc 每个人都可以访问
+func NewAuthInterceptor(jwtManager *JWTManager, accessibleRoles map[string][]string, options ...AuthInterceptorOption) *AuthInterceptor {
+	ai := &AuthInterceptor{
+		jwtManager: jwtManager,
+		policy:     accessibleRoleMap(accessibleRoles),
+	}
+	for _, option := range options {
+		option(ai)
+	}
+	return ai
 }
 
 // Unary 创建一元rpc拦截器
@@ -31,12 +122,12 @@ func (ai *AuthInterceptor) Unary() grpc.UnaryServerInterceptor {
 	) (interface{}, error) {
 		log.Println("--> unary interceptor: ", info.FullMethod)
 
-		err := ai.authorize(ctx, info.FullMethod)
+		claims, err := ai.authorize(ctx, info.FullMethod)
 		if err != nil {
 			return nil, err
 		}
 
-		return handler(ctx, req)
+		return handler(contextWithClaims(ctx, claims), req)
 	}
 }
 
@@ -50,42 +141,216 @@ func (ai *AuthInterceptor) Stream() grpc.StreamServerInterceptor {
 	) error {
 		log.Println("--> stream interceptor: ", info.FullMethod)
 
-		err := ai.authorize(stream.Context(), info.FullMethod)
+		claims, err := ai.authorize(stream.Context(), info.FullMethod)
 		if err != nil {
 			return err
 		}
-		return handler(srv, stream)
+		return handler(srv, &claimsServerStream{stream, contextWithClaims(stream.Context(), claims)})
 	}
 }
 
-// 鉴权
-func (ai *AuthInterceptor) authorize(ctx context.Context, method string) error {
-	accessibleRoles, ok := ai.accessibleRoles[method]
-	if !ok {
+// 鉴权, 返回已验证的用户信息, 没有凭据访问每个人都可以访问的 rpc 时返回 nil
+//
+// 每个人都可以访问的 rpc 也会验证请求中的凭据, handler 据此限定用户所属的租户;
+// 凭据过期或无效时当作未登录, 否则 token 过期后无法登录和刷新 token
+func (ai *AuthInterceptor) authorize(ctx context.Context, method string) (*UserClaims, error) {
+	claims, err := ai.authenticate(ctx)
+	if ai.policy.IsPublic(method) {
 		// 每个人都可以访问
-		return nil
+		if status.Code(err) == codes.Unauthenticated {
+			return nil, nil
+		}
+		return claims, err
 	}
+	if err != nil {
+		return nil, err
+	}
+	if claims == nil {
+		if _, ok := metadata.FromIncomingContext(ctx); !ok {
+			return nil, status.Errorf(codes.Unauthenticated, "metadata is not provided")
+		}
+		return nil, status.Errorf(codes.Unauthenticated, "authorization token is not provided")
+	}
+	return ai.allow(claims, method)
+}
 
-	md, ok := metadata.FromIncomingContext(ctx)
-	if !ok {
-		return status.Errorf(codes.Unauthenticated, "metadata is not provided")
+// authenticate 依次使用 API key, access token 和客户端证书验证用户, 没有凭据时返回 nil
+func (ai *AuthInterceptor) authenticate(ctx context.Context) (*UserClaims, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md[apiKeyHeader]; len(values) > 0 {
+		return ai.authenticateAPIKey(values[0])
 	}
 
 	values := md["authorization"]
 	if len(values) == 0 {
-		return status.Errorf(codes.Unauthenticated, "authorization token is not provided")
+		// 服务之间的调用只使用 mTLS, 没有 token
+		if claims, found := ai.peerClaims(ctx); found {
+			return claims, nil
+		}
+		return nil, nil
 	}
 
 	accessToken := values[0]
 	claims, err := ai.jwtManager.Verify(accessToken)
 	if err != nil {
-		return status.Errorf(codes.Unauthenticated, "access token is invalid: %v", err)
+		return nil, tokenError(err)
+	}
+	if ai.revocations != nil && ai.revocations.IsRevoked(claims.Id) {
+		return nil, status.Errorf(codes.Unauthenticated, "access token is revoked")
 	}
 
-	for _, role := range accessibleRoles {
-		if role == claims.Role {
-			return nil
+	if ai.userStore != nil {
+		user, err := ai.findActiveUser(claims.Username)
+		if err != nil {
+			return nil, err
+		}
+		// 角色和组织修改后立即生效
+		claims.Role = user.Role
+		claims.OrgID = user.OrgID
+		claims.OrgRole = user.OrgRole
+	}
+	return claims, nil
+}
+
+// allow 角色可以访问 rpc, API key 还必须在权限范围内
+func (ai *AuthInterceptor) allow(claims *UserClaims, method string) (*UserClaims, error) {
+	if len(claims.APIKeyID) > 0 {
+		policy, ok := ai.policy.(ScopedAccessPolicy)
+		if ok && policy.AllowScopes(claims.Role, claims.Scopes, method) {
+			return claims, nil
 		}
+		return nil, status.Errorf(codes.PermissionDenied, "api key has no permission to access this RPC")
 	}
-	return status.Errorf(codes.PermissionDenied, "no permission to access this RPC")
+	if ai.policy.Allow(claims.Role, method) {
+		return claims, nil
+	}
+	return nil, status.Errorf(codes.PermissionDenied, "no permission to access this RPC")
+}
+
+// authenticateAPIKey 验证 API key, 返回 key 的用户和权限范围
+func (ai *AuthInterceptor) authenticateAPIKey(plaintext string) (*UserClaims, error) {
+	if _, ok := ai.policy.(ScopedAccessPolicy); !ok || ai.apiKeys == nil || ai.userStore == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "api keys are not accepted")
+	}
+
+	key, err := ai.apiKeys.FindByHash(HashAPIKey(plaintext))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find api key: %v", err)
+	}
+	now := time.Now()
+	if key == nil || key.Expired(now) {
+		return nil, status.Errorf(codes.Unauthenticated, "api key is invalid or expired")
+	}
+
+	user, err := ai.findActiveUser(key.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ai.apiKeys.Touch(key.ID, now)
+	if err != nil {
+		log.Printf("cannot record last use of api key %s: %v", key.ID, err)
+	}
+
+	claims := &UserClaims{
+		Username: user.Username,
+		Role:     user.Role,
+		OrgID:    user.OrgID,
+		OrgRole:  user.OrgRole,
+		APIKeyID: key.ID,
+		Scopes:   key.Scopes,
+	}
+	claims.Subject = user.Username
+	return claims, nil
+}
+
+// peerClaims 客户端证书的身份对应的用户信息, 用户名为证书的身份
+func (ai *AuthInterceptor) peerClaims(ctx context.Context) (*UserClaims, bool) {
+	if ai.peers == nil {
+		return nil, false
+	}
+	identity, peerRole, ok := ai.peers.Lookup(ctx)
+	if !ok {
+		return nil, false
+	}
+
+	claims := &UserClaims{
+		Username: identity,
+		Role:     peerRole.Role,
+		OrgID:    peerRole.OrgID,
+	}
+	claims.Subject = identity
+	return claims, true
+}
+
+// findActiveUser 查找用户, 已删除或禁用的用户返回 Unauthenticated
+func (ai *AuthInterceptor) findActiveUser(username string) (*User, error) {
+	user, err := ai.userStore.Find(username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
+	}
+	if user == nil || user.Disabled {
+		return nil, status.Errorf(codes.Unauthenticated, "user %s is deleted or disabled", username)
+	}
+	return user, nil
+}
+
+// token 验证失败的原因, 放在 ErrorInfo 详情中, 客户端据此决定是否刷新 token
+const (
+	TokenErrorDomain        = "pcbook"
+	TokenErrorExpired       = "TOKEN_EXPIRED"
+	TokenErrorNotYetValid   = "TOKEN_NOT_YET_VALID"
+	TokenErrorWrongIssuer   = "TOKEN_WRONG_ISSUER"
+	TokenErrorWrongAudience = "TOKEN_WRONG_AUDIENCE"
+	TokenErrorInvalid       = "TOKEN_INVALID"
+)
+
+// tokenError 将验证失败转换为 Unauthenticated 错误, 不同原因使用不同的消息和 ErrorInfo reason
+func tokenError(err error) error {
+	message, reason := "access token is invalid", TokenErrorInvalid
+	switch {
+	case errors.Is(err, ErrTokenExpired):
+		message, reason = "access token is expired", TokenErrorExpired
+	case errors.Is(err, ErrTokenNotYetValid):
+		message, reason = "access token is not valid yet", TokenErrorNotYetValid
+	case errors.Is(err, ErrTokenWrongIssuer):
+		message, reason = "access token has wrong issuer", TokenErrorWrongIssuer
+	case errors.Is(err, ErrTokenWrongAudience):
+		message, reason = "access token has wrong audience", TokenErrorWrongAudience
+	}
+
+	st := status.Newf(codes.Unauthenticated, "%s: %v", message, err)
+	detailed, detailErr := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: reason,
+		Domain: TokenErrorDomain,
+	})
+	if detailErr != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+type claimsContextKey struct{}
+
+// ClaimsFromContext 获取拦截器验证过的用户信息
+func ClaimsFromContext(ctx context.Context) (*UserClaims, bool) {
+	claims, ok := ctx.Value(claimsContextKey{}).(*UserClaims)
+	return claims, ok && claims != nil
+}
+
+func contextWithClaims(ctx context.Context, claims *UserClaims) context.Context {
+	if claims == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, claimsContextKey{}, claims)
+}
+
+// claimsServerStream 携带用户信息上下文的流
+type claimsServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *claimsServerStream) Context() context.Context {
+	return stream.ctx
 }
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthInterceptorUserStore(t *testing.T) {
+	t.Parallel()
+
+	const method = "/pcbook.LaptopService/CreateLaptop"
+
+	jwtManager := NewJWTManager("secret", time.Minute)
+	userStore := NewInMemoryUserStore()
+	interceptor := NewAuthInterceptor(jwtManager, map[string][]string{method: {"admin"}}, WithUserStore(userStore))
+
+	user, err := NewUser("admin1", "secret", "admin")
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(user))
+
+	accessToken, err := jwtManager.Generate(user)
+	require.NoError(t, err)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", accessToken))
+
+	claims, err := interceptor.authorize(ctx, method)
+	require.NoError(t, err)
+	require.Equal(t, "admin1", claims.Username)
+
+	// 修改角色后已有的 token 使用新的角色
+	user.Role = "user"
+	require.NoError(t, userStore.Update(user))
+	_, err = interceptor.authorize(ctx, method)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// 禁用或删除的用户的 token 被拒绝
+	user.Role = "admin"
+	user.Disabled = true
+	require.NoError(t, userStore.Update(user))
+	_, err = interceptor.authorize(ctx, method)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	require.NoError(t, userStore.Delete("admin1"))
+	_, err = interceptor.authorize(ctx, method)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestAuthInterceptorRegisteredClaims(t *testing.T) {
+	t.Parallel()
+
+	const method = "/pcbook.LaptopService/CreateLaptop"
+
+	user, err := NewUser("admin1", "secret", "admin")
+	require.NoError(t, err)
+
+	issued := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	issuer := NewJWTManager("secret", time.Minute, WithTokenIssuer("pcbook"), WithTokenAudience("pcbook"))
+	issuer.now = func() time.Time { return issued }
+	accessToken, err := issuer.Generate(user)
+	require.NoError(t, err)
+
+	verify := func(now time.Time, options ...JWTManagerOption) error {
+		jwtManager := NewJWTManager("secret", time.Minute, options...)
+		jwtManager.now = func() time.Time { return now }
+		interceptor := NewAuthInterceptor(jwtManager, map[string][]string{method: {"admin"}})
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", accessToken))
+		_, err := interceptor.authorize(ctx, method)
+		return err
+	}
+	requireReason := func(err error, reason string) {
+		st := status.Convert(err)
+		require.Equal(t, codes.Unauthenticated, st.Code())
+		require.Len(t, st.Details(), 1)
+		require.Equal(t, reason, st.Details()[0].(*errdetails.ErrorInfo).Reason)
+	}
+
+	claims, err := issuer.Verify(accessToken)
+	require.NoError(t, err)
+	require.Equal(t, "pcbook", claims.Issuer)
+	require.Equal(t, "pcbook", claims.Audience)
+	require.Equal(t, "admin1", claims.Subject)
+	require.NotEmpty(t, claims.Id)
+	require.Equal(t, issued.Unix(), claims.IssuedAt)
+	require.Equal(t, issued.Unix(), claims.NotBefore)
+
+	require.NoError(t, verify(issued.Add(30*time.Second), WithTokenIssuer("pcbook"), WithTokenAudience("pcbook")))
+
+	// 过期和未生效, 在允许的时钟偏差内仍然有效
+	requireReason(verify(issued.Add(2*time.Minute)), TokenErrorExpired)
+	require.NoError(t, verify(issued.Add(2*time.Minute), WithTokenLeeway(2*time.Minute)))
+	requireReason(verify(issued.Add(-time.Minute)), TokenErrorNotYetValid)
+	require.NoError(t, verify(issued.Add(-time.Minute), WithTokenLeeway(2*time.Minute)))
+
+	requireReason(verify(issued, WithTokenIssuer("other")), TokenErrorWrongIssuer)
+	requireReason(verify(issued, WithTokenAudience("other")), TokenErrorWrongAudience)
+
+	accessToken = "not a token"
+	requireReason(verify(issued), TokenErrorInvalid)
+}
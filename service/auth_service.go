@@ -2,21 +2,83 @@ package service
 
 import (
 	"context"
+	"errors"
 	"go-pcbook-micro/pb"
+	"log"
+	"time"
 
+	"github.com/google/uuid"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// 自己注册的用户的角色
+const defaultUserRole = "user"
+
+// refresh token 默认的有效期
+const defaultRefreshTokenDuration = 7 * 24 * time.Hour
+
 // AuthService 授权服务
 type AuthService struct {
-	userStore  UserStore
-	jwtManager *JWTManager
+	userStore            UserStore
+	jwtManager           *JWTManager
+	refreshTokens        RefreshTokenStore
+	refreshTokenDuration time.Duration
+	revocations          *RevocationList
+	orgStore             OrganizationStore
+	apiKeys              APIKeyStore
+	apiKeyPolicy         ScopedAccessPolicy // 为 nil 时不能创建 API key
+}
+
+// AuthServiceOption AuthService 的可选配置
+type AuthServiceOption func(server *AuthService)
+
+// WithRefreshTokenStore 保存 refresh token 的存储, 默认保存在内存中
+func WithRefreshTokenStore(refreshTokens RefreshTokenStore, duration time.Duration) AuthServiceOption {
+	return func(server *AuthService) {
+		server.refreshTokens = refreshTokens
+		server.refreshTokenDuration = duration
+	}
+}
+
+// WithTokenRevocation 登出时吊销 access token, 需要与 AuthInterceptor 使用同一个列表
+func WithTokenRevocation(revocations *RevocationList) AuthServiceOption {
+	return func(server *AuthService) {
+		server.revocations = revocations
+	}
+}
+
+// WithOrganizationStore 保存组织的存储, 默认保存在内存中
+func WithOrganizationStore(orgStore OrganizationStore) AuthServiceOption {
+	return func(server *AuthService) {
+		server.orgStore = orgStore
+	}
+}
+
+// WithAPIKeys 保存 API key 的存储, 需要与 AuthInterceptor 使用同一个存储, policy 用于检查 key 的权限范围
+func WithAPIKeys(apiKeys APIKeyStore, policy ScopedAccessPolicy) AuthServiceOption {
+	return func(server *AuthService) {
+		server.apiKeys = apiKeys
+		server.apiKeyPolicy = policy
+	}
 }
 
 // NewAuthService 创建授权服务实例
-func NewAuthService(userStore UserStore, jwtManager *JWTManager) *AuthService {
-	return &AuthService{userStore, jwtManager}
+func NewAuthService(userStore UserStore, jwtManager *JWTManager, options ...AuthServiceOption) *AuthService {
+	server := &AuthService{
+		userStore:            userStore,
+		jwtManager:           jwtManager,
+		refreshTokens:        NewInMemoryRefreshTokenStore(),
+		refreshTokenDuration: defaultRefreshTokenDuration,
+		revocations:          NewRevocationList(),
+		orgStore:             NewInMemoryOrganizationStore(),
+		apiKeys:              NewInMemoryAPIKeyStore(),
+	}
+	for _, option := range options {
+		option(server)
+	}
+	return server
 }
 
 func (server *AuthService) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
@@ -27,14 +89,720 @@ func (server *AuthService) Login(ctx context.Context, req *pb.LoginRequest) (*pb
 	if user == nil || !user.IsCorrectPassword(req.GetPassword()) {
 		return nil, status.Errorf(codes.NotFound, "incorrect username/password")
 	}
+	if user.Disabled {
+		return nil, status.Errorf(codes.PermissionDenied, "account is disabled")
+	}
 
 	token, err := server.jwtManager.Generate(user)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "cannot generate access token")
 	}
 
+	// 每次登录开始一个新的 refresh token family
+	refreshToken, err := server.issueRefreshToken(user.Username, uuid.New().String())
+	if err != nil {
+		return nil, err
+	}
+
 	res := &pb.LoginResponse{
-		AccessToken: token,
+		AccessToken:  token,
+		RefreshToken: refreshToken,
+	}
+	return res, nil
+}
+
+// RefreshToken 使用 refresh token 换取新的 access token 和 refresh token, 旧的 refresh token 失效
+func (server *AuthService) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
+	token, err := server.refreshTokens.Consume(HashRefreshToken(req.GetRefreshToken()))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find refresh token: %v", err)
+	}
+	if token == nil || time.Now().After(token.ExpiresAt) {
+		return nil, status.Errorf(codes.Unauthenticated, "refresh token is invalid or expired")
+	}
+	if token.Used {
+		// 已经换发过的 token 被再次使用, 吊销这次登录的所有 token
+		log.Printf("refresh token reuse detected for user %s", token.Username)
+		err = server.refreshTokens.DeleteFamily(token.FamilyID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot revoke refresh tokens: %v", err)
+		}
+		return nil, status.Errorf(codes.Unauthenticated, "refresh token is already used")
+	}
+
+	user, err := server.userStore.Find(token.Username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
+	}
+	if user == nil || user.Disabled {
+		return nil, status.Errorf(codes.Unauthenticated, "user %s is deleted or disabled", token.Username)
+	}
+
+	accessToken, err := server.jwtManager.Generate(user)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot generate access token")
+	}
+	refreshToken, err := server.issueRefreshToken(user.Username, token.FamilyID)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.RefreshTokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}
+	return res, nil
+}
+
+// Logout 吊销当前的 access token 和 refresh token, all_sessions 为 true 时吊销用户的所有 refresh token
+func (server *AuthService) Logout(ctx context.Context, req *pb.LogoutRequest) (*pb.LogoutResponse, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "user is not authenticated")
+	}
+	log.Printf("receive a logout request: user = %s, all sessions = %t", claims.Username, req.GetAllSessions())
+
+	// API key 和客户端证书没有可以吊销的 access token
+	if len(claims.Id) == 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot log out without an access token")
+	}
+
+	server.revocations.Revoke(claims.Id, time.Unix(claims.ExpiresAt, 0))
+
+	if req.GetAllSessions() {
+		err := server.refreshTokens.DeleteByUser(claims.Username)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot revoke refresh tokens: %v", err)
+		}
+		return &pb.LogoutResponse{}, nil
+	}
+
+	if len(req.GetRefreshToken()) > 0 {
+		token, err := server.refreshTokens.Find(HashRefreshToken(req.GetRefreshToken()))
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot find refresh token: %v", err)
+		}
+		// 只能吊销自己的 refresh token
+		if token != nil && token.Username == claims.Username {
+			err = server.refreshTokens.DeleteFamily(token.FamilyID)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "cannot revoke refresh tokens: %v", err)
+			}
+		}
+	}
+	return &pb.LogoutResponse{}, nil
+}
+
+// RevokeToken 按 jti 吊销 access token, 仅管理员
+func (server *AuthService) RevokeToken(ctx context.Context, req *pb.RevokeTokenRequest) (*pb.RevokeTokenResponse, error) {
+	log.Printf("receive a revoke-token request with jti: %s", req.GetJti())
+
+	if len(req.GetJti()) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "jti is required")
+	}
+
+	// 不知道 token 的过期时间, 保存到最晚可能的过期时间
+	server.revocations.Revoke(req.GetJti(), time.Now().Add(server.jwtManager.TokenDuration()))
+	return &pb.RevokeTokenResponse{}, nil
+}
+
+// Register 注册新用户, 角色为 user
+func (server *AuthService) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+	log.Printf("receive a register request for user %s", req.GetUsername())
+
+	err := ValidateUsername(req.GetUsername())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot register: %v", err)
+	}
+	err = ValidatePassword(req.GetPassword())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot register: %v", err)
+	}
+
+	user, err := NewUser(req.GetUsername(), req.GetPassword(), defaultUserRole)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot create user: %v", err)
+	}
+
+	err = server.userStore.Save(user)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrAlreadyExits) {
+			code = codes.AlreadyExists
+		}
+		return nil, status.Errorf(code, "cannot save user: %v", err)
+	}
+
+	return &pb.RegisterResponse{Profile: toPbProfile(user)}, nil
+}
+
+// ChangePassword 修改当前用户的密码, 需要提供旧密码
+func (server *AuthService) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	user, err := server.currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("receive a change-password request for user %s", user.Username)
+
+	if !user.IsCorrectPassword(req.GetOldPassword()) {
+		return nil, status.Errorf(codes.PermissionDenied, "incorrect password")
+	}
+	err = ValidatePassword(req.GetNewPassword())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot change password: %v", err)
+	}
+
+	err = user.SetPassword(req.GetNewPassword())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot change password: %v", err)
+	}
+
+	err = server.userStore.Update(user)
+	if err != nil {
+		return nil, userStoreError(err)
+	}
+	err = server.refreshTokens.DeleteByUser(user.Username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot revoke refresh tokens: %v", err)
+	}
+	return &pb.ChangePasswordResponse{}, nil
+}
+
+// GetProfile 获取当前用户的信息
+func (server *AuthService) GetProfile(ctx context.Context, req *pb.GetProfileRequest) (*pb.GetProfileResponse, error) {
+	user, err := server.currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GetProfileResponse{Profile: toPbProfile(user)}, nil
+}
+
+// DeleteAccount 删除当前用户, 需要再次提供密码
+func (server *AuthService) DeleteAccount(ctx context.Context, req *pb.DeleteAccountRequest) (*pb.DeleteAccountResponse, error) {
+	user, err := server.currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("receive a delete-account request for user %s", user.Username)
+
+	if !user.IsCorrectPassword(req.GetPassword()) {
+		return nil, status.Errorf(codes.PermissionDenied, "incorrect password")
+	}
+
+	err = server.userStore.Delete(user.Username)
+	if err != nil {
+		return nil, userStoreError(err)
+	}
+	err = server.refreshTokens.DeleteByUser(user.Username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot revoke refresh tokens: %v", err)
+	}
+	// 避免同名的新用户使用旧的 key
+	err = server.apiKeys.DeleteByUser(user.Username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot revoke api keys: %v", err)
+	}
+	return &pb.DeleteAccountResponse{}, nil
+}
+
+// ListUsers 分页获取所有用户, 仅管理员, 超级管理员以外只能看到同一组织的用户
+func (server *AuthService) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	offset, limit, err := parsePage(req.GetPageSize(), req.GetPageToken())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot list users: %v", err)
+	}
+
+	var users []*User
+	var total int
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok || claims.Role == RoleSuperAdmin {
+		users, total, err = server.userStore.List(offset, limit)
+	} else {
+		users, total, err = server.listOrgUsers(claims.OrgID, offset, limit)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list users: %v", err)
+	}
+
+	res := &pb.ListUsersResponse{
+		NextPageToken: nextPageToken(offset, len(users), total),
+		TotalSize:     int32(total),
+	}
+	for _, user := range users {
+		res.Users = append(res.Users, toPbProfile(user))
+	}
+	return res, nil
+}
+
+// CreateUser 创建指定角色的用户, 仅管理员
+//
+// 超级管理员以外只能在自己的组织中创建用户, 不指定组织时使用自己的组织
+func (server *AuthService) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
+	log.Printf("receive a create-user request: user = %s, role = %s, org = %s", req.GetUsername(), req.GetRole(), req.GetOrgId())
+
+	orgID := req.GetOrgId()
+	claims, ok := ClaimsFromContext(ctx)
+	if ok && claims.Role != RoleSuperAdmin {
+		if len(orgID) == 0 {
+			orgID = claims.OrgID
+		}
+		if orgID != claims.OrgID {
+			return nil, status.Errorf(codes.PermissionDenied, "cannot create user in org %s", orgID)
+		}
+	}
+	orgRole := req.GetOrgRole()
+	if len(orgID) > 0 && len(orgRole) == 0 {
+		orgRole = OrgRoleMember
+	}
+
+	err := ValidateUsername(req.GetUsername())
+	if err == nil {
+		err = ValidatePassword(req.GetPassword())
+	}
+	if err == nil {
+		err = ValidateRole(req.GetRole())
+	}
+	if err == nil {
+		err = ValidateOrgRole(orgID, orgRole)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot create user: %v", err)
+	}
+	err = server.checkAssignRole(ctx, req.GetRole())
+	if err != nil {
+		return nil, err
+	}
+	err = server.checkOrg(orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := NewUser(req.GetUsername(), req.GetPassword(), req.GetRole())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot create user: %v", err)
+	}
+	user.OrgID = orgID
+	user.OrgRole = orgRole
+
+	err = server.userStore.Save(user)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrAlreadyExits) {
+			code = codes.AlreadyExists
+		}
+		return nil, status.Errorf(code, "cannot save user: %v", err)
+	}
+
+	return &pb.CreateUserResponse{Profile: toPbProfile(user)}, nil
+}
+
+// SetUserDisabled 禁用或启用用户, 仅管理员, 不能禁用自己
+func (server *AuthService) SetUserDisabled(ctx context.Context, req *pb.SetUserDisabledRequest) (*pb.SetUserDisabledResponse, error) {
+	log.Printf("receive a set-user-disabled request: user = %s, disabled = %t", req.GetUsername(), req.GetDisabled())
+
+	user, err := server.updateOtherUser(ctx, req.GetUsername(), func(user *User) error {
+		user.Disabled = req.GetDisabled()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		err = server.refreshTokens.DeleteByUser(user.Username)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot revoke refresh tokens: %v", err)
+		}
+	}
+	return &pb.SetUserDisabledResponse{Profile: toPbProfile(user)}, nil
+}
+
+// ResetPassword 重置用户的密码, 仅管理员
+func (server *AuthService) ResetPassword(ctx context.Context, req *pb.ResetPasswordRequest) (*pb.ResetPasswordResponse, error) {
+	log.Printf("receive a reset-password request for user %s", req.GetUsername())
+
+	err := ValidatePassword(req.GetNewPassword())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot reset password: %v", err)
+	}
+
+	user, err := server.findManagedUser(ctx, req.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+	err = user.SetPassword(req.GetNewPassword())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot reset password: %v", err)
+	}
+	err = server.userStore.Update(user)
+	if err != nil {
+		return nil, userStoreError(err)
+	}
+	err = server.refreshTokens.DeleteByUser(user.Username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot revoke refresh tokens: %v", err)
+	}
+	return &pb.ResetPasswordResponse{}, nil
+}
+
+// SetUserRole 修改用户的角色, 仅管理员, 不能修改自己的角色
+func (server *AuthService) SetUserRole(ctx context.Context, req *pb.SetUserRoleRequest) (*pb.SetUserRoleResponse, error) {
+	log.Printf("receive a set-user-role request: user = %s, role = %s", req.GetUsername(), req.GetRole())
+
+	err := ValidateRole(req.GetRole())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot set role: %v", err)
+	}
+	err = server.checkAssignRole(ctx, req.GetRole())
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := server.updateOtherUser(ctx, req.GetUsername(), func(user *User) error {
+		user.Role = req.GetRole()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.SetUserRoleResponse{Profile: toPbProfile(user)}, nil
+}
+
+// updateOtherUser 修改其他用户, 避免管理员把自己锁在外面
+func (server *AuthService) updateOtherUser(ctx context.Context, username string, update func(user *User) error) (*User, error) {
+	if claims, ok := ClaimsFromContext(ctx); ok && claims.Username == username {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot modify own account")
+	}
+
+	user, err := server.findManagedUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	err = update(user)
+	if err != nil {
+		return nil, err
+	}
+	err = server.userStore.Update(user)
+	if err != nil {
+		return nil, userStoreError(err)
+	}
+	return user, nil
+}
+
+// CreateOrganization 创建组织, 仅超级管理员
+func (server *AuthService) CreateOrganization(ctx context.Context, req *pb.CreateOrganizationRequest) (*pb.CreateOrganizationResponse, error) {
+	log.Printf("receive a create-organization request: id = %s, name = %s", req.GetId(), req.GetName())
+
+	err := ValidateOrgID(req.GetId())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot create organization: %v", err)
+	}
+	if len(req.GetName()) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot create organization: name is required")
+	}
+
+	org := &Organization{
+		ID:        req.GetId(),
+		Name:      req.GetName(),
+		CreatedAt: time.Now(),
+	}
+	err = server.orgStore.Save(org)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrAlreadyExits) {
+			code = codes.AlreadyExists
+		}
+		return nil, status.Errorf(code, "cannot save organization: %v", err)
+	}
+
+	return &pb.CreateOrganizationResponse{Organization: toPbOrganization(org)}, nil
+}
+
+// ListOrganizations 获取所有组织, 仅超级管理员
+func (server *AuthService) ListOrganizations(ctx context.Context, req *pb.ListOrganizationsRequest) (*pb.ListOrganizationsResponse, error) {
+	orgs, err := server.orgStore.List()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list organizations: %v", err)
+	}
+
+	res := &pb.ListOrganizationsResponse{}
+	for _, org := range orgs {
+		res.Organizations = append(res.Organizations, toPbOrganization(org))
+	}
+	return res, nil
+}
+
+// SetOrgMembership 修改用户所属的组织和在组织内的角色
+//
+// 超级管理员可以把用户加入任何组织, 组织管理员只能修改本组织的成员或把成员移出组织
+func (server *AuthService) SetOrgMembership(ctx context.Context, req *pb.SetOrgMembershipRequest) (*pb.SetOrgMembershipResponse, error) {
+	log.Printf("receive a set-org-membership request: user = %s, org = %s, org role = %s", req.GetUsername(), req.GetOrgId(), req.GetOrgRole())
+
+	err := ValidateOrgRole(req.GetOrgId(), req.GetOrgRole())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot set org membership: %v", err)
+	}
+	if claims, ok := ClaimsFromContext(ctx); ok && claims.Role != RoleSuperAdmin {
+		if !managesOrg(claims, claims.OrgID) {
+			return nil, status.Errorf(codes.PermissionDenied, "only org admins can manage org members")
+		}
+		if len(req.GetOrgId()) > 0 && req.GetOrgId() != claims.OrgID {
+			return nil, status.Errorf(codes.PermissionDenied, "cannot add user to org %s", req.GetOrgId())
+		}
+	}
+	err = server.checkOrg(req.GetOrgId())
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := server.updateOtherUser(ctx, req.GetUsername(), func(user *User) error {
+		user.OrgID = req.GetOrgId()
+		user.OrgRole = req.GetOrgRole()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.SetOrgMembershipResponse{Profile: toPbProfile(user)}, nil
+}
+
+// CreateApiKey 为当前用户创建 API key, 权限范围必须是策略中的权限
+//
+// 使用 API key 创建新的 key 时, 新 key 的权限范围不能超过当前的 key
+func (server *AuthService) CreateApiKey(ctx context.Context, req *pb.CreateApiKeyRequest) (*pb.CreateApiKeyResponse, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "user is not authenticated")
+	}
+	log.Printf("receive a create-api-key request: user = %s, name = %s, scopes = %v", claims.Username, req.GetName(), req.GetScopes())
+
+	if server.apiKeyPolicy == nil {
+		return nil, status.Errorf(codes.Unimplemented, "api keys are not supported")
+	}
+	if len(req.GetName()) == 0 || len(req.GetName()) > 64 {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot create api key: name must be 1 to 64 bytes")
+	}
+	if len(req.GetScopes()) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot create api key: scopes are required")
+	}
+	for _, scope := range req.GetScopes() {
+		if !server.apiKeyPolicy.HasPermission(scope) {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot create api key: unknown scope %q", scope)
+		}
+		if !server.apiKeyPolicy.RoleHasPermission(claims.Role, scope) {
+			return nil, status.Errorf(codes.PermissionDenied, "cannot create api key with scope %q not granted to role %s", scope, claims.Role)
+		}
+		if len(claims.APIKeyID) > 0 && !hasScope(claims.Scopes, scope) {
+			return nil, status.Errorf(codes.PermissionDenied, "cannot create api key with scope %q outside the current api key", scope)
+		}
+	}
+
+	var expiresAt time.Time
+	if req.GetExpiresAt() != nil {
+		expiresAt = req.GetExpiresAt().AsTime()
+		if !expiresAt.After(time.Now()) {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot create api key: expires_at is in the past")
+		}
+	}
+
+	plaintext, key, err := NewAPIKey(claims.Username, req.GetName(), req.GetScopes(), expiresAt)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	err = server.apiKeys.Save(key)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot save api key: %v", err)
+	}
+
+	res := &pb.CreateApiKeyResponse{
+		ApiKey: toPbAPIKey(key),
+		Key:    plaintext,
 	}
 	return res, nil
 }
+
+// ListApiKeys 获取当前用户的所有 API key, 不包括 key 的明文
+func (server *AuthService) ListApiKeys(ctx context.Context, req *pb.ListApiKeysRequest) (*pb.ListApiKeysResponse, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "user is not authenticated")
+	}
+
+	keys, err := server.apiKeys.List(claims.Username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list api keys: %v", err)
+	}
+
+	res := &pb.ListApiKeysResponse{}
+	for _, key := range keys {
+		res.ApiKeys = append(res.ApiKeys, toPbAPIKey(key))
+	}
+	return res, nil
+}
+
+// RevokeApiKey 删除当前用户的 API key, 其他用户的 key 视为不存在
+func (server *AuthService) RevokeApiKey(ctx context.Context, req *pb.RevokeApiKeyRequest) (*pb.RevokeApiKeyResponse, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "user is not authenticated")
+	}
+	log.Printf("receive a revoke-api-key request: user = %s, id = %s", claims.Username, req.GetId())
+
+	err := server.apiKeys.Delete(claims.Username, req.GetId())
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			code = codes.NotFound
+		}
+		return nil, status.Errorf(code, "cannot revoke api key: %v", err)
+	}
+	return &pb.RevokeApiKeyResponse{}, nil
+}
+
+// findManagedUser 查找当前用户可以管理的用户
+//
+// 超级管理员以外不能管理其他组织的用户, 其他组织的用户视为不存在, 也不能管理超级管理员
+func (server *AuthService) findManagedUser(ctx context.Context, username string) (*User, error) {
+	user, err := server.findUser(username)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok || claims.Role == RoleSuperAdmin {
+		return user, nil
+	}
+	if user.OrgID != claims.OrgID {
+		return nil, status.Errorf(codes.NotFound, "cannot find user: %v", ErrUserNotFound)
+	}
+	if user.Role == RoleSuperAdmin {
+		return nil, status.Errorf(codes.PermissionDenied, "cannot modify superadmin %s", username)
+	}
+	return user, nil
+}
+
+// listOrgUsers 分页返回组织内的用户和组织的用户总数
+func (server *AuthService) listOrgUsers(orgID string, offset int, limit int) ([]*User, int, error) {
+	all, _, err := server.userStore.List(0, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	users := make([]*User, 0, len(all))
+	for _, user := range all {
+		if user.OrgID == orgID {
+			users = append(users, user)
+		}
+	}
+
+	total := len(users)
+	if offset > total {
+		offset = total
+	}
+	users = users[offset:]
+	if limit > 0 && len(users) > limit {
+		users = users[:limit]
+	}
+	return users, total, nil
+}
+
+// checkAssignRole 只有超级管理员可以分配超级管理员角色
+func (server *AuthService) checkAssignRole(ctx context.Context, role string) error {
+	claims, ok := ClaimsFromContext(ctx)
+	if role == RoleSuperAdmin && ok && claims.Role != RoleSuperAdmin {
+		return status.Errorf(codes.PermissionDenied, "only superadmins can assign role %s", role)
+	}
+	return nil
+}
+
+// checkOrg 组织必须存在, 为空表示不属于任何组织
+func (server *AuthService) checkOrg(orgID string) error {
+	if len(orgID) == 0 {
+		return nil
+	}
+	org, err := server.orgStore.Find(orgID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot find organization: %v", err)
+	}
+	if org == nil {
+		return status.Errorf(codes.NotFound, "cannot find organization %s: %v", orgID, ErrOrganizationNotFound)
+	}
+	return nil
+}
+
+// currentUser 查找拦截器验证过的用户
+func (server *AuthService) currentUser(ctx context.Context) (*User, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "user is not authenticated")
+	}
+	return server.findUser(claims.Username)
+}
+
+func (server *AuthService) findUser(username string) (*User, error) {
+	user, err := server.userStore.Find(username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
+	}
+	if user == nil {
+		return nil, status.Errorf(codes.NotFound, "cannot find user: %v", ErrUserNotFound)
+	}
+	return user, nil
+}
+
+// issueRefreshToken 生成并保存 refresh token, 返回明文
+func (server *AuthService) issueRefreshToken(username string, familyID string) (string, error) {
+	plaintext, token, err := NewRefreshToken(username, familyID, server.refreshTokenDuration)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "%v", err)
+	}
+
+	err = server.refreshTokens.Save(token)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "cannot save refresh token: %v", err)
+	}
+	return plaintext, nil
+}
+
+func userStoreError(err error) error {
+	code := codes.Internal
+	if errors.Is(err, ErrUserNotFound) {
+		code = codes.NotFound
+	}
+	return status.Errorf(code, "cannot update user: %v", err)
+}
+
+func toPbProfile(user *User) *pb.Profile {
+	return &pb.Profile{
+		Username: user.Username,
+		Role:     user.Role,
+		Disabled: user.Disabled,
+		OrgId:    user.OrgID,
+		OrgRole:  user.OrgRole,
+	}
+}
+
+func toPbAPIKey(key *APIKey) *pb.ApiKey {
+	res := &pb.ApiKey{
+		Id:        key.ID,
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		Scopes:    key.Scopes,
+		CreatedAt: timestamppb.New(key.CreatedAt),
+	}
+	if !key.ExpiresAt.IsZero() {
+		res.ExpiresAt = timestamppb.New(key.ExpiresAt)
+	}
+	if !key.LastUsedAt.IsZero() {
+		res.LastUsedAt = timestamppb.New(key.LastUsedAt)
+	}
+	return res
+}
+
+func toPbOrganization(org *Organization) *pb.Organization {
+	return &pb.Organization{
+		Id:        org.ID,
+		Name:      org.Name,
+		CreatedAt: timestamppb.New(org.CreatedAt),
+	}
+}
@@ -0,0 +1,195 @@
+package service
+
+import (
+	"context"
+	"go-pcbook-micro/pb"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthServiceAccount(t *testing.T) {
+	t.Parallel()
+
+	userStore := NewInMemoryUserStore()
+	server := NewAuthService(userStore, NewJWTManager("secret", time.Minute))
+
+	res, err := server.Register(context.Background(), &pb.RegisterRequest{Username: "alice", Password: "password1"})
+	require.NoError(t, err)
+	require.Equal(t, "alice", res.GetProfile().GetUsername())
+	require.Equal(t, "user", res.GetProfile().GetRole())
+
+	// 用户名不能重复
+	_, err = server.Register(context.Background(), &pb.RegisterRequest{Username: "alice", Password: "password2"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	for _, req := range []*pb.RegisterRequest{
+		{Username: "a", Password: "password1"},
+		{Username: "bob smith", Password: "password1"},
+		{Username: "bob", Password: "123"},
+	} {
+		_, err = server.Register(context.Background(), req)
+		require.Equal(t, codes.InvalidArgument, status.Code(err), req.GetUsername())
+	}
+
+	_, err = server.GetProfile(context.Background(), &pb.GetProfileRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := contextWithClaims(context.Background(), &UserClaims{Username: "alice", Role: "user"})
+	profile, err := server.GetProfile(ctx, &pb.GetProfileRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "alice", profile.GetProfile().GetUsername())
+
+	_, err = server.ChangePassword(ctx, &pb.ChangePasswordRequest{OldPassword: "wrong", NewPassword: "password2"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.ChangePassword(ctx, &pb.ChangePasswordRequest{OldPassword: "password1", NewPassword: "123"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = server.ChangePassword(ctx, &pb.ChangePasswordRequest{OldPassword: "password1", NewPassword: "password2"})
+	require.NoError(t, err)
+
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "password1"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "password2"})
+	require.NoError(t, err)
+
+	_, err = server.DeleteAccount(ctx, &pb.DeleteAccountRequest{Password: "password1"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.DeleteAccount(ctx, &pb.DeleteAccountRequest{Password: "password2"})
+	require.NoError(t, err)
+
+	user, err := userStore.Find("alice")
+	require.NoError(t, err)
+	require.Nil(t, user)
+
+	_, err = server.GetProfile(ctx, &pb.GetProfileRequest{})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestAuthServiceAdmin(t *testing.T) {
+	t.Parallel()
+
+	userStore := NewInMemoryUserStore()
+	server := NewAuthService(userStore, NewJWTManager("secret", time.Minute))
+	ctx := contextWithClaims(context.Background(), &UserClaims{Username: "admin1", Role: "admin"})
+
+	for _, username := range []string{"admin1", "carol", "bob", "dave"} {
+		req := &pb.CreateUserRequest{Username: username, Password: "password1", Role: "user"}
+		_, err := server.CreateUser(ctx, req)
+		require.NoError(t, err)
+	}
+
+	_, err := server.CreateUser(ctx, &pb.CreateUserRequest{Username: "bob", Password: "password1", Role: "user"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = server.CreateUser(ctx, &pb.CreateUserRequest{Username: "erin", Password: "password1", Role: "root"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// 按用户名分页
+	page, err := server.ListUsers(ctx, &pb.ListUsersRequest{PageSize: 3})
+	require.NoError(t, err)
+	require.Equal(t, int32(4), page.GetTotalSize())
+	require.Len(t, page.GetUsers(), 3)
+	require.Equal(t, "admin1", page.GetUsers()[0].GetUsername())
+	require.Equal(t, "bob", page.GetUsers()[1].GetUsername())
+
+	page, err = server.ListUsers(ctx, &pb.ListUsersRequest{PageSize: 3, PageToken: page.GetNextPageToken()})
+	require.NoError(t, err)
+	require.Len(t, page.GetUsers(), 1)
+	require.Equal(t, "dave", page.GetUsers()[0].GetUsername())
+	require.Empty(t, page.GetNextPageToken())
+
+	role, err := server.SetUserRole(ctx, &pb.SetUserRoleRequest{Username: "bob", Role: "admin"})
+	require.NoError(t, err)
+	require.Equal(t, "admin", role.GetProfile().GetRole())
+
+	disabled, err := server.SetUserDisabled(ctx, &pb.SetUserDisabledRequest{Username: "carol", Disabled: true})
+	require.NoError(t, err)
+	require.True(t, disabled.GetProfile().GetDisabled())
+
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "carol", Password: "password1"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = server.ResetPassword(ctx, &pb.ResetPasswordRequest{Username: "dave", NewPassword: "password2"})
+	require.NoError(t, err)
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "dave", Password: "password2"})
+	require.NoError(t, err)
+
+	// 管理员不能修改自己
+	_, err = server.SetUserDisabled(ctx, &pb.SetUserDisabledRequest{Username: "admin1", Disabled: true})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = server.SetUserRole(ctx, &pb.SetUserRoleRequest{Username: "unknown", Role: "user"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestAuthServiceOrganizations(t *testing.T) {
+	t.Parallel()
+
+	userStore := NewInMemoryUserStore()
+	server := NewAuthService(userStore, NewJWTManager("secret", time.Minute))
+	root := contextWithClaims(context.Background(), &UserClaims{Username: "root", Role: RoleSuperAdmin})
+
+	for _, id := range []string{"globex", "acme"} {
+		_, err := server.CreateOrganization(root, &pb.CreateOrganizationRequest{Id: id, Name: id})
+		require.NoError(t, err)
+	}
+	_, err := server.CreateOrganization(root, &pb.CreateOrganizationRequest{Id: "acme", Name: "Acme"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = server.CreateOrganization(root, &pb.CreateOrganizationRequest{Id: "-", Name: "Invalid"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	orgs, err := server.ListOrganizations(root, &pb.ListOrganizationsRequest{})
+	require.NoError(t, err)
+	require.Len(t, orgs.GetOrganizations(), 2)
+	require.Equal(t, "acme", orgs.GetOrganizations()[0].GetId())
+
+	create := func(ctx context.Context, username string, role string, orgID string) (*pb.Profile, error) {
+		req := &pb.CreateUserRequest{Username: username, Password: "password1", Role: role, OrgId: orgID}
+		res, err := server.CreateUser(ctx, req)
+		return res.GetProfile(), err
+	}
+	profile, err := create(root, "alice", "user", "acme")
+	require.NoError(t, err)
+	require.Equal(t, OrgRoleMember, profile.GetOrgRole())
+	_, err = create(root, "bob", "user", "globex")
+	require.NoError(t, err)
+	_, err = create(root, "carol", "user", "unknown")
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = server.SetOrgMembership(root, &pb.SetOrgMembershipRequest{Username: "alice", OrgId: "acme", OrgRole: OrgRoleAdmin})
+	require.NoError(t, err)
+	acmeAdmin := contextWithClaims(context.Background(), &UserClaims{Username: "alice", Role: "user", OrgID: "acme", OrgRole: OrgRoleAdmin})
+	acmeMember := contextWithClaims(context.Background(), &UserClaims{Username: "dave", Role: "user", OrgID: "acme", OrgRole: OrgRoleMember})
+
+	// 组织管理员只能在自己的组织中创建用户, 不能分配超级管理员角色
+	profile, err = create(acmeAdmin, "dave", "user", "")
+	require.NoError(t, err)
+	require.Equal(t, "acme", profile.GetOrgId())
+	_, err = create(acmeAdmin, "erin", "user", "globex")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = create(acmeAdmin, "erin", RoleSuperAdmin, "acme")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// 其他组织的用户视为不存在
+	_, err = server.SetUserDisabled(acmeAdmin, &pb.SetUserDisabledRequest{Username: "bob", Disabled: true})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = server.SetOrgMembership(acmeAdmin, &pb.SetOrgMembershipRequest{Username: "bob", OrgId: "acme", OrgRole: OrgRoleMember})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = server.SetOrgMembership(acmeMember, &pb.SetOrgMembershipRequest{Username: "alice"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	users, err := server.ListUsers(acmeAdmin, &pb.ListUsersRequest{PageSize: 1})
+	require.NoError(t, err)
+	require.Equal(t, int32(2), users.GetTotalSize())
+	require.Equal(t, "alice", users.GetUsers()[0].GetUsername())
+	users, err = server.ListUsers(root, &pb.ListUsersRequest{})
+	require.NoError(t, err)
+	require.Equal(t, int32(3), users.GetTotalSize())
+
+	// 移出组织
+	res, err := server.SetOrgMembership(acmeAdmin, &pb.SetOrgMembershipRequest{Username: "dave"})
+	require.NoError(t, err)
+	require.Empty(t, res.GetProfile().GetOrgId())
+	require.Empty(t, res.GetProfile().GetOrgRole())
+}
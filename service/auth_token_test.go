@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"go-pcbook-micro/pb"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthServiceRefreshToken(t *testing.T) {
+	t.Parallel()
+
+	const method = "/pcbook.LaptopService/RateLaptop"
+
+	userStore := NewInMemoryUserStore()
+	user, err := NewUser("alice", "password1", "user")
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(user))
+
+	jwtManager := NewJWTManager("secret", time.Minute)
+	revocations := NewRevocationList()
+	server := NewAuthService(userStore, jwtManager, WithTokenRevocation(revocations))
+	interceptor := NewAuthInterceptor(jwtManager, map[string][]string{method: {"user"}}, WithRevocationList(revocations))
+
+	login, err := server.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "password1"})
+	require.NoError(t, err)
+	require.NotEmpty(t, login.GetRefreshToken())
+
+	// 刷新后换发新的 refresh token
+	refreshed, err := server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.NoError(t, err)
+	require.NotEqual(t, login.GetRefreshToken(), refreshed.GetRefreshToken())
+
+	// 旧的 refresh token 再次使用时整个 family 失效
+	_, err = server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: refreshed.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: "unknown"})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// 登出后 access token 和 refresh token 都失效
+	login, err = server.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "password1"})
+	require.NoError(t, err)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", login.GetAccessToken()))
+	claims, err := interceptor.authorize(ctx, method)
+	require.NoError(t, err)
+
+	_, err = server.Logout(contextWithClaims(ctx, claims), &pb.LogoutRequest{RefreshToken: login.GetRefreshToken()})
+	require.NoError(t, err)
+
+	_, err = interceptor.authorize(ctx, method)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// 管理员按 jti 吊销
+	login, err = server.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "password1"})
+	require.NoError(t, err)
+	claims, err = jwtManager.Verify(login.GetAccessToken())
+	require.NoError(t, err)
+
+	_, err = server.RevokeToken(context.Background(), &pb.RevokeTokenRequest{Jti: claims.Id})
+	require.NoError(t, err)
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", login.GetAccessToken()))
+	_, err = interceptor.authorize(ctx, method)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestRevocationList(t *testing.T) {
+	t.Parallel()
+
+	list := NewRevocationList()
+	now := time.Now()
+	list.now = func() time.Time { return now }
+
+	list.Revoke("jti-1", now.Add(time.Minute))
+	list.Revoke("jti-2", now.Add(-time.Minute))
+	require.True(t, list.IsRevoked("jti-1"))
+	require.False(t, list.IsRevoked("jti-2"))
+
+	// 过期的记录被清理
+	list.now = func() time.Time { return now.Add(2 * time.Minute) }
+	list.Revoke("jti-3", now.Add(time.Hour))
+	require.False(t, list.IsRevoked("jti-1"))
+	require.True(t, list.IsRevoked("jti-3"))
+}
@@ -0,0 +1,398 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrEventsNotSupported 评分存储不支持事件历史返回此错误
+var ErrEventsNotSupported = errors.New("rating store doesn't support events")
+
+// RatingEventType 评分事件类型
+type RatingEventType string
+
+const (
+	RatingEventRated    RatingEventType = "rated"    // 添加或替换评分
+	RatingEventRemoved  RatingEventType = "removed"  // 撤回评分
+	RatingEventExcluded RatingEventType = "excluded" // 评分不计入汇总
+	RatingEventIncluded RatingEventType = "included" // 评分重新计入汇总
+)
+
+// RatingEvent 一次评分的变更
+type RatingEvent struct {
+	Sequence      uint64          `json:"seq"`
+	Type          RatingEventType `json:"type"`
+	LaptopID      string          `json:"laptop_id"`
+	Username      string          `json:"username"`
+	Score         float64         `json:"score"`
+	PreviousScore *float64        `json:"previous_score,omitempty"` // 之前没有评分时为 nil
+	Timestamp     time.Time       `json:"timestamp"`
+}
+
+// RatingEventQuery 查询评分事件的条件, 为空的条件不限制
+type RatingEventQuery struct {
+	LaptopID      string
+	Username      string
+	AfterSequence uint64 // 只返回序号大于此值的事件
+	Limit         int    // 0 表示不限制
+}
+
+// RatingRebuildReport 重建评分汇总的结果
+type RatingRebuildReport struct {
+	Events         int // 重放的事件数量
+	Laptops        int // 有评分的 laptop 数量
+	ChangedLaptops int // 汇总与重建前不一致的 laptop 数量
+}
+
+// RatingEventStore 保存评分事件历史的评分存储
+type RatingEventStore interface {
+	// 按条件查询评分事件, 按序号升序
+	ListEvents(query RatingEventQuery) ([]*RatingEvent, error)
+	// 从事件日志重新计算评分汇总
+	RebuildAggregates() (*RatingRebuildReport, error)
+}
+
+// ratingLogFile 评分日志文件, 测试时可以替换为写入失败的文件
+type ratingLogFile interface {
+	io.ReadWriteSeeker
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FileRatingStore 把每次评分变更追加写入日志文件, 评分汇总由日志重放得到
+type FileRatingStore struct {
+	mutex   sync.RWMutex
+	path    string
+	file    ratingLogFile
+	size    int64 // 最后一条完整事件的结束位置
+	events  []*RatingEvent
+	ratings *InMemoryRatingStore
+	now     func() time.Time
+}
+
+// NewFileRatingStore 打开或创建日志文件并重放已有的事件
+func NewFileRatingStore(path string) (*FileRatingStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open rating log: %w", err)
+	}
+
+	events, ratings, size, err := replayRatingLog(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// 丢弃写入到一半的最后一条事件
+	err = file.Truncate(size)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot truncate rating log: %w", err)
+	}
+	_, err = file.Seek(size, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot seek rating log: %w", err)
+	}
+
+	log.Printf("replayed %d rating events from %s", len(events), path)
+
+	store := &FileRatingStore{
+		path:    path,
+		file:    file,
+		size:    size,
+		events:  events,
+		ratings: ratings,
+		now:     time.Now,
+	}
+	return store, nil
+}
+
+// Close 关闭日志文件
+func (store *FileRatingStore) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.file.Close()
+}
+
+func (store *FileRatingStore) Add(laptopID string, username string, score float64) (*Rating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	event := &RatingEvent{
+		Type:      RatingEventRated,
+		LaptopID:  laptopID,
+		Username:  username,
+		Score:     score,
+		Timestamp: store.now().UTC(),
+	}
+
+	previous, err := store.ratings.FindUserRating(laptopID, username)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		event.PreviousScore = &previous.Score
+	}
+
+	err = store.append(event)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.ratings.addAt(laptopID, username, score, event.Timestamp)
+}
+
+func (store *FileRatingStore) Remove(laptopID string, username string) (*Rating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	previous, err := store.ratings.FindUserRating(laptopID, username)
+	if err != nil {
+		return nil, err
+	}
+	if previous == nil {
+		return nil, ErrRatingNotFound
+	}
+
+	event := &RatingEvent{
+		Type:          RatingEventRemoved,
+		LaptopID:      laptopID,
+		Username:      username,
+		PreviousScore: &previous.Score,
+		Timestamp:     store.now().UTC(),
+	}
+
+	err = store.append(event)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.ratings.Remove(laptopID, username)
+}
+
+func (store *FileRatingStore) SetExcluded(laptopID string, username string, excluded bool) (*Rating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	event := &RatingEvent{
+		Type:      RatingEventIncluded,
+		LaptopID:  laptopID,
+		Username:  username,
+		Timestamp: store.now().UTC(),
+	}
+	if excluded {
+		event.Type = RatingEventExcluded
+	}
+
+	err := store.append(event)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.ratings.SetExcluded(laptopID, username, excluded)
+}
+
+func (store *FileRatingStore) Find(laptopID string) (*Rating, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.ratings.Find(laptopID)
+}
+
+func (store *FileRatingStore) FindUserRating(laptopID string, username string) (*UserRating, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.ratings.FindUserRating(laptopID, username)
+}
+
+func (store *FileRatingStore) Scores(laptopID string) ([]float64, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.ratings.Scores(laptopID)
+}
+
+func (store *FileRatingStore) ListUserRatings(laptopID string) ([]*UserRating, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.ratings.ListUserRatings(laptopID)
+}
+
+func (store *FileRatingStore) RatedLaptops() ([]string, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.ratings.RatedLaptops()
+}
+
+func (store *FileRatingStore) ListEvents(query RatingEventQuery) ([]*RatingEvent, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var events []*RatingEvent
+	for _, event := range store.events {
+		if event.Sequence <= query.AfterSequence {
+			continue
+		}
+		if len(query.LaptopID) > 0 && event.LaptopID != query.LaptopID {
+			continue
+		}
+		if len(query.Username) > 0 && event.Username != query.Username {
+			continue
+		}
+
+		other := *event
+		events = append(events, &other)
+		if query.Limit > 0 && len(events) >= query.Limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+func (store *FileRatingStore) RebuildAggregates() (*RatingRebuildReport, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	_, err := store.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("cannot seek rating log: %w", err)
+	}
+	events, ratings, size, err := replayRatingLog(store.file)
+	if err != nil {
+		return nil, err
+	}
+	_, err = store.file.Seek(size, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("cannot seek rating log: %w", err)
+	}
+	store.size = size
+
+	laptopIDs, err := ratings.RatedLaptops()
+	if err != nil {
+		return nil, err
+	}
+	oldLaptopIDs, err := store.ratings.RatedLaptops()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RatingRebuildReport{
+		Events:  len(events),
+		Laptops: len(laptopIDs),
+	}
+
+	// 比较重建前后所有 laptop 的汇总
+	checked := make(map[string]bool)
+	for _, laptopID := range append(laptopIDs, oldLaptopIDs...) {
+		if checked[laptopID] {
+			continue
+		}
+		checked[laptopID] = true
+
+		rebuilt, _ := ratings.Find(laptopID)
+		current, _ := store.ratings.Find(laptopID)
+		if *rebuilt != *current {
+			report.ChangedLaptops++
+		}
+	}
+
+	store.events = events
+	store.ratings = ratings
+	return report, nil
+}
+
+// append 调用方需持有锁, 写入并同步到磁盘后才修改内存中的数据
+func (store *FileRatingStore) append(event *RatingEvent) error {
+	event.Sequence = uint64(len(store.events)) + 1
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("cannot marshal rating event: %w", err)
+	}
+	data = append(data, '\n')
+
+	_, err = store.file.Write(data)
+	if err == nil {
+		err = store.file.Sync()
+	}
+	if err != nil {
+		return store.rollback(fmt.Errorf("cannot write rating event: %w", err))
+	}
+
+	store.size += int64(len(data))
+	store.events = append(store.events, event)
+	return nil
+}
+
+// rollback 写入失败时截断写入到一半的事件, 否则之后的事件会追加在不完整的行后面, 重启时无法重放
+func (store *FileRatingStore) rollback(cause error) error {
+	err := store.file.Truncate(store.size)
+	if err != nil {
+		return fmt.Errorf("%v, cannot truncate rating log: %w", cause, err)
+	}
+	_, err = store.file.Seek(store.size, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("%v, cannot seek rating log: %w", cause, err)
+	}
+	return cause
+}
+
+// replayRatingLog 从当前位置读取所有事件并计算评分汇总, 返回完整事件的结束位置
+func replayRatingLog(reader io.Reader) ([]*RatingEvent, *InMemoryRatingStore, int64, error) {
+	ratings := NewInMemoryRatingStore()
+	var events []*RatingEvent
+	var size int64
+
+	buffered := bufio.NewReader(reader)
+	for {
+		line, err := buffered.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("discard incomplete rating event at offset %d", size)
+			}
+			break
+		}
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("cannot read rating log: %w", err)
+		}
+
+		event := &RatingEvent{}
+		err = json.Unmarshal(line, event)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("invalid rating event at offset %d: %w", size, err)
+		}
+
+		switch event.Type {
+		case RatingEventRated:
+			_, err = ratings.addAt(event.LaptopID, event.Username, event.Score, event.Timestamp)
+		case RatingEventRemoved:
+			_, err = ratings.Remove(event.LaptopID, event.Username)
+		case RatingEventExcluded, RatingEventIncluded:
+			_, err = ratings.SetExcluded(event.LaptopID, event.Username, event.Type == RatingEventExcluded)
+		default:
+			err = fmt.Errorf("unknown event type %q", event.Type)
+		}
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("cannot replay rating event %d: %w", event.Sequence, err)
+		}
+
+		events = append(events, event)
+		size += int64(len(line))
+	}
+
+	return events, ratings, size, nil
+}
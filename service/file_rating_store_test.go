@@ -0,0 +1,142 @@
+package service
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileRatingStore(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "ratings.log")
+
+	store, err := NewFileRatingStore(path)
+	require.NoError(t, err)
+
+	_, err = store.Add("laptop-1", "user1", 8)
+	require.NoError(t, err)
+	_, err = store.Add("laptop-1", "user2", 6)
+	require.NoError(t, err)
+	_, err = store.Add("laptop-1", "user1", 10)
+	require.NoError(t, err)
+	_, err = store.Remove("laptop-1", "user2")
+	require.NoError(t, err)
+	_, err = store.Remove("laptop-1", "user2")
+	require.ErrorIs(t, err, ErrRatingNotFound)
+
+	events, err := store.ListEvents(RatingEventQuery{Username: "user1"})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Nil(t, events[0].PreviousScore)
+	require.Equal(t, 8.0, *events[1].PreviousScore)
+	require.Equal(t, uint64(3), events[1].Sequence)
+
+	events, err = store.ListEvents(RatingEventQuery{AfterSequence: 1, Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), events[0].Sequence)
+	require.Len(t, events, 2)
+	require.NoError(t, store.Close())
+
+	// 模拟写入到一半时崩溃
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"seq":5,"type":"rated","laptop_id":"lap`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	// 重启后从日志恢复
+	store, err = NewFileRatingStore(path)
+	require.NoError(t, err)
+	defer store.Close()
+
+	rating, err := store.Find("laptop-1")
+	require.NoError(t, err)
+	require.Equal(t, Rating{Count: 1, Sum: 10}, *rating)
+
+	userRating, err := store.FindUserRating("laptop-1", "user1")
+	require.NoError(t, err)
+	require.Equal(t, 10.0, userRating.Score)
+	require.False(t, userRating.RatedAt.IsZero())
+
+	_, err = store.Add("laptop-2", "user1", 5)
+	require.NoError(t, err)
+	events, err = store.ListEvents(RatingEventQuery{LaptopID: "laptop-2"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), events[0].Sequence)
+
+	report, err := store.RebuildAggregates()
+	require.NoError(t, err)
+	require.Equal(t, &RatingRebuildReport{Events: 5, Laptops: 2}, report)
+}
+
+// failingRatingLog 只写入前 limit 个字节, 之后写入失败
+type failingRatingLog struct {
+	*os.File
+	limit int
+}
+
+func (file *failingRatingLog) Write(data []byte) (int, error) {
+	if len(data) <= file.limit {
+		return file.File.Write(data)
+	}
+	n, _ := file.File.Write(data[:file.limit])
+	return n, errors.New("no space left on device")
+}
+
+func TestFileRatingStoreWriteFailure(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "ratings.log")
+	store, err := NewFileRatingStore(path)
+	require.NoError(t, err)
+
+	// 0 分也写入日志
+	_, err = store.Add("laptop-1", "user1", 0)
+	require.NoError(t, err)
+
+	// 写入到一半失败时截断, 之后的事件从完整的行之后写入
+	file := store.file.(*os.File)
+	store.file = &failingRatingLog{File: file, limit: 10}
+	_, err = store.Add("laptop-1", "user2", 5)
+	require.Error(t, err)
+	store.file = file
+
+	_, err = store.Add("laptop-1", "user3", 7)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], `"score":0,`)
+
+	// 重启后可以重放
+	store, err = NewFileRatingStore(path)
+	require.NoError(t, err)
+	defer store.Close()
+
+	rating, err := store.Find("laptop-1")
+	require.NoError(t, err)
+	require.Equal(t, Rating{Count: 2, Sum: 7}, *rating)
+	userRating, err := store.FindUserRating("laptop-1", "user2")
+	require.NoError(t, err)
+	require.Nil(t, userRating)
+}
+
+func TestFileRatingStoreRejectsCorruptLog(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "ratings.log")
+	err := os.WriteFile(path, []byte("not json\n"), 0644)
+	require.NoError(t, err)
+
+	_, err = NewFileRatingStore(path)
+	require.Error(t, err)
+}
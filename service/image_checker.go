@@ -0,0 +1,304 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ImageIssueKind 图片一致性问题类型
+type ImageIssueKind int
+
+const (
+	ImageIssueOrphanFile       ImageIssueKind = iota + 1 // 没有被任何图片引用的文件
+	ImageIssueDanglingMetadata                           // 图片信息指向的文件不存在
+	ImageIssueSizeMismatch                               // 文件大小与记录不一致
+	ImageIssueChecksumMismatch                           // 文件内容与 SHA-256 不一致
+	ImageIssueMissingLaptop                              // 图片所属的 laptop 不存在
+)
+
+func (kind ImageIssueKind) String() string {
+	switch kind {
+	case ImageIssueOrphanFile:
+		return "orphan file"
+	case ImageIssueDanglingMetadata:
+		return "dangling metadata"
+	case ImageIssueSizeMismatch:
+		return "size mismatch"
+	case ImageIssueChecksumMismatch:
+		return "checksum mismatch"
+	case ImageIssueMissingLaptop:
+		return "missing laptop"
+	default:
+		return "unknown"
+	}
+}
+
+// ImageIssue 一致性检查发现的问题
+type ImageIssue struct {
+	Kind     ImageIssueKind
+	ImageID  string
+	Variant  string // 问题出现在缩放版本时不为空
+	Path     string
+	Detail   string
+	Repaired bool
+}
+
+// ImageCheckReport 一致性检查报告
+type ImageCheckReport struct {
+	CheckedImages int
+	CheckedFiles  int
+	Issues        []*ImageIssue
+}
+
+// ImageChecker 支持一致性检查的图片存储
+type ImageChecker interface {
+	// 检查图片信息与存储内容是否一致, repair 为 true 时修复发现的问题
+	Check(laptopStore LaptopStore, repair bool) (*ImageCheckReport, error)
+}
+
+// Check 检查孤立文件、缺失文件、大小和 SHA-256 不一致以及所属 laptop 不存在的图片
+//
+// 修复时删除孤立文件, 删除指向缺失或损坏文件的图片(或缩放版本), 删除所属 laptop 不存在的图片
+func (store *DiskImageStore) Check(laptopStore LaptopStore, repair bool) (*ImageCheckReport, error) {
+	// 计算 SHA-256 需要读取所有文件, 不持有锁, 避免阻塞上传和下载
+	store.mutex.RLock()
+	blobs := make(map[string]*imageBlob, len(store.blobs))
+	for checksum, blob := range store.blobs {
+		blobs[checksum] = blob
+	}
+	store.mutex.RUnlock()
+
+	checked := make(map[string]*ImageIssue)
+	for checksum, blob := range blobs {
+		issue, err := checkImageFile(checksum, blob)
+		if err != nil {
+			return nil, err
+		}
+		if issue != nil {
+			checked[checksum] = issue
+		}
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	report := &ImageCheckReport{
+		CheckedImages: len(store.images),
+	}
+
+	// 检查期间被释放或重新写入的文件留到下一次检查
+	broken := make(map[string]*ImageIssue)
+	for checksum, issue := range checked {
+		if store.blobs[checksum] == blobs[checksum] {
+			broken[checksum] = issue
+		}
+	}
+
+	referenced := make(map[string]bool)
+	for _, blob := range store.blobs {
+		referenced[filepath.Clean(blob.path)] = true
+	}
+
+	// 检查没有被引用的文件
+	files, err := ioutil.ReadDir(store.imageFolder)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image folder: %w", err)
+	}
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), tempImagePrefix) {
+			continue
+		}
+		report.CheckedFiles++
+
+		path := filepath.Join(store.imageFolder, file.Name())
+		if referenced[path] {
+			continue
+		}
+
+		issue := &ImageIssue{
+			Kind:   ImageIssueOrphanFile,
+			Path:   path,
+			Detail: fmt.Sprintf("%d bytes", file.Size()),
+		}
+		if repair {
+			err := os.Remove(path)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("cannot remove orphan file: %w", err)
+			}
+			issue.Repaired = true
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	// 检查图片信息
+	for imageID, info := range store.images {
+		remove := false
+
+		if blobIssue := broken[info.Checksum]; blobIssue != nil {
+			report.Issues = append(report.Issues, &ImageIssue{
+				Kind:     blobIssue.Kind,
+				ImageID:  imageID,
+				Path:     info.Path,
+				Detail:   blobIssue.Detail,
+				Repaired: repair,
+			})
+			remove = true
+		}
+
+		for name, v := range info.Variants {
+			blobIssue := broken[v.Checksum]
+			if blobIssue == nil {
+				continue
+			}
+
+			report.Issues = append(report.Issues, &ImageIssue{
+				Kind:     blobIssue.Kind,
+				ImageID:  imageID,
+				Variant:  name,
+				Path:     v.Path,
+				Detail:   blobIssue.Detail,
+				Repaired: repair,
+			})
+			if repair && !remove {
+				delete(info.Variants, name)
+				err := store.releaseBlob(v.Checksum)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if laptopStore != nil {
+			laptop, err := laptopStore.Find(info.LaptopId)
+			if err != nil {
+				return nil, fmt.Errorf("cannot find laptop: %w", err)
+			}
+			if laptop == nil {
+				report.Issues = append(report.Issues, &ImageIssue{
+					Kind:     ImageIssueMissingLaptop,
+					ImageID:  imageID,
+					Path:     info.Path,
+					Detail:   fmt.Sprintf("laptop %s doesn't exist", info.LaptopId),
+					Repaired: repair,
+				})
+				remove = true
+			}
+		}
+
+		if repair && remove {
+			err := store.deleteImage(imageID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// checkImageFile 检查文件是否存在以及大小和 SHA-256 是否一致
+func checkImageFile(checksum string, blob *imageBlob) (*ImageIssue, error) {
+	file, err := os.Open(blob.path)
+	if os.IsNotExist(err) {
+		return &ImageIssue{Kind: ImageIssueDanglingMetadata, Detail: "file doesn't exist"}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open image file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image file: %w", err)
+	}
+
+	if size != blob.size {
+		detail := fmt.Sprintf("expected %d bytes, got %d bytes", blob.size, size)
+		return &ImageIssue{Kind: ImageIssueSizeMismatch, Detail: detail}, nil
+	}
+
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if actual != checksum {
+		detail := fmt.Sprintf("expected sha256 %s, got %s", checksum, actual)
+		return &ImageIssue{Kind: ImageIssueChecksumMismatch, Detail: detail}, nil
+	}
+
+	return nil, nil
+}
+
+// ImageReconciler 定期在后台检查图片存储的一致性
+type ImageReconciler struct {
+	checker     ImageChecker
+	laptopStore LaptopStore
+	quota       *ImageQuota
+	interval    time.Duration
+	repair      bool
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// NewImageReconciler 创建实例, 调用 Start 后开始检查, 修复时删除的图片归还 quota 的配额, quota 可以为 nil
+func NewImageReconciler(checker ImageChecker, laptopStore LaptopStore, quota *ImageQuota, interval time.Duration, repair bool) *ImageReconciler {
+	return &ImageReconciler{
+		checker:     checker,
+		laptopStore: laptopStore,
+		quota:       quota,
+		interval:    interval,
+		repair:      repair,
+		done:        make(chan struct{}),
+	}
+}
+
+// Start 启动后台检查
+func (reconciler *ImageReconciler) Start() {
+	reconciler.wg.Add(1)
+
+	go func() {
+		defer reconciler.wg.Done()
+
+		ticker := time.NewTicker(reconciler.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-reconciler.done:
+				return
+			case <-ticker.C:
+				reconciler.run()
+			}
+		}
+	}()
+}
+
+// Stop 停止后台检查
+func (reconciler *ImageReconciler) Stop() {
+	close(reconciler.done)
+	reconciler.wg.Wait()
+}
+
+func (reconciler *ImageReconciler) run() {
+	report, err := reconciler.checker.Check(reconciler.laptopStore, reconciler.repair)
+	if err != nil {
+		log.Printf("cannot check image store: %v", err)
+		return
+	}
+	if reconciler.quota != nil {
+		reconciler.quota.RemoveRepaired(report)
+	}
+
+	log.Printf("checked %d images and %d files, found %d issues", report.CheckedImages, report.CheckedFiles, len(report.Issues))
+	for _, issue := range report.Issues {
+		log.Printf("- %s: image = %q, variant = %q, path = %s, %s, repaired = %t",
+			issue.Kind, issue.ImageID, issue.Variant, issue.Path, issue.Detail, issue.Repaired)
+	}
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"go-pcbook-micro/pb"
+	"go-pcbook-micro/sample"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskImageStoreCheck(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+	imageStore := NewDiskImageStore(imageFolder)
+	laptopStore := NewInMemoryLaptopStore()
+
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop))
+
+	healthyID, err := imageStore.Save(laptop.GetId(), ".jpg", *bytes.NewBufferString("healthy"))
+	require.NoError(t, err)
+	missingID, err := imageStore.Save(laptop.GetId(), ".jpg", *bytes.NewBufferString("missing"))
+	require.NoError(t, err)
+	corruptID, err := imageStore.Save(laptop.GetId(), ".jpg", *bytes.NewBufferString("corrupt"))
+	require.NoError(t, err)
+	resizedID, err := imageStore.Save(laptop.GetId(), ".jpg", *bytes.NewBufferString("resized"))
+	require.NoError(t, err)
+	require.NoError(t, imageStore.SaveVariant(resizedID, "small", ".jpg", *bytes.NewBufferString("truncated")))
+	noLaptopID, err := imageStore.Save("deleted-laptop", ".jpg", *bytes.NewBufferString("no laptop"))
+	require.NoError(t, err)
+
+	missing, _ := imageStore.Find(missingID)
+	require.NoError(t, os.Remove(missing.Path))
+	corrupt, _ := imageStore.Find(corruptID)
+	require.NoError(t, ioutil.WriteFile(corrupt.Path, []byte("CORRUPT"), 0644))
+	resized, _ := imageStore.Find(resizedID)
+	require.NoError(t, ioutil.WriteFile(resized.Variants["small"].Path, []byte("trunc"), 0644))
+	orphanPath := filepath.Join(imageFolder, "orphan.jpg")
+	require.NoError(t, ioutil.WriteFile(orphanPath, []byte("orphan"), 0644))
+
+	report, err := imageStore.Check(laptopStore, false)
+	require.NoError(t, err)
+	require.Equal(t, 5, report.CheckedImages)
+	require.Equal(t, 6, report.CheckedFiles)
+
+	kinds := make(map[ImageIssueKind]*ImageIssue)
+	for _, issue := range report.Issues {
+		require.False(t, issue.Repaired)
+		kinds[issue.Kind] = issue
+	}
+	require.Len(t, report.Issues, 5)
+	require.Equal(t, orphanPath, kinds[ImageIssueOrphanFile].Path)
+	require.Equal(t, missingID, kinds[ImageIssueDanglingMetadata].ImageID)
+	require.Equal(t, corruptID, kinds[ImageIssueChecksumMismatch].ImageID)
+	require.Equal(t, resizedID, kinds[ImageIssueSizeMismatch].ImageID)
+	require.Equal(t, "small", kinds[ImageIssueSizeMismatch].Variant)
+	require.Equal(t, noLaptopID, kinds[ImageIssueMissingLaptop].ImageID)
+
+	// 修复
+	report, err = imageStore.Check(laptopStore, true)
+	require.NoError(t, err)
+	require.Len(t, report.Issues, 5)
+	for _, issue := range report.Issues {
+		require.True(t, issue.Repaired)
+	}
+	require.NoFileExists(t, orphanPath)
+
+	for _, imageID := range []string{missingID, corruptID, noLaptopID} {
+		info, err := imageStore.Find(imageID)
+		require.NoError(t, err)
+		require.Nil(t, info)
+	}
+
+	resized, err = imageStore.Find(resizedID)
+	require.NoError(t, err)
+	require.Empty(t, resized.Variants)
+
+	healthy, err := imageStore.Find(healthyID)
+	require.NoError(t, err)
+	require.NotNil(t, healthy)
+
+	// 修复后没有问题
+	report, err = imageStore.Check(laptopStore, false)
+	require.NoError(t, err)
+	require.Empty(t, report.Issues)
+	require.Equal(t, 2, report.CheckedImages)
+	require.Equal(t, 2, report.CheckedFiles)
+}
+
+func TestImageCheckRepairReleasesQuota(t *testing.T) {
+	t.Parallel()
+
+	imageStore := NewDiskImageStore(t.TempDir())
+	laptopStore := NewInMemoryLaptopStore()
+	quota := NewImageQuota(QuotaConfig{})
+
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop))
+
+	save := func(laptopID string, data string) string {
+		imageID, err := imageStore.Save(laptopID, ".jpg", *bytes.NewBufferString(data))
+		require.NoError(t, err)
+		require.NoError(t, quota.Reserve(laptopID, "alice", int64(len(data))))
+		quota.Commit(imageID, laptopID, "alice", int64(len(data)))
+		return imageID
+	}
+
+	save(laptop.GetId(), "healthy")
+	save("deleted-laptop-1", "orphan 1")
+	save("deleted-laptop-2", "orphan 2")
+	require.Equal(t, QuotaUsage{Images: 3, Bytes: 23}, quota.UserUsage("alice"))
+
+	// CheckImages rpc 修复后归还配额
+	server := NewLaptopServer(laptopStore, imageStore, nil, WithImageQuota(quota))
+	res, err := server.CheckImages(context.Background(), &pb.CheckImagesRequest{Repair: true})
+	require.NoError(t, err)
+	require.Len(t, res.GetIssues(), 2)
+	require.Equal(t, QuotaUsage{}, quota.LaptopUsage("deleted-laptop-1"))
+	require.Equal(t, QuotaUsage{Images: 1, Bytes: 7}, quota.UserUsage("alice"))
+
+	// 后台检查修复后归还配额
+	save("deleted-laptop-3", "orphan 3")
+	reconciler := NewImageReconciler(imageStore, laptopStore, quota, time.Hour, true)
+	reconciler.run()
+	require.Equal(t, QuotaUsage{}, quota.LaptopUsage("deleted-laptop-3"))
+	require.Equal(t, QuotaUsage{Images: 1, Bytes: 7}, quota.UserUsage("alice"))
+	require.Equal(t, QuotaUsage{Images: 1, Bytes: 7}, quota.LaptopUsage(laptop.GetId()))
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"go-pcbook-micro/pb"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ImageDownloadPath REST 下载图片的路径, 与 DownloadImage 的 http 规则相同
+const ImageDownloadPath = "/v1/laptop/image/{image_id}"
+
+// NewImageDownloadHandler 返回 REST 下载图片的 handler, 通过 DownloadImage 读取图片,
+// 直接返回图片内容和对应的 Content-Type, 而不是网关转换的流式 JSON 消息.
+// 缩放版本由查询参数 variant 指定, 凭据与其他 REST 请求一样转发给 gRPC 服务
+func NewImageDownloadHandler(mux *runtime.ServeMux, client pb.LaptopServiceClient) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		_, outbound := runtime.MarshalerForRequest(mux, r)
+		ctx, err := runtime.AnnotateContext(r.Context(), mux, r, "/pcbook.LaptopService/DownloadImage")
+		if err != nil {
+			runtime.HTTPError(r.Context(), mux, outbound, w, r, err)
+			return
+		}
+
+		req := &pb.DownloadImageRequest{
+			ImageId: params["image_id"],
+			Variant: r.URL.Query().Get("variant"),
+		}
+		stream, err := client.DownloadImage(ctx, req)
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outbound, w, r, err)
+			return
+		}
+
+		// 第一条消息是图片信息, 找不到图片等错误都在发送图片信息之前返回
+		res, err := stream.Recv()
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outbound, w, r, err)
+			return
+		}
+		info := res.GetInfo()
+		if info == nil {
+			runtime.HTTPError(ctx, mux, outbound, w, r, status.Errorf(codes.Internal, "image info is not received"))
+			return
+		}
+
+		contentType := mime.TypeByExtension(info.GetImageType())
+		if len(contentType) == 0 {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+
+		for {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				// 已经开始发送图片内容, 不能再返回错误状态码
+				log.Printf("cannot receive image %s: %v", req.GetImageId(), err)
+				return
+			}
+
+			_, err = w.Write(res.GetChunkData())
+			if err != nil {
+				log.Printf("cannot write image %s: %v", req.GetImageId(), err)
+				return
+			}
+		}
+	}
+}
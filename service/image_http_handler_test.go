@@ -0,0 +1,70 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"go-pcbook-micro/pb"
+	"go-pcbook-micro/sample"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestImageDownloadHandler(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop))
+
+	imageStore := NewDiskImageStore(t.TempDir())
+	data := bytes.Repeat([]byte("jpeg"), imageChunkSize)
+	imageID, err := imageStore.Save(laptop.GetId(), ".jpg", *bytes.NewBuffer(data))
+	require.NoError(t, err)
+	require.NoError(t, imageStore.SaveVariant(imageID, "small", ".png", *bytes.NewBufferString("png")))
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
+
+	// 与 REST 服务器相同, 先注册网关生成的 handler, 再替换下载图片的 handler
+	mux := runtime.NewServeMux()
+	dialOptions := []grpc.DialOption{grpc.WithInsecure()}
+	require.NoError(t, pb.RegisterLaptopServiceHandlerFromEndpoint(context.Background(), mux, serverAddress, dialOptions))
+	require.NoError(t, mux.HandlePath("GET", ImageDownloadPath, NewImageDownloadHandler(mux, newTestLaptopClient(t, serverAddress))))
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	get := func(path string) (*http.Response, []byte) {
+		res, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res, body
+	}
+
+	res, body := get("/v1/laptop/image/" + imageID)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "image/jpeg", res.Header.Get("Content-Type"))
+	require.Equal(t, data, body)
+
+	res, body = get("/v1/laptop/image/" + imageID + "?variant=small")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "image/png", res.Header.Get("Content-Type"))
+	require.Equal(t, []byte("png"), body)
+
+	res, _ = get("/v1/laptop/image/" + imageID + "?variant=large")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	res, _ = get("/v1/laptop/image/unknown")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	// 其他图片相关的路径仍由网关生成的 handler 处理
+	res, _ = get("/v1/laptop/image/" + imageID + "/url")
+	require.NotEqual(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+}
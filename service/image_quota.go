@@ -0,0 +1,216 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+)
+
+// QuotaConfig 图片配额, 0 表示不限制
+type QuotaConfig struct {
+	MaxImagesPerLaptop int64 // 每个 laptop 的图片数量
+	MaxBytesPerLaptop  int64 // 每个 laptop 的图片总大小
+	MaxBytesPerUser    int64 // 每个用户上传的图片总大小
+}
+
+// QuotaUsage 已使用的配额
+type QuotaUsage struct {
+	Images int64
+	Bytes  int64
+}
+
+// QuotaExceededError 超出配额返回此错误
+type QuotaExceededError struct {
+	Subject string // 如 laptop:<id>, user:<username>
+	Kind    string // images / bytes
+	Usage   int64  // 当前使用量
+	Request int64  // 本次请求量
+	Limit   int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s %s quota exceeded: usage %d + %d > limit %d", e.Subject, e.Kind, e.Usage, e.Request, e.Limit)
+}
+
+// ImageQuota 记录并限制 laptop 和用户的图片使用量
+type ImageQuota struct {
+	mutex   sync.Mutex
+	config  QuotaConfig
+	laptops map[string]*QuotaUsage
+	users   map[string]*QuotaUsage
+	images  map[string]*imageQuotaRecord
+}
+
+// imageQuotaRecord 图片占用的配额
+type imageQuotaRecord struct {
+	laptopID string
+	username string
+	size     int64
+}
+
+// NewImageQuota 创建配额实例
+func NewImageQuota(config QuotaConfig) *ImageQuota {
+	return &ImageQuota{
+		config:  config,
+		laptops: make(map[string]*QuotaUsage),
+		users:   make(map[string]*QuotaUsage),
+		images:  make(map[string]*imageQuotaRecord),
+	}
+}
+
+// Config 返回配额配置
+func (quota *ImageQuota) Config() QuotaConfig {
+	return quota.config
+}
+
+// Check 检查再上传一张 size 大小的图片是否超出配额, username 为空时不检查用户配额
+func (quota *ImageQuota) Check(laptopID string, username string, size int64) error {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	return quota.check(laptopID, username, size)
+}
+
+// Reserve 检查并占用配额, 保存失败时调用 Release 归还
+func (quota *ImageQuota) Reserve(laptopID string, username string, size int64) error {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	err := quota.check(laptopID, username, size)
+	if err != nil {
+		return err
+	}
+
+	quota.add(laptopID, username, 1, size)
+	return nil
+}
+
+// Release 归还 Reserve 占用的配额
+func (quota *ImageQuota) Release(laptopID string, username string, size int64) {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	quota.add(laptopID, username, -1, -size)
+}
+
+// Commit 记录已保存图片占用的配额, 删除图片时由 Remove 归还
+func (quota *ImageQuota) Commit(imageID string, laptopID string, username string, size int64) {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	quota.images[imageID] = &imageQuotaRecord{
+		laptopID: laptopID,
+		username: username,
+		size:     size,
+	}
+}
+
+// Remove 归还已删除图片占用的配额
+func (quota *ImageQuota) Remove(imageID string) {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	record := quota.images[imageID]
+	if record == nil {
+		return
+	}
+
+	delete(quota.images, imageID)
+	quota.add(record.laptopID, record.username, -1, -record.size)
+}
+
+// RemoveRepaired 归还一致性检查修复时删除的图片占用的配额
+func (quota *ImageQuota) RemoveRepaired(report *ImageCheckReport) {
+	for _, issue := range report.Issues {
+		// 只删除缩放版本时图片仍然存在
+		if issue.Repaired && len(issue.ImageID) > 0 && len(issue.Variant) == 0 {
+			quota.Remove(issue.ImageID)
+		}
+	}
+}
+
+// LaptopUsage 返回 laptop 的使用量
+func (quota *ImageQuota) LaptopUsage(laptopID string) QuotaUsage {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	if usage := quota.laptops[laptopID]; usage != nil {
+		return *usage
+	}
+	return QuotaUsage{}
+}
+
+// UserUsage 返回用户的使用量
+func (quota *ImageQuota) UserUsage(username string) QuotaUsage {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	if usage := quota.users[username]; usage != nil {
+		return *usage
+	}
+	return QuotaUsage{}
+}
+
+// check 调用方需持有锁
+func (quota *ImageQuota) check(laptopID string, username string, size int64) error {
+	laptop := quota.laptops[laptopID]
+	if laptop == nil {
+		laptop = &QuotaUsage{}
+	}
+
+	subject := "laptop:" + laptopID
+	err := checkLimit(subject, "images", laptop.Images, 1, quota.config.MaxImagesPerLaptop)
+	if err != nil {
+		return err
+	}
+	err = checkLimit(subject, "bytes", laptop.Bytes, size, quota.config.MaxBytesPerLaptop)
+	if err != nil {
+		return err
+	}
+
+	if len(username) == 0 {
+		return nil
+	}
+
+	user := quota.users[username]
+	if user == nil {
+		user = &QuotaUsage{}
+	}
+	return checkLimit("user:"+username, "bytes", user.Bytes, size, quota.config.MaxBytesPerUser)
+}
+
+// add 调用方需持有锁
+func (quota *ImageQuota) add(laptopID string, username string, images int64, bytes int64) {
+	laptop := quota.laptops[laptopID]
+	if laptop == nil {
+		laptop = &QuotaUsage{}
+		quota.laptops[laptopID] = laptop
+	}
+	laptop.Images += images
+	laptop.Bytes += bytes
+
+	if len(username) == 0 {
+		return
+	}
+
+	user := quota.users[username]
+	if user == nil {
+		user = &QuotaUsage{}
+		quota.users[username] = user
+	}
+	user.Images += images
+	user.Bytes += bytes
+}
+
+func checkLimit(subject string, kind string, usage int64, request int64, limit int64) error {
+	if limit <= 0 || usage+request <= limit {
+		return nil
+	}
+
+	return &QuotaExceededError{
+		Subject: subject,
+		Kind:    kind,
+		Usage:   usage,
+		Request: request,
+		Limit:   limit,
+	}
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"go-pcbook-micro/pb"
+	"go-pcbook-micro/sample"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestImageQuota(t *testing.T) {
+	t.Parallel()
+
+	quota := NewImageQuota(QuotaConfig{
+		MaxImagesPerLaptop: 2,
+		MaxBytesPerLaptop:  100,
+		MaxBytesPerUser:    150,
+	})
+
+	require.NoError(t, quota.Reserve("laptop-1", "user1", 60))
+	quota.Commit("image-1", "laptop-1", "user1", 60)
+
+	// laptop 字节数超出
+	err := quota.Check("laptop-1", "user1", 41)
+	require.Error(t, err)
+	quotaErr, ok := err.(*QuotaExceededError)
+	require.True(t, ok)
+	require.Equal(t, "laptop:laptop-1", quotaErr.Subject)
+	require.EqualValues(t, 60, quotaErr.Usage)
+	require.EqualValues(t, 100, quotaErr.Limit)
+
+	require.NoError(t, quota.Reserve("laptop-1", "user1", 40))
+	quota.Commit("image-2", "laptop-1", "user1", 40)
+
+	// laptop 图片数量超出
+	err = quota.Check("laptop-1", "user1", 0)
+	require.Error(t, err)
+	require.Equal(t, "images", err.(*QuotaExceededError).Kind)
+
+	// 用户字节数超出
+	err = quota.Check("laptop-2", "user1", 51)
+	require.Error(t, err)
+	require.Equal(t, "user:user1", err.(*QuotaExceededError).Subject)
+	require.NoError(t, quota.Check("laptop-2", "user2", 51))
+
+	// 删除图片后归还配额
+	quota.Remove("image-1")
+	require.Equal(t, QuotaUsage{Images: 1, Bytes: 40}, quota.LaptopUsage("laptop-1"))
+	require.Equal(t, QuotaUsage{Images: 1, Bytes: 40}, quota.UserUsage("user1"))
+	require.NoError(t, quota.Check("laptop-1", "user1", 60))
+
+	quota.Release("laptop-1", "user1", 40)
+	require.Equal(t, QuotaUsage{}, quota.LaptopUsage("laptop-1"))
+}
+
+func TestClientUploadImageQuotaExceeded(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop))
+
+	quota := NewImageQuota(QuotaConfig{MaxBytesPerLaptop: 10})
+	serverAddress := startTestLaptopServer(t, laptopStore, NewDiskImageStore(t.TempDir()), nil, WithImageQuota(quota))
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	stream, err := laptopClient.UploadImage(context.Background())
+	require.NoError(t, err)
+
+	err = stream.Send(&pb.UploadImageRequest{
+		Data: &pb.UploadImageRequest_Info{
+			Info: &pb.ImageInfo{LaptopId: laptop.GetId(), ImageType: ".jpg"},
+		},
+	})
+	require.NoError(t, err)
+
+	err = stream.Send(&pb.UploadImageRequest{
+		Data: &pb.UploadImageRequest_ChunkData{ChunkData: make([]byte, 11)},
+	})
+	require.NoError(t, err)
+
+	_, err = stream.CloseAndRecv()
+	st, ok := status.FromError(err)
+	require.True(t, ok)
+	require.Equal(t, codes.ResourceExhausted, st.Code())
+	require.Len(t, st.Details(), 1)
+	require.Equal(t, "laptop:"+laptop.GetId(), st.Details()[0].(*errdetails.QuotaFailure).Violations[0].Subject)
+
+	// 没有占用配额
+	require.Equal(t, QuotaUsage{}, quota.LaptopUsage(laptop.GetId()))
+}
@@ -0,0 +1,282 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // 注册 gif 解码器
+	"image/jpeg"
+	"image/png"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrResizeQueueFull 缩放任务队列已满
+	ErrResizeQueueFull = errors.New("resize queue is full")
+	// ErrImageTooLarge 图片像素数超过限制, 不解码
+	ErrImageTooLarge = errors.New("image is too large")
+)
+
+// DefaultMaxImagePixels 默认最多解码的像素数
+const DefaultMaxImagePixels = 40 << 20
+
+// ImageVariant 图片缩放版本配置, 缩放后的图片保持宽高比且不超过最大宽高
+type ImageVariant struct {
+	Name      string
+	MaxWidth  int
+	MaxHeight int
+}
+
+// ParseImageVariants 解析缩放版本配置, 格式如 "small=160x160,medium=480x480"
+func ParseImageVariants(value string) ([]ImageVariant, error) {
+	var variants []ImageVariant
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		var variant ImageVariant
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return nil, fmt.Errorf("invalid image variant: %s", item)
+		}
+		variant.Name = parts[0]
+
+		_, err := fmt.Sscanf(parts[1], "%dx%d", &variant.MaxWidth, &variant.MaxHeight)
+		if err != nil || variant.MaxWidth <= 0 || variant.MaxHeight <= 0 {
+			return nil, fmt.Errorf("invalid image variant size: %s", item)
+		}
+
+		variants = append(variants, variant)
+	}
+	return variants, nil
+}
+
+// ResizingImageStore 保存图片后在后台生成缩放版本
+type ResizingImageStore struct {
+	ImageStore
+	variants  []ImageVariant
+	maxPixels int64
+	jobs      chan string
+	wg        sync.WaitGroup
+}
+
+// ResizingImageStoreOption 配置 ResizingImageStore
+type ResizingImageStoreOption func(*ResizingImageStore)
+
+// WithMaxImagePixels 宽 x 高超过 maxPixels 的图片不生成缩放版本, 避免解压炸弹占用大量内存, 0 表示不限制
+func WithMaxImagePixels(maxPixels int64) ResizingImageStoreOption {
+	return func(store *ResizingImageStore) {
+		store.maxPixels = maxPixels
+	}
+}
+
+// NewResizingImageStore 创建实例并启动 workers 个后台任务
+func NewResizingImageStore(imageStore ImageStore, variants []ImageVariant, workers int, queueSize int, options ...ResizingImageStoreOption) *ResizingImageStore {
+	store := &ResizingImageStore{
+		ImageStore: imageStore,
+		variants:   variants,
+		maxPixels:  DefaultMaxImagePixels,
+		jobs:       make(chan string, queueSize),
+	}
+	for _, option := range options {
+		option(store)
+	}
+
+	for i := 0; i < workers; i++ {
+		store.wg.Add(1)
+		go store.work()
+	}
+
+	return store
+}
+
+// Save 保存原图并加入缩放任务队列
+func (store *ResizingImageStore) Save(laptopID string, imageType string, imageData bytes.Buffer) (string, error) {
+	imageID, err := store.ImageStore.Save(laptopID, imageType, imageData)
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case store.jobs <- imageID:
+	default:
+		// 队列满时不影响上传, 仅记录日志
+		log.Printf("cannot resize image %s: %v", imageID, ErrResizeQueueFull)
+	}
+
+	return imageID, nil
+}
+
+// PresignURL 由被包装的存储生成预签名下载地址
+func (store *ResizingImageStore) PresignURL(imageID string, variant string, expires time.Duration) (string, error) {
+	signer, ok := store.ImageStore.(ImageURLSigner)
+	if !ok {
+		return "", ErrPresignNotSupported
+	}
+	return signer.PresignURL(imageID, variant, expires)
+}
+
+// Check 由被包装的存储检查一致性
+func (store *ResizingImageStore) Check(laptopStore LaptopStore, repair bool) (*ImageCheckReport, error) {
+	checker, ok := store.ImageStore.(ImageChecker)
+	if !ok {
+		return nil, ErrCheckNotSupported
+	}
+	return checker.Check(laptopStore, repair)
+}
+
+// Close 停止接收任务并等待已入队的任务完成
+func (store *ResizingImageStore) Close() {
+	close(store.jobs)
+	store.wg.Wait()
+}
+
+func (store *ResizingImageStore) work() {
+	defer store.wg.Done()
+
+	for imageID := range store.jobs {
+		err := store.resize(imageID)
+		if err != nil {
+			log.Printf("cannot resize image %s: %v", imageID, err)
+		}
+	}
+}
+
+func (store *ResizingImageStore) resize(imageID string) error {
+	data, err := store.ImageStore.Load(imageID, "")
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return fmt.Errorf("image %s doesn't exist", imageID)
+	}
+
+	// 先只读取图片头部的宽高, 解码时按宽高分配内存
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("cannot decode image config: %w", err)
+	}
+	pixels := int64(config.Width) * int64(config.Height)
+	if store.maxPixels > 0 && pixels > store.maxPixels {
+		return fmt.Errorf("%w: %dx%d exceeds %d pixels", ErrImageTooLarge, config.Width, config.Height, store.maxPixels)
+	}
+
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("cannot decode image: %w", err)
+	}
+
+	for _, variant := range store.variants {
+		width, height := fitSize(src.Bounds().Dx(), src.Bounds().Dy(), variant.MaxWidth, variant.MaxHeight)
+		dst := resizeImage(src, width, height)
+
+		imageData := bytes.Buffer{}
+		imageType, err := encodeImage(&imageData, dst, format)
+		if err != nil {
+			return fmt.Errorf("cannot encode %s variant: %w", variant.Name, err)
+		}
+
+		err = store.ImageStore.SaveVariant(imageID, variant.Name, imageType, imageData)
+		if err != nil {
+			return fmt.Errorf("cannot save %s variant: %w", variant.Name, err)
+		}
+
+		log.Printf("saved %s variant of image %s: %dx%d", variant.Name, imageID, width, height)
+	}
+
+	return nil
+}
+
+// fitSize 计算保持宽高比并不超过最大宽高的尺寸, 不放大原图
+func fitSize(width, height, maxWidth, maxHeight int) (int, int) {
+	if width <= maxWidth && height <= maxHeight {
+		return width, height
+	}
+
+	if width*maxHeight > height*maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+	} else {
+		width = width * maxHeight / height
+		height = maxHeight
+	}
+
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return width, height
+}
+
+// resizeImage 使用区域平均算法缩放图片
+func resizeImage(src image.Image, width, height int) *image.RGBA {
+	// 先转换为 RGBA 再直接读取像素数据, 逐像素调用 At 每次都会分配内存
+	rgba := toRGBA(src)
+	srcWidth, srcHeight := rgba.Rect.Dx(), rgba.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := y * srcHeight / height
+		y1 := (y + 1) * srcHeight / height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < width; x++ {
+			x0 := x * srcWidth / width
+			x1 := (x + 1) * srcWidth / width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				i := sy*rgba.Stride + x0*4
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(rgba.Pix[i])
+					g += uint64(rgba.Pix[i+1])
+					b += uint64(rgba.Pix[i+2])
+					a += uint64(rgba.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+
+			j := y*dst.Stride + x*4
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
+
+// toRGBA 返回从 (0, 0) 开始的 RGBA 图片, 其他格式转换一次
+func toRGBA(src image.Image) *image.RGBA {
+	if rgba, ok := src.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	bounds := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Rect, src, bounds.Min, draw.Src)
+	return rgba
+}
+
+// encodeImage 按原图格式编码, 返回图片类型(扩展名)
+func encodeImage(w *bytes.Buffer, img image.Image, format string) (string, error) {
+	if format == "jpeg" {
+		return ".jpg", jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	}
+	return ".png", png.Encode(w, img)
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResizingImageStore(t *testing.T) {
+	t.Parallel()
+
+	testImageFolder := "../tmp"
+	variants, err := ParseImageVariants("small=160x160,large=1024x1024")
+	require.NoError(t, err)
+
+	imageStore := NewResizingImageStore(NewDiskImageStore(testImageFolder), variants, 2, 10)
+
+	data, err := ioutil.ReadFile(testImageFolder + "/laptop.jpg")
+	require.NoError(t, err)
+	original, _, err := image.DecodeConfig(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	imageID, err := imageStore.Save("laptop-id", ".jpg", *bytes.NewBuffer(data))
+	require.NoError(t, err)
+
+	// 等待后台任务完成
+	imageStore.Close()
+
+	info, err := imageStore.Find(imageID)
+	require.NoError(t, err)
+	require.Len(t, info.Variants, 2)
+
+	small, err := imageStore.Load(imageID, "small")
+	require.NoError(t, err)
+	config, _, err := image.DecodeConfig(bytes.NewReader(small))
+	require.NoError(t, err)
+	require.LessOrEqual(t, config.Width, 160)
+	require.LessOrEqual(t, config.Height, 160)
+
+	// 不放大原图
+	large, err := imageStore.Load(imageID, "large")
+	require.NoError(t, err)
+	config, _, err = image.DecodeConfig(bytes.NewReader(large))
+	require.NoError(t, err)
+	require.Equal(t, original.Width, config.Width)
+	require.Equal(t, original.Height, config.Height)
+}
+
+func TestResizingImageStoreTooLarge(t *testing.T) {
+	t.Parallel()
+
+	variants, err := ParseImageVariants("small=160x160")
+	require.NoError(t, err)
+
+	// 0 个 worker, 直接调用 resize
+	imageStore := NewResizingImageStore(NewDiskImageStore(t.TempDir()), variants, 0, 10)
+
+	// 头部声明 50000x50000 的 png, 解码需要约 10 GB 内存
+	data := bytes.Buffer{}
+	require.NoError(t, png.Encode(&data, image.NewGray(image.Rect(0, 0, 1, 1))))
+	bomb := data.Bytes()
+	binary.BigEndian.PutUint32(bomb[16:], 50000)
+	binary.BigEndian.PutUint32(bomb[20:], 50000)
+	binary.BigEndian.PutUint32(bomb[29:], crc32.ChecksumIEEE(bomb[12:29]))
+
+	imageID, err := imageStore.ImageStore.Save("laptop-id", ".png", *bytes.NewBuffer(bomb))
+	require.NoError(t, err)
+	err = imageStore.resize(imageID)
+	require.ErrorIs(t, err, ErrImageTooLarge)
+
+	// 限制可以配置
+	small := bytes.Buffer{}
+	require.NoError(t, png.Encode(&small, image.NewGray(image.Rect(0, 0, 100, 100))))
+	imageID, err = imageStore.ImageStore.Save("laptop-id", ".png", small)
+	require.NoError(t, err)
+	require.NoError(t, imageStore.resize(imageID))
+
+	imageStore = NewResizingImageStore(imageStore.ImageStore, variants, 0, 10, WithMaxImagePixels(5000))
+	err = imageStore.resize(imageID)
+	require.ErrorIs(t, err, ErrImageTooLarge)
+}
+
+func TestParseImageVariants(t *testing.T) {
+	t.Parallel()
+
+	variants, err := ParseImageVariants("small=160x120, medium=480x360")
+	require.NoError(t, err)
+	require.Equal(t, []ImageVariant{
+		{Name: "small", MaxWidth: 160, MaxHeight: 120},
+		{Name: "medium", MaxWidth: 480, MaxHeight: 360},
+	}, variants)
+
+	_, err = ParseImageVariants("small")
+	require.Error(t, err)
+
+	_, err = ParseImageVariants("small=0x160")
+	require.Error(t, err)
+}
+
+func TestFitSize(t *testing.T) {
+	t.Parallel()
+
+	width, height := fitSize(1920, 1080, 480, 480)
+	require.Equal(t, 480, width)
+	require.Equal(t, 270, height)
+
+	width, height = fitSize(1080, 1920, 480, 480)
+	require.Equal(t, 270, width)
+	require.Equal(t, 480, height)
+
+	width, height = fitSize(100, 50, 480, 480)
+	require.Equal(t, 100, width)
+	require.Equal(t, 50, height)
+}
+
+func TestResizeImage(t *testing.T) {
+	t.Parallel()
+
+	// 左半边黑色, 右半边白色, 缩放后每个像素是对应区域的平均值
+	src := image.NewGray(image.Rect(0, 0, 4, 2))
+	for y := 0; y < 2; y++ {
+		for x := 2; x < 4; x++ {
+			src.SetGray(x, y, color.Gray{Y: 255})
+		}
+	}
+
+	dst := resizeImage(src, 2, 1)
+	require.Equal(t, image.Rect(0, 0, 2, 1), dst.Bounds())
+	require.Equal(t, color.RGBA{0, 0, 0, 255}, dst.RGBAAt(0, 0))
+	require.Equal(t, color.RGBA{255, 255, 255, 255}, dst.RGBAAt(1, 0))
+
+	dst = resizeImage(src, 1, 1)
+	require.Equal(t, color.RGBA{127, 127, 127, 255}, dst.RGBAAt(0, 0))
+
+	// 不从 (0, 0) 开始的子图
+	sub := src.SubImage(image.Rect(2, 0, 4, 2))
+	dst = resizeImage(sub, 1, 1)
+	require.Equal(t, color.RGBA{255, 255, 255, 255}, dst.RGBAAt(0, 0))
+}
@@ -2,24 +2,57 @@ package service
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// ErrImageNotFound 图片不存在返回此错误
+var ErrImageNotFound = errors.New("image not found")
+
+// 正在写入的临时文件的前缀, 一致性检查时不作为孤立文件
+const tempImagePrefix = ".upload-"
+
+// ErrPresignNotSupported 存储不支持生成预签名下载地址
+var ErrPresignNotSupported = errors.New("presigned url is not supported by the image store")
+
+// ErrCheckNotSupported 存储不支持一致性检查
+var ErrCheckNotSupported = errors.New("consistency check is not supported by the image store")
+
 // ImageStore 图片存储接口
 type ImageStore interface {
 	// 保存图片
 	Save(laptopID string, imageType string, imageData bytes.Buffer) (string, error)
+	// 保存图片的缩放版本
+	SaveVariant(imageID string, variant string, imageType string, imageData bytes.Buffer) error
+	// 通过id查找图片信息
+	Find(imageID string) (*ImageInfo, error)
+	// 读取图片数据, variant 为空时读取原图
+	Load(imageID string, variant string) ([]byte, error)
+	// 删除图片及其缩放版本
+	Delete(imageID string) error
 }
 
-// DiskImageStore 磁盘存储
+// ImageURLSigner 支持生成预签名下载地址的图片存储
+type ImageURLSigner interface {
+	// 生成图片的下载地址, variant 为空时为原图
+	PresignURL(imageID string, variant string, expires time.Duration) (string, error)
+}
+
+// DiskImageStore 磁盘存储, 以内容的 SHA-256 作为文件名, 相同内容的图片共享同一个文件
 type DiskImageStore struct {
 	mutex       sync.RWMutex
 	imageFolder string
 	images      map[string]*ImageInfo
+	blobs       map[string]*imageBlob // checksum -> 文件
 }
 
 // ImageInfo 图片结构体
@@ -27,6 +60,24 @@ type ImageInfo struct {
 	LaptopId string
 	Type     string
 	Path     string
+	Size     int64
+	Checksum string                       // 图片内容的 SHA-256
+	Variants map[string]*ImageVariantInfo // 缩放版本
+}
+
+// ImageVariantInfo 图片缩放版本
+type ImageVariantInfo struct {
+	Type     string
+	Path     string
+	Size     int64
+	Checksum string
+}
+
+// imageBlob 磁盘上的图片文件及其引用计数
+type imageBlob struct {
+	path     string
+	size     int64
+	refCount int
 }
 
 // NewDiskImageStore 创建磁盘存储实例
@@ -34,6 +85,7 @@ func NewDiskImageStore(imageFloder string) *DiskImageStore {
 	return &DiskImageStore{
 		imageFolder: imageFloder,
 		images:      make(map[string]*ImageInfo),
+		blobs:       make(map[string]*imageBlob),
 	}
 }
 
@@ -43,26 +95,251 @@ func (store *DiskImageStore) Save(laptopID string, imageType string, imageData b
 		return "", fmt.Errorf("cannot generate image id: %w", err)
 	}
 
-	imagePath := fmt.Sprintf("%s/%s%s", store.imageFolder, imageID, imageType)
+	// 计算 SHA-256 和写入文件不持有锁, 持有锁时只改名和修改引用计数
+	staged, err := store.stageBlob(imageType, imageData)
+	if err != nil {
+		return "", err
+	}
+	defer staged.discard()
 
-	file, err := os.Create(imagePath)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	imagePath, err := store.addBlob(staged)
 	if err != nil {
-		return "", fmt.Errorf("cannot create image file: %w", err)
+		return "", err
 	}
 
-	_, err = imageData.WriteTo(file)
+	store.images[imageID.String()] = &ImageInfo{
+		LaptopId: laptopID,
+		Type:     imageType,
+		Path:     imagePath,
+		Size:     staged.size,
+		Checksum: staged.checksum,
+		Variants: make(map[string]*ImageVariantInfo),
+	}
+
+	return imageID.String(), nil
+}
+
+func (store *DiskImageStore) SaveVariant(imageID string, variant string, imageType string, imageData bytes.Buffer) error {
+	staged, err := store.stageBlob(imageType, imageData)
 	if err != nil {
-		return "", fmt.Errorf("cannot write image to file: %w", err)
+		return err
 	}
+	defer staged.discard()
 
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	store.images[imageID.String()] = &ImageInfo{
-		LaptopId: laptopID,
+	info := store.images[imageID]
+	if info == nil {
+		return ErrImageNotFound
+	}
+
+	imagePath, err := store.addBlob(staged)
+	if err != nil {
+		return err
+	}
+
+	// 替换已有的缩放版本
+	if old := info.Variants[variant]; old != nil {
+		err = store.releaseBlob(old.Checksum)
+		if err != nil {
+			return err
+		}
+	}
+
+	info.Variants[variant] = &ImageVariantInfo{
 		Type:     imageType,
 		Path:     imagePath,
+		Size:     staged.size,
+		Checksum: staged.checksum,
 	}
 
-	return imageID.String(), nil
+	return nil
+}
+
+func (store *DiskImageStore) Find(imageID string) (*ImageInfo, error) {
+	return store.find(imageID), nil
+}
+
+func (store *DiskImageStore) Load(imageID string, variant string) ([]byte, error) {
+	info := store.find(imageID)
+	if info == nil {
+		return nil, nil
+	}
+
+	path := info.Path
+	if len(variant) > 0 {
+		v := info.Variants[variant]
+		if v == nil {
+			return nil, nil
+		}
+		path = v.Path
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image file: %w", err)
+	}
+
+	return data, nil
+}
+
+func (store *DiskImageStore) Delete(imageID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.deleteImage(imageID)
+}
+
+// deleteImage 删除图片信息并释放文件, 调用方需持有写锁
+func (store *DiskImageStore) deleteImage(imageID string) error {
+	info := store.images[imageID]
+	if info == nil {
+		return ErrImageNotFound
+	}
+
+	delete(store.images, imageID)
+
+	for _, v := range info.Variants {
+		err := store.releaseBlob(v.Checksum)
+		if err != nil {
+			return err
+		}
+	}
+	return store.releaseBlob(info.Checksum)
+}
+
+// find 返回图片信息的副本
+func (store *DiskImageStore) find(imageID string) *ImageInfo {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	info := store.images[imageID]
+	if info == nil {
+		return nil
+	}
+	return info.Clone()
+}
+
+// stagedBlob 已写入临时文件, 还没有加入存储的图片内容
+type stagedBlob struct {
+	checksum string
+	size     int64
+	path     string // 图片文件的路径
+	tempPath string
+}
+
+// stageBlob 计算 SHA-256 并把内容写入图片目录中的临时文件, 不需要持有锁
+func (store *DiskImageStore) stageBlob(imageType string, imageData bytes.Buffer) (*stagedBlob, error) {
+	sum := sha256.Sum256(imageData.Bytes())
+	checksum := hex.EncodeToString(sum[:])
+
+	file, err := ioutil.TempFile(store.imageFolder, tempImagePrefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create image file: %w", err)
+	}
+
+	staged := &stagedBlob{
+		checksum: checksum,
+		size:     int64(imageData.Len()),
+		path:     fmt.Sprintf("%s/%s%s", store.imageFolder, checksum, imageType),
+		tempPath: file.Name(),
+	}
+
+	err = writeImageFile(file, imageData)
+	if err != nil {
+		staged.discard()
+		return nil, err
+	}
+	return staged, nil
+}
+
+// discard 删除没有使用的临时文件, 已经改名时什么也不做
+func (staged *stagedBlob) discard() {
+	err := os.Remove(staged.tempPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("cannot remove temporary image file %s: %v", staged.tempPath, err)
+	}
+}
+
+// addBlob 增加图片文件的引用, 文件不存在时把临时文件改名为图片文件, 调用方需持有写锁
+func (store *DiskImageStore) addBlob(staged *stagedBlob) (string, error) {
+	blob := store.blobs[staged.checksum]
+	if blob != nil {
+		blob.refCount++
+		return blob.path, nil
+	}
+
+	err := os.Rename(staged.tempPath, staged.path)
+	if err != nil {
+		return "", fmt.Errorf("cannot rename image file: %w", err)
+	}
+
+	store.blobs[staged.checksum] = &imageBlob{
+		path:     staged.path,
+		size:     staged.size,
+		refCount: 1,
+	}
+
+	return staged.path, nil
+}
+
+// releaseBlob 减少图片文件的引用, 最后一个引用释放时删除文件, 调用方需持有写锁
+func (store *DiskImageStore) releaseBlob(checksum string) error {
+	blob := store.blobs[checksum]
+	if blob == nil {
+		return nil
+	}
+
+	blob.refCount--
+	if blob.refCount > 0 {
+		return nil
+	}
+
+	delete(store.blobs, checksum)
+
+	err := os.Remove(blob.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove image file: %w", err)
+	}
+	return nil
+}
+
+// Clone 复制图片信息
+func (info *ImageInfo) Clone() *ImageInfo {
+	other := &ImageInfo{
+		LaptopId: info.LaptopId,
+		Type:     info.Type,
+		Path:     info.Path,
+		Size:     info.Size,
+		Checksum: info.Checksum,
+		Variants: make(map[string]*ImageVariantInfo, len(info.Variants)),
+	}
+	for name, v := range info.Variants {
+		other.Variants[name] = &ImageVariantInfo{
+			Type:     v.Type,
+			Path:     v.Path,
+			Size:     v.Size,
+			Checksum: v.Checksum,
+		}
+	}
+	return other
+}
+
+// writeImageFile 写入并关闭文件, 有的文件系统在关闭时才报告写入错误
+func writeImageFile(file *os.File, imageData bytes.Buffer) error {
+	_, err := imageData.WriteTo(file)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cannot write image to file: %w", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return fmt.Errorf("cannot close image file: %w", err)
+	}
+	return nil
 }
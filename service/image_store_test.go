@@ -0,0 +1,111 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskImageStoreDeduplication(t *testing.T) {
+	t.Parallel()
+
+	imageStore := NewDiskImageStore(t.TempDir())
+	data := []byte("same laptop image")
+	sum := sha256.Sum256(data)
+
+	imageID1, err := imageStore.Save("laptop-1", ".jpg", *bytes.NewBuffer(data))
+	require.NoError(t, err)
+	imageID2, err := imageStore.Save("laptop-2", ".jpg", *bytes.NewBuffer(data))
+	require.NoError(t, err)
+	require.NotEqual(t, imageID1, imageID2)
+
+	info1, err := imageStore.Find(imageID1)
+	require.NoError(t, err)
+	info2, err := imageStore.Find(imageID2)
+	require.NoError(t, err)
+
+	// 相同内容共享同一个文件
+	require.Equal(t, hex.EncodeToString(sum[:]), info1.Checksum)
+	require.Equal(t, info1.Path, info2.Path)
+	require.FileExists(t, info1.Path)
+
+	// 仍有引用时保留文件
+	require.NoError(t, imageStore.Delete(imageID1))
+	require.FileExists(t, info1.Path)
+
+	loaded, err := imageStore.Load(imageID2, "")
+	require.NoError(t, err)
+	require.Equal(t, data, loaded)
+
+	// 最后一个引用删除后移除文件
+	require.NoError(t, imageStore.Delete(imageID2))
+	require.NoFileExists(t, info1.Path)
+
+	require.ErrorIs(t, imageStore.Delete(imageID2), ErrImageNotFound)
+}
+
+func TestDiskImageStoreReplaceVariant(t *testing.T) {
+	t.Parallel()
+
+	imageStore := NewDiskImageStore(t.TempDir())
+
+	imageID, err := imageStore.Save("laptop-1", ".png", *bytes.NewBufferString("original"))
+	require.NoError(t, err)
+
+	err = imageStore.SaveVariant(imageID, "small", ".png", *bytes.NewBufferString("small-1"))
+	require.NoError(t, err)
+	info, err := imageStore.Find(imageID)
+	require.NoError(t, err)
+	oldPath := info.Variants["small"].Path
+
+	err = imageStore.SaveVariant(imageID, "small", ".png", *bytes.NewBufferString("small-2"))
+	require.NoError(t, err)
+	require.NoFileExists(t, oldPath)
+
+	err = imageStore.SaveVariant("unknown", "small", ".png", *bytes.NewBufferString("small-2"))
+	require.ErrorIs(t, err, ErrImageNotFound)
+}
+
+func TestDiskImageStoreConcurrentSave(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+	imageStore := NewDiskImageStore(imageFolder)
+	data := []byte("concurrent laptop image")
+
+	const n = 8
+	var wg sync.WaitGroup
+	imageIDs := make([]string, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			imageIDs[i], errs[i] = imageStore.Save("laptop", ".jpg", *bytes.NewBuffer(data))
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		require.NoError(t, errs[i])
+		loaded, err := imageStore.Load(imageIDs[i], "")
+		require.NoError(t, err)
+		require.Equal(t, data, loaded)
+	}
+
+	// 相同内容只保留一个文件, 临时文件全部清理
+	files, err := ioutil.ReadDir(imageFolder)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.False(t, strings.HasPrefix(files[0].Name(), tempImagePrefix))
+
+	report, err := imageStore.Check(NewInMemoryLaptopStore(), false)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.CheckedFiles)
+}
@@ -0,0 +1,270 @@
+package service
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+const minRSAKeyBits = 2048
+
+// SigningKey 签名 access token 的非对称密钥, 用 kid 区分
+type SigningKey struct {
+	ID         string
+	Algorithm  string // RS256, ES256 或 EdDSA
+	PrivateKey crypto.PrivateKey
+	PublicKey  crypto.PublicKey
+	ActivateAt time.Time // 从这个时间开始用于签名, 零值表示立即生效
+}
+
+// NewSigningKey 根据私钥类型确定算法: RSA 使用 RS256, P-256 使用 ES256, Ed25519 使用 EdDSA
+func NewSigningKey(id string, privateKey crypto.PrivateKey, activateAt time.Time) (*SigningKey, error) {
+	if len(id) == 0 {
+		return nil, errors.New("signing key id must not be empty")
+	}
+
+	key := &SigningKey{
+		ID:         id,
+		PrivateKey: privateKey,
+		ActivateAt: activateAt,
+	}
+
+	switch privateKey := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if privateKey.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("rsa signing key %s must be at least %d bits", id, minRSAKeyBits)
+		}
+		key.Algorithm = "RS256"
+		key.PublicKey = &privateKey.PublicKey
+	case *ecdsa.PrivateKey:
+		if privateKey.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("ecdsa signing key %s must use curve P-256", id)
+		}
+		key.Algorithm = "ES256"
+		key.PublicKey = &privateKey.PublicKey
+	case ed25519.PrivateKey:
+		key.Algorithm = SigningMethodEd25519.Alg()
+		key.PublicKey = privateKey.Public()
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", privateKey)
+	}
+
+	return key, nil
+}
+
+// LoadSigningKey 从 PEM 文件读取私钥, 支持 PKCS#8, PKCS#1 (RSA) 和 SEC 1 (EC) 格式
+func LoadSigningKey(id string, path string, activateAt time.Time) (*SigningKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read signing key %s: %w", id, err)
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no private key found in %s", path)
+		}
+
+		var privateKey crypto.PrivateKey
+		switch block.Type {
+		case "PRIVATE KEY":
+			privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			privateKey, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			// 例如 openssl ecparam 输出的 EC PARAMETERS
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse signing key %s: %w", id, err)
+		}
+
+		return NewSigningKey(id, privateKey, activateAt)
+	}
+}
+
+// ParseSigningKeys 解析 "kid=path[@activate-at],..." 格式的密钥列表并读取密钥, 生效时间使用 RFC 3339 格式
+func ParseSigningKeys(value string) ([]*SigningKey, error) {
+	var keys []*SigningKey
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid signing key %q, expect kid=path[@activate-at]", item)
+		}
+
+		id := strings.TrimSpace(parts[0])
+		path := strings.TrimSpace(parts[1])
+		activateAt := time.Time{}
+		if i := strings.LastIndex(path, "@"); i >= 0 {
+			var err error
+			activateAt, err = time.Parse(time.RFC3339, path[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid activation time of signing key %s: %w", id, err)
+			}
+			path = path[:i]
+		}
+
+		key, err := LoadSigningKey(id, path, activateAt)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// KeyRing 按生效时间轮换的签名密钥
+//
+// 任一时刻使用已生效的密钥中最新的一个签名, 被替换的密钥在 retention 内仍然可以验证,
+// retention 应不小于 access token 的有效期, 使轮换前签发的 token 在过期之前都有效
+type KeyRing struct {
+	keys      []*SigningKey // 按生效时间排序
+	retention time.Duration
+}
+
+// NewKeyRing 创建实例, kid 不能重复
+func NewKeyRing(keys []*SigningKey, retention time.Duration) (*KeyRing, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one signing key is required")
+	}
+
+	ids := make(map[string]bool)
+	for _, key := range keys {
+		if ids[key.ID] {
+			return nil, fmt.Errorf("duplicate signing key id %s", key.ID)
+		}
+		ids[key.ID] = true
+	}
+
+	sorted := make([]*SigningKey, len(keys))
+	copy(sorted, keys)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].ActivateAt.Before(sorted[j].ActivateAt)
+	})
+
+	return &KeyRing{
+		keys:      sorted,
+		retention: retention,
+	}, nil
+}
+
+// SigningKey 返回 now 时用于签名的密钥, 没有已生效的密钥时返回 nil
+func (ring *KeyRing) SigningKey(now time.Time) *SigningKey {
+	var active *SigningKey
+	for _, key := range ring.keys {
+		if key.ActivateAt.After(now) {
+			break
+		}
+		active = key
+	}
+	return active
+}
+
+// VerificationKey 返回 kid 对应的密钥, 密钥未生效或已经退役时返回错误,
+// leeway 与验证 token 有效期时的时钟偏差一致, 使 token 在 exp 加上 leeway 之前都能找到密钥
+func (ring *KeyRing) VerificationKey(kid string, now time.Time, leeway time.Duration) (*SigningKey, error) {
+	for i, key := range ring.keys {
+		if key.ID != kid {
+			continue
+		}
+
+		if key.ActivateAt.After(now.Add(leeway)) {
+			return nil, fmt.Errorf("signing key %s is not active yet", kid)
+		}
+		if ring.retired(i, now, leeway) {
+			return nil, fmt.Errorf("signing key %s is retired", kid)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %s", kid)
+}
+
+// retired 下一个密钥生效后再经过 retention 和 leeway, 密钥退役
+func (ring *KeyRing) retired(i int, now time.Time, leeway time.Duration) bool {
+	if i+1 >= len(ring.keys) {
+		return false
+	}
+	return now.After(ring.keys[i+1].ActivateAt.Add(ring.retention + leeway))
+}
+
+// JSONWebKey RFC 7517 格式的公钥
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet /.well-known/jwks.json 返回的内容
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWKS 返回尚未退役的公钥, 包括还未生效的密钥, 使其他服务在轮换前就能拿到新的公钥
+func (ring *KeyRing) JWKS(now time.Time, leeway time.Duration) JSONWebKeySet {
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for i, key := range ring.keys {
+		if ring.retired(i, now, leeway) {
+			continue
+		}
+		set.Keys = append(set.Keys, key.JWK())
+	}
+	return set
+}
+
+// JWK 把公钥转换为 JSON Web Key
+func (key *SigningKey) JWK() JSONWebKey {
+	jwk := JSONWebKey{
+		Kid: key.ID,
+		Use: "sig",
+		Alg: key.Algorithm,
+	}
+
+	switch publicKey := key.PublicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encodeJWKBytes(publicKey.N.Bytes())
+		jwk.E = encodeJWKBytes(big.NewInt(int64(publicKey.E)).Bytes())
+	case *ecdsa.PublicKey:
+		// 坐标按曲线长度补齐
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = publicKey.Curve.Params().Name
+		jwk.X = encodeJWKBytes(publicKey.X.FillBytes(make([]byte, size)))
+		jwk.Y = encodeJWKBytes(publicKey.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = encodeJWKBytes(publicKey)
+	}
+	return jwk
+}
+
+func encodeJWKBytes(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeyFile(t *testing.T, dir string, name string, block *pem.Block) string {
+	path := filepath.Join(dir, name+".pem")
+	require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600))
+	return path
+}
+
+func writePKCS8KeyFile(t *testing.T, dir string, name string, privateKey crypto.PrivateKey) string {
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+	return writeKeyFile(t, dir, name, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func TestJWTManagerSigningKeys(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	paths := map[string]string{
+		"RS256": writeKeyFile(t, dir, "rsa", &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}),
+		"ES256": writeKeyFile(t, dir, "ec", &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}),
+		"EdDSA": writePKCS8KeyFile(t, dir, "ed25519", edKey),
+	}
+
+	user, err := NewUser("alice", "password1", "user")
+	require.NoError(t, err)
+
+	for algorithm, path := range paths {
+		keys, err := ParseSigningKeys(fmt.Sprintf("k1=%s", path))
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+		require.Equal(t, algorithm, keys[0].Algorithm)
+
+		ring, err := NewKeyRing(keys, time.Minute)
+		require.NoError(t, err)
+		manager := NewJWTManager("secret", time.Minute, WithSigningKeys(ring))
+
+		token, err := manager.Generate(user)
+		require.NoError(t, err)
+
+		claims, err := manager.Verify(token)
+		require.NoError(t, err, algorithm)
+		require.Equal(t, "alice", claims.Username)
+
+		jwks := manager.JWKS()
+		require.Len(t, jwks.Keys, 1)
+		require.Equal(t, "k1", jwks.Keys[0].Kid)
+		require.Equal(t, algorithm, jwks.Keys[0].Alg)
+	}
+
+	// 配置了非对称密钥后不再接受 HS256 签名的 token
+	token, err := NewJWTManager("secret", time.Minute).Generate(user)
+	require.NoError(t, err)
+
+	keys, err := ParseSigningKeys("k1=" + paths["EdDSA"])
+	require.NoError(t, err)
+	ring, err := NewKeyRing(keys, time.Minute)
+	require.NoError(t, err)
+	_, err = NewJWTManager("secret", time.Minute, WithSigningKeys(ring)).Verify(token)
+	require.Error(t, err)
+
+	_, err = ParseSigningKeys("k1=" + paths["EdDSA"] + "@tomorrow")
+	require.Error(t, err)
+
+	smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	_, err = NewSigningKey("small", smallKey, time.Time{})
+	require.Error(t, err)
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	t.Parallel()
+
+	_, oldKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, newKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rotateAt := start.Add(24 * time.Hour)
+
+	k1, err := NewSigningKey("k1", oldKey, start)
+	require.NoError(t, err)
+	k2, err := NewSigningKey("k2", newKey, rotateAt)
+	require.NoError(t, err)
+
+	_, err = NewKeyRing([]*SigningKey{k1, k1}, time.Hour)
+	require.Error(t, err)
+
+	ring, err := NewKeyRing([]*SigningKey{k2, k1}, time.Hour)
+	require.NoError(t, err)
+
+	require.Nil(t, ring.SigningKey(start.Add(-time.Second)))
+
+	// 轮换前使用 k1 签名, k2 还不能验证, 但已经公开
+	now := start.Add(time.Hour)
+	require.Equal(t, "k1", ring.SigningKey(now).ID)
+	_, err = ring.VerificationKey("k2", now, 0)
+	require.Error(t, err)
+	require.Len(t, ring.JWKS(now, 0).Keys, 2)
+
+	// 轮换后使用 k2 签名, k1 在 retention 内仍然可以验证
+	now = rotateAt.Add(30 * time.Minute)
+	require.Equal(t, "k2", ring.SigningKey(now).ID)
+	_, err = ring.VerificationKey("k1", now, 0)
+	require.NoError(t, err)
+	_, err = ring.VerificationKey("k2", now, 0)
+	require.NoError(t, err)
+
+	// retention 之后 k1 退役
+	now = rotateAt.Add(2 * time.Hour)
+	_, err = ring.VerificationKey("k1", now, 0)
+	require.Error(t, err)
+	jwks := ring.JWKS(now, 0)
+	require.Len(t, jwks.Keys, 1)
+	require.Equal(t, "k2", jwks.Keys[0].Kid)
+	require.Equal(t, "OKP", jwks.Keys[0].Kty)
+
+	_, err = ring.VerificationKey("unknown", now, 0)
+	require.Error(t, err)
+
+	// 验证时允许时钟偏差, k1 签发的 token 在 exp 加上 leeway 之前仍然有效, 密钥也要保留这么久
+	now = rotateAt.Add(time.Hour + 30*time.Second)
+	_, err = ring.VerificationKey("k1", now, 0)
+	require.Error(t, err)
+	_, err = ring.VerificationKey("k1", now, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, ring.JWKS(now, time.Minute).Keys, 2)
+	_, err = ring.VerificationKey("k2", rotateAt.Add(-30*time.Second), time.Minute)
+	require.NoError(t, err)
+
+	// 轮换前最后签发的 token, 在 leeway 内都能通过 JWTManager 验证
+	manager := NewJWTManager("secret", time.Hour, WithSigningKeys(ring), WithTokenLeeway(time.Minute))
+	manager.now = func() time.Time { return rotateAt.Add(-time.Second) }
+	token, err := manager.Generate(&User{Username: "alice", Role: "user"})
+	require.NoError(t, err)
+	manager.now = func() time.Time { return rotateAt.Add(time.Hour + 30*time.Second) }
+	_, err = manager.Verify(token)
+	require.NoError(t, err)
+}
@@ -1,49 +1,149 @@
 package service
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
 )
 
 // JWTManager JWT 管理器
+//
+// 默认使用 secretKey 以 HS256 签名; 配置了非对称密钥后使用 KeyRing 签名, 其他服务只需要公钥就能验证
 type JWTManager struct {
 	secretKey     string
 	tokenDuration time.Duration
+	keys          *KeyRing
+	issuer        string        // 为空时不检查 iss
+	audience      string        // 为空时不检查 aud
+	leeway        time.Duration // 验证 exp, nbf, iat 时允许的时钟偏差
+	now           func() time.Time
+}
+
+// 验证 token 的 registered claims 失败时返回的错误
+var (
+	ErrTokenExpired       = errors.New("token is expired")
+	ErrTokenNotYetValid   = errors.New("token is not valid yet")
+	ErrTokenWrongIssuer   = errors.New("token has wrong issuer")
+	ErrTokenWrongAudience = errors.New("token has wrong audience")
+)
+
+// JWTManagerOption 配置 JWTManager
+type JWTManagerOption func(*JWTManager)
+
+// WithSigningKeys 使用非对称密钥签名, token 头部带有 kid, 不再接受 HS256 签名的 token
+func WithSigningKeys(keys *KeyRing) JWTManagerOption {
+	return func(manager *JWTManager) {
+		manager.keys = keys
+	}
+}
+
+// WithTokenIssuer 签发的 token 带有 iss, 验证时 iss 必须一致
+func WithTokenIssuer(issuer string) JWTManagerOption {
+	return func(manager *JWTManager) {
+		manager.issuer = issuer
+	}
+}
+
+// WithTokenAudience 签发的 token 带有 aud, 验证时 aud 必须一致
+func WithTokenAudience(audience string) JWTManagerOption {
+	return func(manager *JWTManager) {
+		manager.audience = audience
+	}
+}
+
+// WithTokenLeeway 验证有效期时容忍服务之间的时钟偏差
+func WithTokenLeeway(leeway time.Duration) JWTManagerOption {
+	return func(manager *JWTManager) {
+		manager.leeway = leeway
+	}
 }
 
 type UserClaims struct {
 	jwt.StandardClaims
 	Username string `json:"username"`
 	Role     string `json:"role"`
+	OrgID    string `json:"org_id,omitempty"`
+	OrgRole  string `json:"org_role,omitempty"`
+
+	// 使用 API key 访问时为 key 的 ID 和权限范围, 不在 token 中
+	APIKeyID string   `json:"-"`
+	Scopes   []string `json:"-"`
 }
 
 // NewJWTManager 创建 JWTManager 实例
-func NewJWTManager(secretKey string, tokenDuration time.Duration) *JWTManager {
-	return &JWTManager{secretKey, tokenDuration}
+func NewJWTManager(secretKey string, tokenDuration time.Duration, options ...JWTManagerOption) *JWTManager {
+	manager := &JWTManager{
+		secretKey:     secretKey,
+		tokenDuration: tokenDuration,
+		now:           time.Now,
+	}
+	for _, option := range options {
+		option(manager)
+	}
+	return manager
 }
 
-// Generate 生成 token
+// TokenDuration 返回 access token 的有效期
+func (manager *JWTManager) TokenDuration() time.Duration {
+	return manager.tokenDuration
+}
+
+// Generate 生成 token, 每个 token 有唯一的 jti 用于吊销
 func (manager *JWTManager) Generate(user *User) (string, error) {
+	now := manager.now()
 	claims := UserClaims{
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(manager.tokenDuration).Unix(),
+			Id:        uuid.New().String(),
+			Issuer:    manager.issuer,
+			Audience:  manager.audience,
+			Subject:   user.Username,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(manager.tokenDuration).Unix(),
 		},
 		Username: user.Username,
 		Role:     user.Role,
+		OrgID:    user.OrgID,
+		OrgRole:  user.OrgRole,
+	}
+
+	if manager.keys == nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString([]byte(manager.secretKey))
+	}
+
+	key := manager.keys.SigningKey(now)
+	if key == nil {
+		return "", fmt.Errorf("no active signing key")
 	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.PrivateKey)
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(manager.secretKey))
+// JWKS 返回验证 token 使用的公钥, 使用 HS256 时为空
+func (manager *JWTManager) JWKS() JSONWebKeySet {
+	if manager.keys == nil {
+		return JSONWebKeySet{Keys: []JSONWebKey{}}
+	}
+	return manager.keys.JWKS(manager.now(), manager.leeway)
 }
 
-// Verify 验证 token
+// Verify 验证 token 的签名和 registered claims
 func (manager *JWTManager) Verify(accessToken string) (*UserClaims, error) {
-	token, err := jwt.ParseWithClaims(
+	// jwt-go 验证有效期时不支持时钟偏差, 由 validateClaims 验证
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.ParseWithClaims(
 		accessToken,
 		&UserClaims{},
 		func(t *jwt.Token) (interface{}, error) {
+			if manager.keys != nil {
+				return manager.verificationKey(t)
+			}
+
 			_, ok := t.Method.(*jwt.SigningMethodHMAC)
 			if !ok {
 				return nil, fmt.Errorf("unexpected token sign method")
@@ -61,7 +161,54 @@ func (manager *JWTManager) Verify(accessToken string) (*UserClaims, error) {
 		return nil, fmt.Errorf("invalid token claims")
 	}
 
+	err = manager.validateClaims(claims)
+	if err != nil {
+		return nil, err
+	}
 	return claims, nil
 }
 
+// validateClaims 验证有效期, 签发者和受众
+func (manager *JWTManager) validateClaims(claims *UserClaims) error {
+	now := manager.now()
+	if claims.ExpiresAt == 0 {
+		return fmt.Errorf("invalid token: missing expiration time")
+	}
+	if expiresAt := time.Unix(claims.ExpiresAt, 0); now.After(expiresAt.Add(manager.leeway)) {
+		return fmt.Errorf("%w: expired at %s", ErrTokenExpired, expiresAt.UTC().Format(time.RFC3339))
+	}
+	if notBefore := time.Unix(claims.NotBefore, 0); now.Add(manager.leeway).Before(notBefore) {
+		return fmt.Errorf("%w: not before %s", ErrTokenNotYetValid, notBefore.UTC().Format(time.RFC3339))
+	}
+	if issuedAt := time.Unix(claims.IssuedAt, 0); now.Add(manager.leeway).Before(issuedAt) {
+		return fmt.Errorf("%w: issued at %s", ErrTokenNotYetValid, issuedAt.UTC().Format(time.RFC3339))
+	}
 
+	if len(manager.issuer) > 0 && claims.Issuer != manager.issuer {
+		return fmt.Errorf("%w: %q", ErrTokenWrongIssuer, claims.Issuer)
+	}
+	if len(manager.audience) > 0 && claims.Audience != manager.audience {
+		return fmt.Errorf("%w: %q", ErrTokenWrongAudience, claims.Audience)
+	}
+	if claims.Subject != claims.Username {
+		return fmt.Errorf("invalid token: subject %q does not match username %q", claims.Subject, claims.Username)
+	}
+	return nil
+}
+
+// verificationKey 按 kid 查找公钥, 算法必须与密钥一致, 防止用公钥当作 HMAC 密钥伪造 token
+func (manager *JWTManager) verificationKey(t *jwt.Token) (interface{}, error) {
+	kid, ok := t.Header["kid"].(string)
+	if !ok {
+		return nil, fmt.Errorf("missing token key id")
+	}
+
+	key, err := manager.keys.VerificationKey(kid, manager.now(), manager.leeway)
+	if err != nil {
+		return nil, err
+	}
+	if t.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected token sign method %s", t.Method.Alg())
+	}
+	return key.PublicKey, nil
+}
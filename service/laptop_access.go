@@ -0,0 +1,41 @@
+package service
+
+import (
+	"context"
+	"go-pcbook-micro/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// canManageLaptop 资源级别的鉴权, AuthInterceptor 只知道 rpc 名称, 由 handler 找到 laptop 后检查
+//
+//   - laptop 的所有者可以修改 laptop, 上传和删除图片
+//   - admin 和组织管理员可以管理同一组织的 laptop, 不属于任何组织的 admin 管理不属于任何组织的 laptop
+//   - 超级管理员可以管理所有 laptop
+func canManageLaptop(claims *UserClaims, laptop *pb.Laptop) bool {
+	if len(laptop.GetOwner()) > 0 && laptop.GetOwner() == claims.Username {
+		return true
+	}
+	return managesOrg(claims, laptop.GetOrgId())
+}
+
+// managesOrg 用户是组织的管理员, admin 是所在组织的管理员, 超级管理员管理所有组织
+func managesOrg(claims *UserClaims, orgID string) bool {
+	if claims.Role == RoleSuperAdmin {
+		return true
+	}
+	isOrgAdmin := claims.Role == "admin" || claims.OrgRole == OrgRoleAdmin
+	return isOrgAdmin && orgID == claims.OrgID
+}
+
+// authorizeLaptop 当前用户不能管理 laptop 时返回 PermissionDenied
+//
+// 没有用户信息时 (没有配置拦截器) 不检查, 与其他 handler 一致
+func authorizeLaptop(ctx context.Context, laptop *pb.Laptop) error {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok || canManageLaptop(claims, laptop) {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "user %s cannot manage laptop %s", claims.Username, laptop.GetId())
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"go-pcbook-micro/pb"
+	"go-pcbook-micro/sample"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestLaptopServerOwnership(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := NewInMemoryLaptopStore()
+	imageStore := NewDiskImageStore(t.TempDir())
+	server := NewLaptopServer(laptopStore, imageStore, nil)
+
+	alice := contextWithClaims(context.Background(), &UserClaims{Username: "alice", Role: "user", OrgID: "acme"})
+	bob := contextWithClaims(context.Background(), &UserClaims{Username: "bob", Role: "user", OrgID: "acme"})
+	acmeAdmin := contextWithClaims(context.Background(), &UserClaims{Username: "admin1", Role: "admin", OrgID: "acme"})
+	otherAdmin := contextWithClaims(context.Background(), &UserClaims{Username: "admin2", Role: "admin", OrgID: "globex"})
+
+	// 所有者和组织使用登录用户, 不使用客户端发送的值
+	laptop := sample.NewLaptop()
+	laptop.Owner = "bob"
+	laptop.OrgId = "globex"
+	res, err := server.CreateLaptop(alice, &pb.CreateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+
+	found, err := laptopStore.Find(res.GetId())
+	require.NoError(t, err)
+	require.Equal(t, "alice", found.GetOwner())
+	require.Equal(t, "acme", found.GetOrgId())
+
+	updatePrice := func(ctx context.Context) error {
+		_, err := server.UpdateLaptopPrice(ctx, &pb.UpdateLaptopPriceRequest{LaptopId: res.GetId(), PriceUsd: 1000})
+		return err
+	}
+	require.NoError(t, updatePrice(alice))
+	require.NoError(t, updatePrice(acmeAdmin))
+	require.Equal(t, codes.PermissionDenied, status.Code(updatePrice(bob)))
+	// 其他组织的 laptop 视为不存在
+	require.Equal(t, codes.NotFound, status.Code(updatePrice(otherAdmin)))
+
+	deleteImage := func(ctx context.Context) error {
+		imageID, err := imageStore.Save(res.GetId(), ".jpg", bytes.Buffer{})
+		require.NoError(t, err)
+		_, err = server.DeleteImage(ctx, &pb.DeleteImageRequest{ImageId: imageID})
+		return err
+	}
+	require.NoError(t, deleteImage(alice))
+	require.NoError(t, deleteImage(acmeAdmin))
+	require.Equal(t, codes.PermissionDenied, status.Code(deleteImage(bob)))
+	require.Equal(t, codes.NotFound, status.Code(deleteImage(otherAdmin)))
+
+	_, err = server.DeleteImage(alice, &pb.DeleteImageRequest{ImageId: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestClientUploadImageOwnership(t *testing.T) {
+	t.Parallel()
+
+	policy, err := LoadRBACPolicy("../policy/rbac.yaml")
+	require.NoError(t, err)
+	jwtManager := NewJWTManager("secret", time.Minute)
+	interceptor := NewAuthInterceptor(jwtManager, nil, WithAccessPolicy(policy))
+
+	laptopStore := NewInMemoryLaptopStore()
+	server := NewLaptopServer(laptopStore, NewDiskImageStore(t.TempDir()), nil)
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(interceptor.Unary()),
+		grpc.StreamInterceptor(interceptor.Stream()),
+	)
+	pb.RegisterLaptopServiceServer(grpcServer, server)
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+	laptopClient := newTestLaptopClient(t, listener.Addr().String())
+
+	withUser := func(username string, role string) context.Context {
+		accessToken, err := jwtManager.Generate(&User{Username: username, Role: role, OrgID: "acme"})
+		require.NoError(t, err)
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", accessToken)
+	}
+	admin := withUser("admin1", "admin")
+	alice := withUser("alice", "user")
+
+	// 公开注册的 user 不能创建 laptop, 组织的 admin 替成员创建
+	_, err = laptopClient.CreateLaptop(alice, &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	createLaptop := func(owner string) string {
+		laptop := sample.NewLaptop()
+		laptop.Owner = owner
+		res, err := laptopClient.CreateLaptop(admin, &pb.CreateLaptopRequest{Laptop: laptop})
+		require.NoError(t, err)
+		return res.GetId()
+	}
+	aliceLaptopID := createLaptop("alice")
+	bobLaptopID := createLaptop("bob")
+
+	uploadImage := func(ctx context.Context, laptopID string) error {
+		stream, err := laptopClient.UploadImage(ctx)
+		require.NoError(t, err)
+		err = stream.Send(&pb.UploadImageRequest{
+			Data: &pb.UploadImageRequest_Info{
+				Info: &pb.ImageInfo{LaptopId: laptopID, ImageType: ".jpg"},
+			},
+		})
+		require.NoError(t, err)
+		err = stream.Send(&pb.UploadImageRequest{
+			Data: &pb.UploadImageRequest_ChunkData{ChunkData: []byte("image")},
+		})
+		if err != nil && err != io.EOF {
+			return err
+		}
+		_, err = stream.CloseAndRecv()
+		return err
+	}
+	require.NoError(t, uploadImage(alice, aliceLaptopID))
+	require.Equal(t, codes.PermissionDenied, status.Code(uploadImage(alice, bobLaptopID)))
+	require.NoError(t, uploadImage(admin, bobLaptopID))
+}
@@ -2,19 +2,25 @@ package service
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"go-pcbook-micro/pb"
 	"go-pcbook-micro/sample"
 	"go-pcbook-micro/serializer"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func TestClientCreateLaptop(t *testing.T) {
@@ -114,6 +120,224 @@ func TestClientSearchLaptop(t *testing.T) {
 	require.Equal(t, len(expectedIDs), found)
 }
 
+func TestClientSearchLaptopSortByRating(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := NewInMemoryLaptopStore()
+	ratingStore := NewInMemoryRatingStore()
+
+	// 一个 10 分的 laptop 排在一千个 9 分的 laptop 之后
+	scores := [][]float64{{10}, {}, make([]float64, 1000)}
+	for i := range scores[2] {
+		scores[2][i] = 9
+	}
+
+	laptopIDs := make([]string, len(scores))
+	for i := range scores {
+		laptop := sample.NewLaptop()
+		laptopIDs[i] = laptop.GetId()
+		require.NoError(t, laptopStore.Save(laptop))
+
+		for j, score := range scores[i] {
+			_, err := ratingStore.Add(laptop.GetId(), fmt.Sprintf("user%d", j), score)
+			require.NoError(t, err)
+		}
+	}
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	req := &pb.SearchLaptopRequest{
+		Filter: &pb.Filter{MaxPriceUsd: 1e9},
+		SortBy: pb.SearchLaptopRequest_SORT_BY_RATING,
+	}
+	stream, err := laptopClient.SearchLaptop(context.Background(), req)
+	require.NoError(t, err)
+
+	var found []string
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		found = append(found, res.GetLaptop().GetId())
+	}
+	require.Equal(t, []string{laptopIDs[2], laptopIDs[0], laptopIDs[1]}, found)
+
+	stats, err := laptopClient.GetRatingStats(context.Background(), &pb.GetRatingStatsRequest{LaptopId: laptopIDs[2]})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1000), stats.GetRatedCount())
+	require.Equal(t, 9.0, stats.GetMedianScore())
+	require.Len(t, stats.GetHistogram(), 10)
+	require.Equal(t, uint32(1000), stats.GetHistogram()[8].GetCount())
+}
+
+func TestClientTopLaptops(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := NewInMemoryLaptopStore()
+	ratingStore := NewInMemoryRatingStore()
+
+	now := time.Now()
+	ratingStore.now = func() time.Time { return now }
+
+	cheap := sample.NewLaptop()
+	cheap.PriceUsd = 1000
+	expensive := sample.NewLaptop()
+	expensive.PriceUsd = 3000
+	for _, laptop := range []*pb.Laptop{cheap, expensive} {
+		require.NoError(t, laptopStore.Save(laptop))
+	}
+
+	// 贵的 laptop 一个月前评分很低, 最近评分很高
+	ratingStore.now = func() time.Time { return now.Add(-30 * 24 * time.Hour) }
+	_, err := ratingStore.Add(expensive.GetId(), "user1", 1)
+	require.NoError(t, err)
+	ratingStore.now = func() time.Time { return now }
+	_, err = ratingStore.Add(expensive.GetId(), "user2", 10)
+	require.NoError(t, err)
+	_, err = ratingStore.Add(cheap.GetId(), "user1", 8)
+	require.NoError(t, err)
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	res, err := laptopClient.TopLaptops(context.Background(), &pb.TopLaptopsRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.GetLaptops(), 2)
+	require.Equal(t, cheap.GetId(), res.GetLaptops()[0].GetLaptop().GetId())
+
+	req := &pb.TopLaptopsRequest{Ranking: pb.TopLaptopsRequest_TRENDING}
+	res, err = laptopClient.TopLaptops(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, expensive.GetId(), res.GetLaptops()[0].GetLaptop().GetId())
+	require.Equal(t, uint32(1), res.GetLaptops()[0].GetRatedCount())
+
+	req.Filter = &pb.Filter{MaxPriceUsd: 2000}
+	res, err = laptopClient.TopLaptops(context.Background(), req)
+	require.NoError(t, err)
+	require.Len(t, res.GetLaptops(), 1)
+	require.Equal(t, cheap.GetId(), res.GetLaptops()[0].GetLaptop().GetId())
+}
+
+func TestClientCompareLaptops(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := NewInMemoryLaptopStore()
+	ratingStore := NewInMemoryRatingStore()
+
+	laptopIDs := make([]string, 3)
+	for i := range laptopIDs {
+		laptop := sample.NewLaptop()
+		laptop.PriceUsd = float64(1000 * (i + 1))
+		laptopIDs[i] = laptop.GetId()
+		require.NoError(t, laptopStore.Save(laptop))
+	}
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	res, err := laptopClient.CompareLaptops(context.Background(), &pb.CompareLaptopsRequest{LaptopIds: laptopIDs})
+	require.NoError(t, err)
+	require.Len(t, res.GetLaptops(), 3)
+
+	for _, attribute := range res.GetAttributes() {
+		require.Len(t, attribute.GetValues(), 3)
+		if attribute.GetName() == "price" {
+			require.Equal(t, []string{laptopIDs[0]}, attribute.GetBestLaptopIds())
+		}
+	}
+
+	_, err = laptopClient.CompareLaptops(context.Background(), &pb.CompareLaptopsRequest{LaptopIds: laptopIDs[:1]})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	req := &pb.CompareLaptopsRequest{LaptopIds: []string{laptopIDs[0], laptopIDs[0]}}
+	_, err = laptopClient.CompareLaptops(context.Background(), req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	req = &pb.CompareLaptopsRequest{LaptopIds: []string{laptopIDs[0], "unknown"}}
+	_, err = laptopClient.CompareLaptops(context.Background(), req)
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestClientSimilarLaptops(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := NewInMemoryLaptopStore()
+
+	laptops := make([]*pb.Laptop, 5)
+	for i := range laptops {
+		laptop := sample.NewLaptop()
+		laptop.PriceUsd = float64(1000 + 100*i)
+		laptops[i] = laptop
+		require.NoError(t, laptopStore.Save(laptop))
+	}
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil, WithSimilarityWeights(SimilarityWeights{Price: 1}))
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	req := &pb.SimilarLaptopsRequest{LaptopId: laptops[2].GetId(), K: 2}
+	res, err := laptopClient.SimilarLaptops(context.Background(), req)
+	require.NoError(t, err)
+	require.Len(t, res.GetLaptops(), 2)
+	for _, similar := range res.GetLaptops() {
+		require.Contains(t, []string{laptops[1].GetId(), laptops[3].GetId()}, similar.GetLaptop().GetId())
+		require.Equal(t, 0.25, similar.GetDistance())
+	}
+
+	// 过滤后只推荐便宜的
+	req.Filter = &pb.Filter{MaxPriceUsd: 1150}
+	res, err = laptopClient.SimilarLaptops(context.Background(), req)
+	require.NoError(t, err)
+	require.Len(t, res.GetLaptops(), 2)
+	require.Equal(t, laptops[1].GetId(), res.GetLaptops()[0].GetLaptop().GetId())
+	require.Equal(t, laptops[0].GetId(), res.GetLaptops()[1].GetLaptop().GetId())
+
+	req.Weights = &pb.SimilarityWeights{}
+	_, err = laptopClient.SimilarLaptops(context.Background(), req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = laptopClient.SimilarLaptops(context.Background(), &pb.SimilarLaptopsRequest{LaptopId: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestClientListRatingEvents(t *testing.T) {
+	t.Parallel()
+
+	ratingStore, err := NewFileRatingStore(filepath.Join(t.TempDir(), "ratings.log"))
+	require.NoError(t, err)
+	defer ratingStore.Close()
+
+	for _, score := range []float64{3, 5, 7} {
+		_, err = ratingStore.Add("laptop-1", "user1", score)
+		require.NoError(t, err)
+	}
+
+	serverAddress := startTestLaptopServer(t, NewInMemoryLaptopStore(), nil, ratingStore)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	req := &pb.ListRatingEventsRequest{LaptopId: "laptop-1", PageSize: 2}
+	res, err := laptopClient.ListRatingEvents(context.Background(), req)
+	require.NoError(t, err)
+	require.Len(t, res.GetEvents(), 2)
+	require.False(t, res.GetEvents()[0].GetHasPreviousScore())
+	require.Equal(t, 3.0, res.GetEvents()[1].GetPreviousScore())
+
+	req.PageToken = res.GetNextPageToken()
+	res, err = laptopClient.ListRatingEvents(context.Background(), req)
+	require.NoError(t, err)
+	require.Len(t, res.GetEvents(), 1)
+	require.Equal(t, uint64(3), res.GetEvents()[0].GetSequence())
+	require.Empty(t, res.GetNextPageToken())
+
+	// 内存中的评分存储没有事件历史
+	serverAddress = startTestLaptopServer(t, NewInMemoryLaptopStore(), nil, NewInMemoryRatingStore())
+	laptopClient = newTestLaptopClient(t, serverAddress)
+	_, err = laptopClient.RebuildRatingAggregates(context.Background(), &pb.RebuildRatingAggregatesRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
 func TestClientUploadImage(t *testing.T) {
 	t.Parallel()
 
@@ -174,12 +398,60 @@ func TestClientUploadImage(t *testing.T) {
 	require.NoError(t, err)
 	require.NotZero(t, res.GetId())
 	require.EqualValues(t, size, res.GetSize())
+	require.NotEmpty(t, res.GetChecksum())
 
-	savedImagePath := fmt.Sprintf("%s/%s%s", testImageFolder, res.GetId(), imageType)
+	savedImagePath := fmt.Sprintf("%s/%s%s", testImageFolder, res.GetChecksum(), imageType)
 	require.FileExists(t, savedImagePath)
 	// require.NoError(t, os.Remove(savedImagePath))
 }
 
+func TestClientDownloadImage(t *testing.T) {
+	t.Parallel()
+
+	testImageFolder := "../tmp"
+	imageStore := NewDiskImageStore(testImageFolder)
+
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/laptop.jpg", testImageFolder))
+	require.NoError(t, err)
+
+	laptopStore := NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop))
+
+	imageID, err := imageStore.Save(laptop.GetId(), ".jpg", *bytes.NewBuffer(data))
+	require.NoError(t, err)
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	req := &pb.DownloadImageRequest{ImageId: imageID}
+	stream, err := laptopClient.DownloadImage(context.Background(), req)
+	require.NoError(t, err)
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, laptop.GetId(), res.GetInfo().GetLaptopId())
+	require.Equal(t, ".jpg", res.GetInfo().GetImageType())
+
+	downloaded := bytes.Buffer{}
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		downloaded.Write(res.GetChunkData())
+	}
+	require.Equal(t, data, downloaded.Bytes())
+
+	// 缩放版本不存在
+	req = &pb.DownloadImageRequest{ImageId: imageID, Variant: "small"}
+	stream, err = laptopClient.DownloadImage(context.Background(), req)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
 func TestClientRateLapyop(t *testing.T) {
 	t.Parallel()
 
@@ -190,55 +462,311 @@ func TestClientRateLapyop(t *testing.T) {
 	err := laptopStore.Save(laptop)
 	require.NoError(t, err)
 
-	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
+	jwtManager := NewJWTManager("secret", time.Minute)
+	serverAddress := startTestAuthLaptopServer(t, jwtManager, laptopStore, nil, ratingStore)
 	laptopClient := newTestLaptopClient(t, serverAddress)
 
+	// 没有登录不能评分
 	stream, err := laptopClient.RateLaptop(context.Background())
 	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// 同一个用户重复评分时替换之前的分数
+	users := []string{"user1", "user1", "user2"}
+	scores := []float64{8, 7, 10}
+	count := []uint32{1, 1, 2}
+	average := []float64{8, 7, 8.5}
+
+	for i := range scores {
+		ctx := newTestAuthContext(t, jwtManager, users[i], "user")
+		stream, err := laptopClient.RateLaptop(ctx)
+		require.NoError(t, err)
 
-	scores := []float64{8, 7.5, 10}
-	average := []float64{8, 7.75, 8.5}
-
-	n := len(scores)
-	for i := 0; i < n; i++ {
 		req := &pb.RateLaptopRequest{
 			LaptopId: laptop.GetId(),
 			Score:    scores[i],
 		}
 		err = stream.Send(req)
 		require.NoError(t, err)
+		err = stream.CloseSend()
+		require.NoError(t, err)
+
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, laptop.GetId(), res.GetLaptopId())
+		require.Equal(t, count[i], res.GetRatedCount())
+		require.Equal(t, average[i], res.GetAverageScore())
+
+		_, err = stream.Recv()
+		require.Equal(t, io.EOF, err)
 	}
 
+	ctx := newTestAuthContext(t, jwtManager, "user1", "user")
+	myRating, err := laptopClient.GetMyRating(ctx, &pb.GetMyRatingRequest{LaptopId: laptop.GetId()})
+	require.NoError(t, err)
+	require.Equal(t, 7.0, myRating.GetScore())
+
+	// 撤回评分后重新计算平均分
+	removed, err := laptopClient.RemoveRating(ctx, &pb.RemoveRatingRequest{LaptopId: laptop.GetId()})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), removed.GetRatedCount())
+	require.Equal(t, 10.0, removed.GetAverageScore())
+
+	_, err = laptopClient.GetMyRating(ctx, &pb.GetMyRatingRequest{LaptopId: laptop.GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = laptopClient.RemoveRating(ctx, &pb.RemoveRatingRequest{LaptopId: laptop.GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// 无效的分数只拒绝这一次评分, 流不会中断
+	stream, err = laptopClient.RateLaptop(newTestAuthContext(t, jwtManager, "user3", "user"))
+	require.NoError(t, err)
+	for _, score := range []float64{11, 4} {
+		err = stream.Send(&pb.RateLaptopRequest{LaptopId: laptop.GetId(), Score: score})
+		require.NoError(t, err)
+	}
+	err = stream.CloseSend()
+	require.NoError(t, err)
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, codes.InvalidArgument, status.FromProto(res.GetError()).Code())
+
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Nil(t, res.GetError())
+	require.Equal(t, uint32(2), res.GetRatedCount())
+	require.Equal(t, 7.0, res.GetAverageScore())
+
+	policy, err := laptopClient.GetRatingPolicy(context.Background(), &pb.GetRatingPolicyRequest{})
+	require.NoError(t, err)
+	require.Equal(t, DefaultRatingPolicy.MaxScore, policy.GetMaxScore())
+}
+
+func startTestLaptopServer(t *testing.T, laptopStore LaptopStore, imageStore ImageStore, ratingStore RatingStore, options ...LaptopServerOption) string {
+	laotopService := NewLaptopServer(laptopStore, imageStore, ratingStore, options...)
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterLaptopServiceServer(grpcServer, laotopService)
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+
+	return listener.Addr().String()
+}
+
+// startTestAuthLaptopServer 启动带鉴权拦截器的测试服务器, 评分相关的 rpc 需要登录
+func TestClientRateLaptopGuard(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := NewInMemoryLaptopStore()
+	ratingStore := NewInMemoryRatingStore()
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	guard := NewRatingGuard(RatingGuardConfig{
+		MaxRatingsPerUser: 2,
+		RateWindow:        time.Minute,
+		BurstThreshold:    2,
+		BurstWindow:       time.Minute,
+	}, DefaultRatingPolicy)
+
+	jwtManager := NewJWTManager("secret", time.Minute)
+	serverAddress := startTestAuthLaptopServer(t, jwtManager, laptopStore, nil, ratingStore, WithRatingGuard(guard))
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	// 不存在的 laptop 不占用评分次数
+	stream, err := laptopClient.RateLaptop(newTestAuthContext(t, jwtManager, "user1", "user"))
+	require.NoError(t, err)
+	err = stream.Send(&pb.RateLaptopRequest{LaptopId: "unknown", Score: 5})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// 超过频率限制的评分被拒绝, 流不会中断
+	stream, err = laptopClient.RateLaptop(newTestAuthContext(t, jwtManager, "user1", "user"))
+	require.NoError(t, err)
+	for _, score := range []float64{5, 6, 7} {
+		err = stream.Send(&pb.RateLaptopRequest{LaptopId: laptop.GetId(), Score: score})
+		require.NoError(t, err)
+	}
 	err = stream.CloseSend()
 	require.NoError(t, err)
 
-	for idx := 0; ; idx++ {
+	for i := 0; i < 2; i++ {
 		res, err := stream.Recv()
-		if err == io.EOF {
-			require.Equal(t, n, idx)
-			return
-		}
 		require.NoError(t, err)
-		require.Equal(t, laptop.GetId(), res.GetLaptopId())
-		require.Equal(t, uint32(idx+1), res.GetRatedCount())
-		require.Equal(t, average[idx], res.GetAverageScore())
+		require.Nil(t, res.GetError())
+	}
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, int32(codes.ResourceExhausted), res.GetError().GetCode())
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	// 两个用户短时间内给出极端分数时被标记
+	for _, username := range []string{"user2", "user3"} {
+		stream, err := laptopClient.RateLaptop(newTestAuthContext(t, jwtManager, username, "user"))
+		require.NoError(t, err)
+		err = stream.Send(&pb.RateLaptopRequest{LaptopId: laptop.GetId(), Score: 1})
+		require.NoError(t, err)
+		err = stream.CloseSend()
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		require.NoError(t, err)
 	}
+
+	_, err = laptopClient.ListRatingFlags(newTestAuthContext(t, jwtManager, "user1", "user"), &pb.ListRatingFlagsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	ctx := newTestAuthContext(t, jwtManager, "admin1", "admin")
+	flags, err := laptopClient.ListRatingFlags(ctx, &pb.ListRatingFlagsRequest{})
+	require.NoError(t, err)
+	require.Len(t, flags.GetFlags(), 2)
+
+	// 排除的评分不计入汇总
+	resolved, err := laptopClient.ResolveRatingFlag(ctx, &pb.ResolveRatingFlagRequest{
+		FlagId: flags.GetFlags()[0].GetId(),
+		Action: pb.ResolveRatingFlagRequest_EXCLUDE,
+	})
+	require.NoError(t, err)
+	require.Equal(t, pb.RatingFlag_EXCLUDED, resolved.GetFlag().GetStatus())
+	require.Equal(t, uint32(2), resolved.GetRatedCount())
+
+	myRating, err := laptopClient.GetMyRating(
+		newTestAuthContext(t, jwtManager, resolved.GetFlag().GetUsername(), "user"),
+		&pb.GetMyRatingRequest{LaptopId: laptop.GetId()},
+	)
+	require.NoError(t, err)
+	require.True(t, myRating.GetExcluded())
+
+	resolved, err = laptopClient.ResolveRatingFlag(ctx, &pb.ResolveRatingFlagRequest{
+		FlagId: flags.GetFlags()[1].GetId(),
+		Action: pb.ResolveRatingFlagRequest_DISMISS,
+	})
+	require.NoError(t, err)
+	require.Equal(t, pb.RatingFlag_DISMISSED, resolved.GetFlag().GetStatus())
+	require.Equal(t, uint32(2), resolved.GetRatedCount())
+
+	flags, err = laptopClient.ListRatingFlags(ctx, &pb.ListRatingFlagsRequest{})
+	require.NoError(t, err)
+	require.Empty(t, flags.GetFlags())
+
+	_, err = laptopClient.ResolveRatingFlag(ctx, &pb.ResolveRatingFlagRequest{
+		FlagId: "unknown",
+		Action: pb.ResolveRatingFlagRequest_EXCLUDE,
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
 }
 
-func startTestLaptopServer(t *testing.T, laptopStore LaptopStore, imageStore ImageStore, ratingStore RatingStore) string {
-	laotopService := NewLaptopServer(laptopStore, imageStore, ratingStore)
+func TestClientPriceAlerts(t *testing.T) {
+	t.Parallel()
 
-	grpcServer := grpc.NewServer()
+	laptopStore := NewInMemoryLaptopStore()
+
+	jwtManager := NewJWTManager("secret", time.Minute)
+	serverAddress := startTestAuthLaptopServer(t, jwtManager, laptopStore, nil, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	adminCtx := newTestAuthContext(t, jwtManager, "admin1", "admin")
+	userCtx := newTestAuthContext(t, jwtManager, "user1", "user")
+
+	laptop := sample.NewLaptop()
+	laptop.PriceUsd = 2000
+	_, err := laptopClient.CreateLaptop(adminCtx, &pb.CreateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+
+	alert, err := laptopClient.SetPriceAlert(userCtx, &pb.SetPriceAlertRequest{LaptopId: laptop.GetId(), TargetPriceUsd: 1500})
+	require.NoError(t, err)
+	require.Equal(t, 2000.0, alert.GetCurrentPriceUsd())
+	require.Equal(t, 1500.0, alert.GetAlert().GetTargetPriceUsd())
+
+	watchCtx, cancel := context.WithCancel(userCtx)
+	defer cancel()
+	stream, err := laptopClient.WatchAlerts(watchCtx, &pb.WatchAlertsRequest{})
+	require.NoError(t, err)
+
+	// 普通用户不能修改价格
+	req := &pb.UpdateLaptopPriceRequest{LaptopId: laptop.GetId(), PriceUsd: 1000}
+	_, err = laptopClient.UpdateLaptopPrice(userCtx, req)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	for _, price := range []float64{1800, 1400} {
+		req := &pb.UpdateLaptopPriceRequest{LaptopId: laptop.GetId(), PriceUsd: price}
+		res, err := laptopClient.UpdateLaptopPrice(adminCtx, req)
+		require.NoError(t, err)
+		require.Equal(t, "admin1", res.GetChange().GetActor())
+	}
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, laptop.GetId(), res.GetNotification().GetLaptopId())
+	require.Equal(t, 1800.0, res.GetNotification().GetOldPriceUsd())
+	require.Equal(t, 1400.0, res.GetNotification().GetNewPriceUsd())
+
+	history, err := laptopClient.GetPriceHistory(context.Background(), &pb.GetPriceHistoryRequest{LaptopId: laptop.GetId()})
+	require.NoError(t, err)
+	require.Len(t, history.GetChanges(), 3)
+	require.False(t, history.GetChanges()[0].GetHasOldPrice())
+	require.Equal(t, 2000.0, history.GetChanges()[1].GetOldPriceUsd())
+	require.Equal(t, 1400.0, history.GetChanges()[2].GetNewPriceUsd())
+
+	found, err := laptopStore.Find(laptop.GetId())
+	require.NoError(t, err)
+	require.Equal(t, 1400.0, found.GetPriceUsd())
+
+	req = &pb.UpdateLaptopPriceRequest{LaptopId: laptop.GetId(), PriceUsd: -1}
+	_, err = laptopClient.UpdateLaptopPrice(adminCtx, req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	req = &pb.UpdateLaptopPriceRequest{LaptopId: "unknown", PriceUsd: 1000}
+	_, err = laptopClient.UpdateLaptopPrice(adminCtx, req)
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func startTestAuthLaptopServer(t *testing.T, jwtManager *JWTManager, laptopStore LaptopStore, imageStore ImageStore, ratingStore RatingStore, options ...LaptopServerOption) string {
+	const laptopServicePath = "/pcbook.LaptopService/"
+	accessibleRoles := map[string][]string{
+		laptopServicePath + "RateLaptop":   {"admin", "user"},
+		laptopServicePath + "RemoveRating": {"admin", "user"},
+		laptopServicePath + "GetMyRating":  {"admin", "user"},
+
+		laptopServicePath + "ListRatingFlags":   {"admin"},
+		laptopServicePath + "ResolveRatingFlag": {"admin"},
+		laptopServicePath + "UpdateLaptopPrice": {"admin"},
+		laptopServicePath + "SetPriceAlert":     {"admin", "user"},
+		laptopServicePath + "WatchAlerts":       {"admin", "user"},
+	}
+	interceptor := NewAuthInterceptor(jwtManager, accessibleRoles)
+
+	laotopService := NewLaptopServer(laptopStore, imageStore, ratingStore, options...)
+
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(interceptor.Unary()),
+		grpc.StreamInterceptor(interceptor.Stream()),
+	)
 	pb.RegisterLaptopServiceServer(grpcServer, laotopService)
 
 	listener, err := net.Listen("tcp", ":0")
 	require.NoError(t, err)
 
 	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
 
 	return listener.Addr().String()
 }
 
+// newTestAuthContext 返回携带用户 access token 的上下文
+func newTestAuthContext(t *testing.T, jwtManager *JWTManager, username string, role string) context.Context {
+	accessToken, err := jwtManager.Generate(&User{Username: username, Role: role})
+	require.NoError(t, err)
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", accessToken)
+}
+
 func newTestLaptopClient(t *testing.T, address string) pb.LaptopServiceClient {
 	conn, err := grpc.Dial(address, grpc.WithInsecure())
 	require.NoError(t, err)
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"go-pcbook-micro/pb"
+	"math"
+)
+
+const (
+	minCompareLaptops = 2
+	maxCompareLaptops = 5
+
+	bitsPerGigabyte = 1 << 33
+	kgPerLb         = 0.45359237
+)
+
+// AttributeComparison 一项属性在各台 laptop 上的值, 值为 0 表示未知, 不参与比较
+type AttributeComparison struct {
+	Name           string
+	Unit           string
+	HigherIsBetter bool
+	Values         []float64 // 与 laptop 的顺序一致
+	Best           []int     // 最好的 laptop 的下标, 并列时有多个
+}
+
+// CompareLaptops 把每台 laptop 的规格换算为统一单位后逐项比较, ratings 与 laptops 一一对应
+func CompareLaptops(laptops []*pb.Laptop, ratings []*Rating) []*AttributeComparison {
+	attributes := []*AttributeComparison{
+		{Name: "ram", Unit: "GB", HigherIsBetter: true},
+		{Name: "storage", Unit: "GB", HigherIsBetter: true},
+		{Name: "weight", Unit: "kg"},
+		{Name: "cpu_cores", HigherIsBetter: true},
+		{Name: "cpu_min_ghz", Unit: "GHz", HigherIsBetter: true},
+		{Name: "cpu_max_ghz", Unit: "GHz", HigherIsBetter: true},
+		{Name: "gpu_min_ghz", Unit: "GHz", HigherIsBetter: true},
+		{Name: "gpu_max_ghz", Unit: "GHz", HigherIsBetter: true},
+		{Name: "pixel_density", Unit: "ppi", HigherIsBetter: true},
+		{Name: "price", Unit: "USD"},
+		{Name: "price_per_gb_ram", Unit: "USD/GB"},
+		{Name: "average_rating", HigherIsBetter: true},
+	}
+
+	for i, laptop := range laptops {
+		ram := toGigabytes(laptop.GetRam())
+		gpuMinGhz, gpuMaxGhz := fastestGPU(laptop.GetGpus())
+
+		pricePerGB := 0.0
+		if ram > 0 {
+			pricePerGB = laptop.GetPriceUsd() / ram
+		}
+
+		values := []float64{
+			ram,
+			storageGigabytes(laptop.GetStorages()),
+			weightKg(laptop),
+			float64(laptop.GetCpu().GetNumberCores()),
+			laptop.GetCpu().GetMinGhz(),
+			laptop.GetCpu().GetMaxGhz(),
+			gpuMinGhz,
+			gpuMaxGhz,
+			pixelDensity(laptop.GetScreen()),
+			laptop.GetPriceUsd(),
+			pricePerGB,
+			ratings[i].Average(),
+		}
+		for j, value := range values {
+			attributes[j].Values = append(attributes[j].Values, value)
+		}
+	}
+
+	for _, attribute := range attributes {
+		attribute.Best = bestValues(attribute.Values, attribute.HigherIsBetter)
+	}
+	return attributes
+}
+
+// bestValues 返回最好的值的下标, 所有值都未知时返回 nil
+func bestValues(values []float64, higherIsBetter bool) []int {
+	var best []int
+	for i, value := range values {
+		if value <= 0 {
+			continue
+		}
+		if len(best) == 0 {
+			best = []int{i}
+			continue
+		}
+
+		current := values[best[0]]
+		switch {
+		case value == current:
+			best = append(best, i)
+		case (value > current) == higherIsBetter:
+			best = []int{i}
+		}
+	}
+	return best
+}
+
+// toGigabytes 使用与 toBit 相同的单位换算
+func toGigabytes(memory *pb.Memory) float64 {
+	return float64(toBit(memory)) / bitsPerGigabyte
+}
+
+func storageGigabytes(storages []*pb.Storage) float64 {
+	total := 0.0
+	for _, storage := range storages {
+		total += toGigabytes(storage.GetMemory())
+	}
+	return total
+}
+
+// weightKg 不论重量使用哪个单位都换算为千克, 没有重量时返回 0
+func weightKg(laptop *pb.Laptop) float64 {
+	switch weight := laptop.GetWeight().(type) {
+	case *pb.Laptop_WeightKg:
+		return weight.WeightKg
+	case *pb.Laptop_WeightLb:
+		return weight.WeightLb * kgPerLb
+	default:
+		return 0
+	}
+}
+
+// fastestGPU 返回最大频率最高的 GPU 的频率
+func fastestGPU(gpus []*pb.GPU) (float64, float64) {
+	var fastest *pb.GPU
+	for _, gpu := range gpus {
+		if fastest == nil || gpu.GetMaxGhz() > fastest.GetMaxGhz() {
+			fastest = gpu
+		}
+	}
+	return fastest.GetMinGhz(), fastest.GetMaxGhz()
+}
+
+// pixelDensity 每英寸的像素数, 对角线像素数除以屏幕尺寸
+func pixelDensity(screen *pb.Screen) float64 {
+	if screen.GetSizeInch() <= 0 {
+		return 0
+	}
+
+	width := float64(screen.GetResolution().GetWidth())
+	height := float64(screen.GetResolution().GetHeight())
+	return math.Hypot(width, height) / float64(screen.GetSizeInch())
+}
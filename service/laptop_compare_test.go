@@ -0,0 +1,59 @@
+package service
+
+import (
+	"go-pcbook-micro/pb"
+	"go-pcbook-micro/sample"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareLaptops(t *testing.T) {
+	t.Parallel()
+
+	light := sample.NewLaptop()
+	light.Ram = &pb.Memory{Value: 16, Uint: pb.Memory_GIGABYTE}
+	light.Storages = []*pb.Storage{
+		{Memory: &pb.Memory{Value: 512, Uint: pb.Memory_GIGABYTE}},
+		{Memory: &pb.Memory{Value: 1, Uint: pb.Memory_TERABYTE}},
+	}
+	light.Weight = &pb.Laptop_WeightLb{WeightLb: 2}
+	light.Screen = &pb.Screen{SizeInch: 13, Resolution: &pb.Screen_Resolution{Width: 2560, Height: 1600}}
+	light.PriceUsd = 1600
+
+	heavy := sample.NewLaptop()
+	heavy.Ram = &pb.Memory{Value: 32768, Uint: pb.Memory_MEGABYTE}
+	heavy.Storages = []*pb.Storage{{Memory: &pb.Memory{Value: 1536, Uint: pb.Memory_GIGABYTE}}}
+	heavy.Weight = &pb.Laptop_WeightKg{WeightKg: 2}
+	heavy.Screen = &pb.Screen{}
+	heavy.PriceUsd = 1600
+
+	ratings := []*Rating{{Count: 2, Sum: 16}, {}}
+	attributes := CompareLaptops([]*pb.Laptop{light, heavy}, ratings)
+
+	byName := make(map[string]*AttributeComparison)
+	for _, attribute := range attributes {
+		byName[attribute.Name] = attribute
+	}
+
+	require.Equal(t, []float64{16, 32}, byName["ram"].Values)
+	require.Equal(t, []int{1}, byName["ram"].Best)
+
+	// 并列时都是最好的
+	require.Equal(t, []float64{1536, 1536}, byName["storage"].Values)
+	require.Equal(t, []int{0, 1}, byName["storage"].Best)
+
+	require.InDelta(t, 0.907, byName["weight"].Values[0], 0.001)
+	require.Equal(t, []int{0}, byName["weight"].Best)
+
+	// 未知的值不参与比较
+	require.InDelta(t, 232.2, byName["pixel_density"].Values[0], 0.1)
+	require.Equal(t, 0.0, byName["pixel_density"].Values[1])
+	require.Equal(t, []int{0}, byName["pixel_density"].Best)
+
+	require.Equal(t, []float64{100, 50}, byName["price_per_gb_ram"].Values)
+	require.Equal(t, []int{1}, byName["price_per_gb_ram"].Best)
+
+	require.Equal(t, []float64{8, 0}, byName["average_rating"].Values)
+	require.Equal(t, []int{0}, byName["average_rating"].Best)
+}
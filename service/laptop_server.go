@@ -7,25 +7,139 @@ import (
 	"go-pcbook-micro/pb"
 	"io"
 	"log"
+	"math"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/google/uuid"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // 允许上传图片的大小
 const maxImageSize = 1 << 20 // 2M
 
+// 下载图片时每个分块的大小
+const imageChunkSize = 1024
+
+// 预签名下载地址的有效期
+const imageURLExpiry = 15 * time.Minute
+
+// 排行榜默认和最多返回的数量
+const (
+	defaultTopLaptopsLimit = 10
+	maxTopLaptopsLimit     = 100
+)
+
+// 趋势榜默认统计的天数
+const defaultTrendingWindowDays = 7
+
+// 相似推荐默认和最多返回的数量
+const (
+	defaultSimilarLaptopsLimit = 5
+	maxSimilarLaptopsLimit     = 50
+)
+
+// 用户没有监听时最多暂存的降价通知数量
+const maxPendingPriceNotifications = 100
+
 // LaptopServer 提供 laptop services
 type LaptopServer struct {
-	laptopStore LaptopStore
-	imageStore  ImageStore
-	ratingStore RatingStore
+	laptopStore  LaptopStore
+	imageStore   ImageStore
+	ratingStore  RatingStore
+	imageQuota   *ImageQuota
+	ratingPolicy RatingPolicy
+	ratingPrior  *BayesianPrior
+	ratingGuard  *RatingGuard
+
+	similarityWeights SimilarityWeights
+	priceHistory      PriceHistoryStore
+	priceAlerts       *PriceAlertHub
+}
+
+// LaptopServerOption LaptopServer 的可选配置
+type LaptopServerOption func(server *LaptopServer)
+
+// WithImageQuota 上传图片时检查配额, 默认不限制
+func WithImageQuota(imageQuota *ImageQuota) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.imageQuota = imageQuota
+	}
+}
+
+// WithRatingPolicy 评分时检查分数, 默认为 DefaultRatingPolicy
+func WithRatingPolicy(ratingPolicy RatingPolicy) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.ratingPolicy = ratingPolicy
+	}
+}
+
+// WithBayesianPrior 计算贝叶斯平均的先验, 默认为 DefaultBayesianPrior
+func WithBayesianPrior(prior BayesianPrior) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.ratingPrior = &prior
+	}
+}
+
+// WithRatingGuard 评分时限制频率并检测刷分, 默认不限制
+func WithRatingGuard(ratingGuard *RatingGuard) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.ratingGuard = ratingGuard
+	}
+}
+
+// WithSimilarityWeights 相似推荐的默认权重, 默认为 DefaultSimilarityWeights
+func WithSimilarityWeights(weights SimilarityWeights) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.similarityWeights = weights
+	}
+}
+
+// WithPriceHistoryStore 保存价格变更的存储, 默认保存在内存中
+func WithPriceHistoryStore(priceHistory PriceHistoryStore) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.priceHistory = priceHistory
+	}
+}
+
+// WithPriceAlertHub 降价提醒, 默认保存在内存中
+func WithPriceAlertHub(priceAlerts *PriceAlertHub) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.priceAlerts = priceAlerts
+	}
 }
 
 // NewLaptopServer 创建 LaptopServer 实例
-func NewLaptopServer(laptopStore LaptopStore, imageStore ImageStore, ratingStore RatingStore) *LaptopServer {
-	return &LaptopServer{laptopStore, imageStore, ratingStore}
+func NewLaptopServer(laptopStore LaptopStore, imageStore ImageStore, ratingStore RatingStore, options ...LaptopServerOption) *LaptopServer {
+	server := &LaptopServer{
+		laptopStore:  laptopStore,
+		imageStore:   imageStore,
+		ratingStore:  ratingStore,
+		imageQuota:   NewImageQuota(QuotaConfig{}),
+		ratingPolicy: DefaultRatingPolicy,
+
+		similarityWeights: DefaultSimilarityWeights,
+		priceHistory:      NewInMemoryPriceHistoryStore(),
+		priceAlerts:       NewPriceAlertHub(maxPendingPriceNotifications),
+	}
+
+	for _, option := range options {
+		option(server)
+	}
+
+	if server.ratingPrior == nil {
+		prior := DefaultBayesianPrior(server.ratingPolicy)
+		server.ratingPrior = &prior
+	}
+	if server.ratingGuard == nil {
+		server.ratingGuard = NewRatingGuard(RatingGuardConfig{}, server.ratingPolicy)
+	}
+
+	return server
 }
 
 // CreateLaptop 创建 laptop 的 rpc
@@ -47,17 +161,31 @@ func (server *LaptopServer) CreateLaptop(ctx context.Context, req *pb.CreateLapt
 		laptop.Id = id.String()
 	}
 
+	// 所有者和组织由服务器设置, 只有超级管理员可以指定组织, 组织的管理员可以指定所有者
+	if claims, ok := ClaimsFromContext(ctx); ok {
+		owner := laptop.Owner
+		laptop.Owner = claims.Username
+		if claims.Role != RoleSuperAdmin || len(laptop.OrgId) == 0 {
+			laptop.OrgId = claims.OrgID
+		}
+		if len(owner) > 0 && managesOrg(claims, laptop.OrgId) {
+			laptop.Owner = owner
+		}
+	}
+
 	// 如果客户端中断
 	// time.Sleep(6 * time.Second)
 	if err := contextError(ctx); err != nil {
 		return nil, err
 	}
 	// 存储到内存
-	err := server.laptopStore.Save(laptop)
+	err := server.laptops(ctx).Save(laptop)
 	if err != nil {
 		code := codes.Internal
 		if errors.Is(err, ErrAlreadyExits) {
 			code = codes.AlreadyExists
+		} else if errors.Is(err, ErrOtherTenant) {
+			code = codes.PermissionDenied
 		}
 
 		return nil, status.Errorf(code, "cannot save laptop to the store: %v", err)
@@ -65,6 +193,17 @@ func (server *LaptopServer) CreateLaptop(ctx context.Context, req *pb.CreateLapt
 
 	log.Printf("saved laptop with id: %s", laptop.Id)
 
+	// 创建时的价格作为价格历史的第一条记录
+	err = server.priceHistory.Record(&PriceChange{
+		LaptopID:  laptop.Id,
+		NewPrice:  laptop.GetPriceUsd(),
+		Actor:     actorFromContext(ctx),
+		ChangedAt: time.Now(),
+	})
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot record price: %v", err))
+	}
+
 	res := &pb.CreateLaptopResponse{
 		Id: laptop.Id,
 	}
@@ -76,17 +215,34 @@ func (server *LaptopServer) CreateLaptop(ctx context.Context, req *pb.CreateLapt
 // SearchLaptop 搜索 laptop 的服务 rpc
 func (server *LaptopServer) SearchLaptop(req *pb.SearchLaptopRequest, stream pb.LaptopService_SearchLaptopServer) error {
 	filter := req.GetFilter()
-	log.Printf("receive a search-laptop request with filter: %v", filter)
-
-	err := server.laptopStore.Search(stream.Context(), filter, func(laptop *pb.Laptop) error {
-		res := &pb.SearchLaptopResponse{Laptop: laptop}
+	log.Printf("receive a search-laptop request with filter: %v, sort by: %v", filter, req.GetSortBy())
 
+	send := func(res *pb.SearchLaptopResponse) error {
 		err := stream.Send(res)
 		if err != nil {
 			return err
 		}
 
-		log.Printf("sent laptop with id: %s", laptop.GetId())
+		log.Printf("sent laptop with id: %s", res.GetLaptop().GetId())
+		return nil
+	}
+
+	// 按评分排序时需要先找到所有 laptop
+	var results []*pb.SearchLaptopResponse
+	sortByRating := req.GetSortBy() == pb.SearchLaptopRequest_SORT_BY_RATING
+
+	err := server.laptops(stream.Context()).Search(stream.Context(), filter, func(laptop *pb.Laptop) error {
+		res := &pb.SearchLaptopResponse{Laptop: laptop}
+		if !sortByRating {
+			return send(res)
+		}
+
+		rating, err := server.ratings(stream.Context()).Find(laptop.GetId())
+		if err != nil {
+			return err
+		}
+		res.RatingScore = server.ratingPrior.Average(rating)
+		results = append(results, res)
 		return nil
 	})
 
@@ -94,6 +250,16 @@ func (server *LaptopServer) SearchLaptop(req *pb.SearchLaptopRequest, stream pb.
 		return status.Errorf(codes.Internal, "unexpected error: %v", err)
 	}
 
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].GetRatingScore() > results[j].GetRatingScore()
+	})
+	for _, res := range results {
+		err := send(res)
+		if err != nil {
+			return status.Errorf(codes.Internal, "unexpected error: %v", err)
+		}
+	}
+
 	return nil
 }
 
@@ -107,13 +273,29 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServe
 	imageType := req.GetInfo().GetImageType()
 	log.Printf("receive an upload-image request for laptop %s with image type %s", laptopID, imageType)
 
-	laptop, err := server.laptopStore.Find(laptopID)
+	laptop, err := server.laptops(stream.Context()).Find(laptopID)
 	if err != nil {
 		return logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
 	}
 	if laptop == nil {
 		return logError(status.Errorf(codes.InvalidArgument, "laptop %s doesn't exist", laptopID))
 	}
+	// 只能上传到自己有权管理的 laptop
+	err = authorizeLaptop(stream.Context(), laptop)
+	if err != nil {
+		return logError(err)
+	}
+
+	username := ""
+	if claims, ok := ClaimsFromContext(stream.Context()); ok {
+		username = claims.Username
+	}
+
+	// 在接收数据前检查配额
+	err = server.imageQuota.Check(laptopID, username, 0)
+	if err != nil {
+		return logError(quotaError(err))
+	}
 
 	imageData := bytes.Buffer{}
 	imageSize := 0
@@ -145,6 +327,11 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServe
 			return logError(status.Errorf(codes.InvalidArgument, "image is too large: %d > %d", imageSize, maxImageSize))
 		}
 
+		err = server.imageQuota.Check(laptopID, username, int64(imageSize))
+		if err != nil {
+			return logError(quotaError(err))
+		}
+
 		// 测试超时
 		// time.Sleep(time.Second)
 
@@ -154,14 +341,28 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServe
 		}
 	}
 
-	imageID, err := server.imageStore.Save(laptopID, imageType, imageData)
+	// 并发上传时再次检查并占用配额
+	err = server.imageQuota.Reserve(laptopID, username, int64(imageSize))
 	if err != nil {
+		return logError(quotaError(err))
+	}
+
+	imageID, err := server.images(stream.Context()).Save(laptopID, imageType, imageData)
+	if err != nil {
+		server.imageQuota.Release(laptopID, username, int64(imageSize))
 		return logError(status.Errorf(codes.Internal, "cannot save image to the store: %v", err))
 	}
+	server.imageQuota.Commit(imageID, laptopID, username, int64(imageSize))
+
+	info, err := server.images(stream.Context()).Find(imageID)
+	if err != nil || info == nil {
+		return logError(status.Errorf(codes.Internal, "cannot find saved image: %v", err))
+	}
 
 	res := &pb.UploadImageResponse{
-		Id:   imageID,
-		Size: uint32(imageSize),
+		Id:       imageID,
+		Size:     uint32(imageSize),
+		Checksum: info.Checksum,
 	}
 
 	err = stream.SendAndClose(res)
@@ -169,11 +370,211 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServe
 		return logError(status.Errorf(codes.Unknown, "cannot send response: %v", err))
 	}
 
-	log.Printf("saved image with id: %s, size: %d", imageID, imageSize)
+	log.Printf("saved image with id: %s, size: %d, checksum: %s", imageID, imageSize, info.Checksum)
+	return nil
+}
+
+func (server *LaptopServer) DownloadImage(req *pb.DownloadImageRequest, stream pb.LaptopService_DownloadImageServer) error {
+	imageID := req.GetImageId()
+	variant := req.GetVariant()
+	log.Printf("receive a download-image request for image %s with variant %q", imageID, variant)
+
+	info, err := server.images(stream.Context()).Find(imageID)
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "cannot find image: %v", err))
+	}
+	if info == nil {
+		return logError(status.Errorf(codes.NotFound, "image %s doesn't exist", imageID))
+	}
+
+	imageType := info.Type
+	if len(variant) > 0 {
+		v := info.Variants[variant]
+		if v == nil {
+			return logError(status.Errorf(codes.NotFound, "variant %s of image %s is not available", variant, imageID))
+		}
+		imageType = v.Type
+	}
+
+	data, err := server.images(stream.Context()).Load(imageID, variant)
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "cannot load image: %v", err))
+	}
+	if data == nil {
+		return logError(status.Errorf(codes.NotFound, "image %s doesn't exist", imageID))
+	}
+
+	res := &pb.DownloadImageResponse{
+		Data: &pb.DownloadImageResponse_Info{
+			Info: &pb.ImageInfo{
+				LaptopId:  info.LaptopId,
+				ImageType: imageType,
+			},
+		},
+	}
+	err = stream.Send(res)
+	if err != nil {
+		return logError(status.Errorf(codes.Unknown, "cannot send image info: %v", err))
+	}
+
+	for offset := 0; offset < len(data); offset += imageChunkSize {
+		if err := contextError(stream.Context()); err != nil {
+			return err
+		}
+
+		end := offset + imageChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		res := &pb.DownloadImageResponse{
+			Data: &pb.DownloadImageResponse_ChunkData{
+				ChunkData: data[offset:end],
+			},
+		}
+		err = stream.Send(res)
+		if err != nil {
+			return logError(status.Errorf(codes.Unknown, "cannot send chunk data: %v", err))
+		}
+	}
+
+	log.Printf("sent image with id: %s, size: %d", imageID, len(data))
 	return nil
 }
 
+// GetImageURL 获取图片预签名下载地址的 rpc
+func (server *LaptopServer) GetImageURL(ctx context.Context, req *pb.GetImageURLRequest) (*pb.GetImageURLResponse, error) {
+	imageID := req.GetImageId()
+	variant := req.GetVariant()
+	log.Printf("receive a get-image-url request for image %s with variant %q", imageID, variant)
+
+	signer, ok := server.imageStore.(ImageURLSigner)
+	if !ok {
+		return nil, logError(status.Errorf(codes.Unimplemented, "cannot presign image url: %v", ErrPresignNotSupported))
+	}
+
+	// 其他租户的图片视为不存在
+	info, err := server.images(ctx).Find(imageID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find image: %v", err))
+	}
+	if info == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "image %s doesn't exist", imageID))
+	}
+
+	url, err := signer.PresignURL(imageID, variant, imageURLExpiry)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrImageNotFound) {
+			code = codes.NotFound
+		} else if errors.Is(err, ErrPresignNotSupported) {
+			code = codes.Unimplemented
+		}
+
+		return nil, logError(status.Errorf(code, "cannot presign image url: %v", err))
+	}
+
+	res := &pb.GetImageURLResponse{
+		Url:              url,
+		ExpiresInSeconds: int64(imageURLExpiry / time.Second),
+	}
+	return res, nil
+}
+
+// DeleteImage 删除图片的 rpc
+func (server *LaptopServer) DeleteImage(ctx context.Context, req *pb.DeleteImageRequest) (*pb.DeleteImageResponse, error) {
+	imageID := req.GetImageId()
+	log.Printf("receive a delete-image request for image %s", imageID)
+
+	err := server.authorizeImage(ctx, imageID)
+	if err != nil {
+		return nil, logError(err)
+	}
+
+	err = server.images(ctx).Delete(imageID)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrImageNotFound) {
+			code = codes.NotFound
+		}
+
+		return nil, logError(status.Errorf(code, "cannot delete image: %v", err))
+	}
+	server.imageQuota.Remove(imageID)
+
+	log.Printf("deleted image with id: %s", imageID)
+	return &pb.DeleteImageResponse{}, nil
+}
+
+// GetQuotaUsage 获取 laptop 和当前用户图片配额使用量的 rpc
+func (server *LaptopServer) GetQuotaUsage(ctx context.Context, req *pb.GetQuotaUsageRequest) (*pb.GetQuotaUsageResponse, error) {
+	laptopID := req.GetLaptopId()
+	log.Printf("receive a get-quota-usage request for laptop %s", laptopID)
+
+	config := server.imageQuota.Config()
+	res := &pb.GetQuotaUsageResponse{}
+
+	if len(laptopID) > 0 {
+		usage := server.imageQuota.LaptopUsage(laptopID)
+		res.LaptopImages = &pb.QuotaUsage{Used: usage.Images, Limit: config.MaxImagesPerLaptop}
+		res.LaptopBytes = &pb.QuotaUsage{Used: usage.Bytes, Limit: config.MaxBytesPerLaptop}
+	}
+
+	if claims, ok := ClaimsFromContext(ctx); ok {
+		usage := server.imageQuota.UserUsage(claims.Username)
+		res.Username = claims.Username
+		res.UserBytes = &pb.QuotaUsage{Used: usage.Bytes, Limit: config.MaxBytesPerUser}
+	}
+
+	return res, nil
+}
+
+// CheckImages 检查并修复图片存储一致性的 rpc
+func (server *LaptopServer) CheckImages(ctx context.Context, req *pb.CheckImagesRequest) (*pb.CheckImagesResponse, error) {
+	log.Printf("receive a check-images request with repair = %t", req.GetRepair())
+
+	checker, ok := server.imageStore.(ImageChecker)
+	if !ok {
+		return nil, logError(status.Errorf(codes.Unimplemented, "cannot check images: %v", ErrCheckNotSupported))
+	}
+
+	report, err := checker.Check(server.laptopStore, req.GetRepair())
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrCheckNotSupported) {
+			code = codes.Unimplemented
+		}
+
+		return nil, logError(status.Errorf(code, "cannot check images: %v", err))
+	}
+	server.imageQuota.RemoveRepaired(report)
+
+	res := &pb.CheckImagesResponse{
+		CheckedImages: uint32(report.CheckedImages),
+		CheckedFiles:  uint32(report.CheckedFiles),
+	}
+	for _, issue := range report.Issues {
+		res.Issues = append(res.Issues, &pb.ImageIssue{
+			Kind:     toPbImageIssueKind(issue.Kind),
+			ImageId:  issue.ImageID,
+			Variant:  issue.Variant,
+			Path:     issue.Path,
+			Detail:   issue.Detail,
+			Repaired: issue.Repaired,
+		})
+	}
+
+	log.Printf("checked %d images, found %d issues", report.CheckedImages, len(report.Issues))
+	return res, nil
+}
+
+// RateLaptop 评分的 rpc, 每个用户对每台 laptop 只保留最后一次评分
 func (server *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer) error {
+	claims, ok := ClaimsFromContext(stream.Context())
+	if !ok {
+		return logError(status.Errorf(codes.Unauthenticated, "cannot rate laptop: user is not authenticated"))
+	}
+
 	for {
 		err := contextError(stream.Context())
 		if err != nil {
@@ -192,9 +593,20 @@ func (server *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer)
 		laptopID := req.GetLaptopId()
 		score := req.GetScore()
 
-		log.Printf("received a rate-laptop request: id = %s, score = %.2f", laptopID, score)
+		log.Printf("received a rate-laptop request: id = %s, score = %.2f, user = %s", laptopID, score, claims.Username)
 
-		found, err := server.laptopStore.Find(laptopID)
+		// 分数无效或评分过于频繁时只拒绝这一次评分
+		err = server.ratingPolicy.Validate(score)
+		if err != nil {
+			err = rejectRating(stream, laptopID, status.Newf(codes.InvalidArgument, "cannot rate laptop: %v", err))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// 先检查 laptop, 不存在或属于其他租户的 laptop 不占用评分次数
+		found, err := server.laptops(stream.Context()).Find(laptopID)
 		if err != nil {
 			return logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
 		}
@@ -202,15 +614,26 @@ func (server *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer)
 			return logError(status.Errorf(codes.NotFound, "laptopID %s is not found", laptopID))
 		}
 
-		rating, err := server.ratingStore.Add(laptopID, score)
+		now := time.Now()
+		err = server.ratingGuard.Allow(claims.Username, now)
 		if err != nil {
-			return logError(status.Errorf(codes.Internal, "cannot add rating to the store: %v", err))
+			err = rejectRating(stream, laptopID, status.Newf(codes.ResourceExhausted, "cannot rate laptop: %v", err))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		rating, err := server.ratingGuard.addRating(server.ratings(stream.Context()), laptopID, claims.Username, score, now)
+		if err != nil {
+			return logError(status.Errorf(codes.Internal, "cannot rate laptop: %v", err))
 		}
 
 		res := &pb.RateLaptopResponse{
-			LaptopId:     laptopID,
-			RatedCount:   rating.Count,
-			AverageScore: rating.Sum / float64(rating.Count),
+			LaptopId:        laptopID,
+			RatedCount:      rating.Count,
+			AverageScore:    rating.Average(),
+			BayesianAverage: server.ratingPrior.Average(rating),
 		}
 
 		err = stream.Send(res)
@@ -221,6 +644,729 @@ func (server *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer)
 	return nil
 }
 
+// RemoveRating 撤回当前用户评分的 rpc
+func (server *LaptopServer) RemoveRating(ctx context.Context, req *pb.RemoveRatingRequest) (*pb.RemoveRatingResponse, error) {
+	laptopID := req.GetLaptopId()
+
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, logError(status.Errorf(codes.Unauthenticated, "cannot remove rating: user is not authenticated"))
+	}
+	log.Printf("receive a remove-rating request: id = %s, user = %s", laptopID, claims.Username)
+
+	rating, err := server.ratings(ctx).Remove(laptopID, claims.Username)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrRatingNotFound) {
+			code = codes.NotFound
+		}
+
+		return nil, logError(status.Errorf(code, "cannot remove rating: %v", err))
+	}
+
+	res := &pb.RemoveRatingResponse{
+		LaptopId:     laptopID,
+		RatedCount:   rating.Count,
+		AverageScore: rating.Average(),
+	}
+	return res, nil
+}
+
+// GetMyRating 获取当前用户评分的 rpc
+func (server *LaptopServer) GetMyRating(ctx context.Context, req *pb.GetMyRatingRequest) (*pb.GetMyRatingResponse, error) {
+	laptopID := req.GetLaptopId()
+
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, logError(status.Errorf(codes.Unauthenticated, "cannot get rating: user is not authenticated"))
+	}
+	log.Printf("receive a get-my-rating request: id = %s, user = %s", laptopID, claims.Username)
+
+	userRating, err := server.ratings(ctx).FindUserRating(laptopID, claims.Username)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find rating: %v", err))
+	}
+	if userRating == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "cannot get rating: %v", ErrRatingNotFound))
+	}
+
+	res := &pb.GetMyRatingResponse{
+		LaptopId: laptopID,
+		Score:    userRating.Score,
+		Excluded: userRating.Excluded,
+	}
+	return res, nil
+}
+
+// GetRatingStats 获取评分统计的 rpc
+func (server *LaptopServer) GetRatingStats(ctx context.Context, req *pb.GetRatingStatsRequest) (*pb.GetRatingStatsResponse, error) {
+	laptopID := req.GetLaptopId()
+	log.Printf("receive a get-rating-stats request: id = %s", laptopID)
+
+	found, err := server.laptops(ctx).Find(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+	}
+	if found == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "laptopID %s is not found", laptopID))
+	}
+
+	scores, err := server.ratings(ctx).Scores(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot get scores: %v", err))
+	}
+
+	stats := NewRatingStats(scores, server.ratingPolicy, *server.ratingPrior)
+	res := &pb.GetRatingStatsResponse{
+		LaptopId:        laptopID,
+		RatedCount:      stats.Count,
+		AverageScore:    stats.Mean,
+		MedianScore:     stats.Median,
+		StdDev:          stats.StdDev,
+		BayesianAverage: stats.BayesianAverage,
+	}
+	for _, bucket := range stats.Histogram {
+		res.Histogram = append(res.Histogram, &pb.RatingBucket{
+			Score: bucket.Score,
+			Count: bucket.Count,
+		})
+	}
+	return res, nil
+}
+
+// TopLaptops 评分排行榜和趋势榜的 rpc
+func (server *LaptopServer) TopLaptops(ctx context.Context, req *pb.TopLaptopsRequest) (*pb.TopLaptopsResponse, error) {
+	log.Printf("receive a top-laptops request: ranking = %v, window = %d days", req.GetRanking(), req.GetWindowDays())
+
+	options := LeaderboardOptions{
+		Trending:   req.GetRanking() == pb.TopLaptopsRequest_TRENDING,
+		Window:     time.Duration(req.GetWindowDays()) * 24 * time.Hour,
+		MinRatings: req.GetMinRatings(),
+		Limit:      int(req.GetLimit()),
+		Now:        time.Now(),
+	}
+	if options.Trending && options.Window == 0 {
+		options.Window = defaultTrendingWindowDays * 24 * time.Hour
+	}
+	if options.Limit == 0 {
+		options.Limit = defaultTopLaptopsLimit
+	}
+	if options.Limit > maxTopLaptopsLimit {
+		options.Limit = maxTopLaptopsLimit
+	}
+
+	laptopIDs, err := server.ratings(ctx).RatedLaptops()
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot get rated laptops: %v", err))
+	}
+
+	laptops := make(map[string]*pb.Laptop)
+	ratings := make(map[string][]*UserRating)
+	for _, laptopID := range laptopIDs {
+		err := contextError(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		laptop, err := server.laptops(ctx).Find(laptopID)
+		if err != nil {
+			return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+		}
+		if laptop == nil || (req.GetFilter() != nil && !isQualified(req.GetFilter(), laptop)) {
+			continue
+		}
+
+		userRatings, err := server.ratings(ctx).ListUserRatings(laptopID)
+		if err != nil {
+			return nil, logError(status.Errorf(codes.Internal, "cannot get ratings: %v", err))
+		}
+		laptops[laptopID] = laptop
+		ratings[laptopID] = userRatings
+	}
+
+	res := &pb.TopLaptopsResponse{}
+	for _, entry := range RankLaptops(ratings, *server.ratingPrior, options) {
+		res.Laptops = append(res.Laptops, &pb.TopLaptop{
+			Laptop:       laptops[entry.LaptopID],
+			Score:        entry.Score,
+			RatedCount:   entry.RatedCount,
+			AverageScore: entry.AverageScore,
+		})
+	}
+	return res, nil
+}
+
+// CompareLaptops 逐项比较多台 laptop 规格的 rpc
+func (server *LaptopServer) CompareLaptops(ctx context.Context, req *pb.CompareLaptopsRequest) (*pb.CompareLaptopsResponse, error) {
+	laptopIDs := req.GetLaptopIds()
+	log.Printf("receive a compare-laptops request with ids: %v", laptopIDs)
+
+	if len(laptopIDs) < minCompareLaptops || len(laptopIDs) > maxCompareLaptops {
+		return nil, logError(status.Errorf(codes.InvalidArgument,
+			"cannot compare laptops: need %d to %d laptops, got %d", minCompareLaptops, maxCompareLaptops, len(laptopIDs)))
+	}
+
+	laptops := make([]*pb.Laptop, len(laptopIDs))
+	ratings := make([]*Rating, len(laptopIDs))
+	seen := make(map[string]bool)
+	for i, laptopID := range laptopIDs {
+		if seen[laptopID] {
+			return nil, logError(status.Errorf(codes.InvalidArgument, "cannot compare laptops: duplicate laptopID %s", laptopID))
+		}
+		seen[laptopID] = true
+
+		laptop, err := server.laptops(ctx).Find(laptopID)
+		if err != nil {
+			return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+		}
+		if laptop == nil {
+			return nil, logError(status.Errorf(codes.NotFound, "laptopID %s is not found", laptopID))
+		}
+
+		rating, err := server.ratings(ctx).Find(laptopID)
+		if err != nil {
+			return nil, logError(status.Errorf(codes.Internal, "cannot find rating: %v", err))
+		}
+
+		laptops[i] = laptop
+		ratings[i] = rating
+	}
+
+	res := &pb.CompareLaptopsResponse{Laptops: laptops}
+	for _, attribute := range CompareLaptops(laptops, ratings) {
+		other := &pb.AttributeComparison{
+			Name:           attribute.Name,
+			Unit:           attribute.Unit,
+			HigherIsBetter: attribute.HigherIsBetter,
+			Values:         attribute.Values,
+		}
+		for _, i := range attribute.Best {
+			other.BestLaptopIds = append(other.BestLaptopIds, laptopIDs[i])
+		}
+		res.Attributes = append(res.Attributes, other)
+	}
+	return res, nil
+}
+
+// SimilarLaptops 推荐与指定 laptop 规格最接近的 laptop 的 rpc
+func (server *LaptopServer) SimilarLaptops(ctx context.Context, req *pb.SimilarLaptopsRequest) (*pb.SimilarLaptopsResponse, error) {
+	laptopID := req.GetLaptopId()
+	log.Printf("receive a similar-laptops request: id = %s, k = %d", laptopID, req.GetK())
+
+	k := int(req.GetK())
+	if k == 0 {
+		k = defaultSimilarLaptopsLimit
+	}
+	if k > maxSimilarLaptopsLimit {
+		k = maxSimilarLaptopsLimit
+	}
+
+	weights := server.similarityWeights
+	if req.GetWeights() != nil {
+		weights = toSimilarityWeights(req.GetWeights())
+		err := weights.Validate()
+		if err != nil {
+			return nil, logError(status.Errorf(codes.InvalidArgument, "cannot find similar laptops: %v", err))
+		}
+	}
+
+	target, err := server.laptops(ctx).Find(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+	}
+	if target == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "laptopID %s is not found", laptopID))
+	}
+
+	// 没有过滤条件时不限制价格
+	filter := req.GetFilter()
+	if filter == nil {
+		filter = &pb.Filter{MaxPriceUsd: math.MaxFloat64}
+	}
+
+	var candidates []LaptopFeatures
+	err = server.laptops(ctx).Search(ctx, filter, func(laptop *pb.Laptop) error {
+		candidates = append(candidates, NewLaptopFeatures(laptop))
+		return nil
+	})
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot search laptops: %v", err))
+	}
+
+	res := &pb.SimilarLaptopsResponse{}
+	for _, similar := range NearestLaptops(NewLaptopFeatures(target), candidates, weights, k) {
+		laptop, err := server.laptops(ctx).Find(similar.LaptopID)
+		if err != nil {
+			return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+		}
+		if laptop == nil {
+			continue
+		}
+
+		res.Laptops = append(res.Laptops, &pb.SimilarLaptop{
+			Laptop:   laptop,
+			Distance: similar.Distance,
+		})
+	}
+	return res, nil
+}
+
+// UpdateLaptopPrice 修改 laptop 价格的 rpc, 价格跌破用户的目标价时发送通知
+func (server *LaptopServer) UpdateLaptopPrice(ctx context.Context, req *pb.UpdateLaptopPriceRequest) (*pb.UpdateLaptopPriceResponse, error) {
+	laptopID := req.GetLaptopId()
+	price := req.GetPriceUsd()
+	log.Printf("receive an update-laptop-price request: id = %s, price = %.2f", laptopID, price)
+
+	if price <= 0 || math.IsInf(price, 0) || math.IsNaN(price) {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "price must be a positive number, got %v", price))
+	}
+
+	laptop, err := server.laptops(ctx).Find(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+	}
+	if laptop == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "laptop %s doesn't exist", laptopID))
+	}
+	// 所有者和组织不会修改, 在更新前检查即可
+	err = authorizeLaptop(ctx, laptop)
+	if err != nil {
+		return nil, logError(err)
+	}
+
+	change := &PriceChange{
+		LaptopID:    laptopID,
+		NewPrice:    price,
+		HasOldPrice: true,
+		Actor:       actorFromContext(ctx),
+	}
+
+	// 在 laptop 存储的锁内记录价格变更, 使价格历史的顺序与修改的顺序一致
+	_, err = server.laptops(ctx).Update(laptopID, func(laptop *pb.Laptop) error {
+		change.OldPrice = laptop.GetPriceUsd()
+		change.ChangedAt = time.Now()
+		laptop.PriceUsd = price
+		return server.priceHistory.Record(change)
+	})
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrLaptopNotFound) {
+			code = codes.NotFound
+		}
+		return nil, logError(status.Errorf(code, "cannot update laptop price: %v", err))
+	}
+
+	notifications := server.priceAlerts.PriceChanged(change)
+	log.Printf("laptop %s price: %.2f -> %.2f, sent %d notifications", laptopID, change.OldPrice, change.NewPrice, len(notifications))
+
+	return &pb.UpdateLaptopPriceResponse{Change: toPbPriceChange(change)}, nil
+}
+
+// GetPriceHistory 获取 laptop 价格变更历史的 rpc
+func (server *LaptopServer) GetPriceHistory(ctx context.Context, req *pb.GetPriceHistoryRequest) (*pb.GetPriceHistoryResponse, error) {
+	laptopID := req.GetLaptopId()
+	log.Printf("receive a get-price-history request with id: %s", laptopID)
+
+	laptop, err := server.laptops(ctx).Find(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+	}
+	if laptop == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "laptopID %s is not found", laptopID))
+	}
+
+	changes, err := server.priceHistory.List(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot list price history: %v", err))
+	}
+
+	res := &pb.GetPriceHistoryResponse{}
+	for _, change := range changes {
+		res.Changes = append(res.Changes, toPbPriceChange(change))
+	}
+	return res, nil
+}
+
+// SetPriceAlert 设置当前用户降价提醒的 rpc
+func (server *LaptopServer) SetPriceAlert(ctx context.Context, req *pb.SetPriceAlertRequest) (*pb.SetPriceAlertResponse, error) {
+	laptopID := req.GetLaptopId()
+	targetPrice := req.GetTargetPriceUsd()
+
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, logError(status.Errorf(codes.Unauthenticated, "cannot set price alert: user is not authenticated"))
+	}
+	log.Printf("receive a set-price-alert request: id = %s, target = %.2f, user = %s", laptopID, targetPrice, claims.Username)
+
+	if targetPrice < 0 || math.IsInf(targetPrice, 0) || math.IsNaN(targetPrice) {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "target price must be a non-negative number, got %v", targetPrice))
+	}
+
+	laptop, err := server.laptops(ctx).Find(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+	}
+	if laptop == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "laptopID %s is not found", laptopID))
+	}
+
+	res := &pb.SetPriceAlertResponse{CurrentPriceUsd: laptop.GetPriceUsd()}
+	alert := server.priceAlerts.SetAlert(claims.Username, laptopID, targetPrice)
+	if alert != nil {
+		res.Alert = &pb.PriceAlert{
+			LaptopId:       alert.LaptopID,
+			TargetPriceUsd: alert.TargetPrice,
+			CreatedAt:      timestamppb.New(alert.CreatedAt),
+		}
+	}
+	return res, nil
+}
+
+// WatchAlerts 持续接收当前用户降价通知的 rpc, 直到客户端取消
+func (server *LaptopServer) WatchAlerts(req *pb.WatchAlertsRequest, stream pb.LaptopService_WatchAlertsServer) error {
+	claims, ok := ClaimsFromContext(stream.Context())
+	if !ok {
+		return logError(status.Errorf(codes.Unauthenticated, "cannot watch alerts: user is not authenticated"))
+	}
+	log.Printf("receive a watch-alerts request from user %s", claims.Username)
+
+	notifications, cancel := server.priceAlerts.Subscribe(claims.Username)
+	defer cancel()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			log.Printf("user %s stopped watching alerts", claims.Username)
+			return nil
+		case notification := <-notifications:
+			res := &pb.WatchAlertsResponse{
+				Notification: &pb.PriceNotification{
+					Id:             notification.ID,
+					LaptopId:       notification.LaptopID,
+					OldPriceUsd:    notification.OldPrice,
+					NewPriceUsd:    notification.NewPrice,
+					TargetPriceUsd: notification.TargetPrice,
+					NotifiedAt:     timestamppb.New(notification.NotifiedAt),
+				},
+			}
+			err := stream.Send(res)
+			if err != nil {
+				return logError(status.Errorf(codes.Unknown, "cannot send stream response: %v", err))
+			}
+		}
+	}
+}
+
+// ListRatingEvents 分页获取评分事件历史的 rpc
+func (server *LaptopServer) ListRatingEvents(ctx context.Context, req *pb.ListRatingEventsRequest) (*pb.ListRatingEventsResponse, error) {
+	log.Printf("receive a list-rating-events request: laptop = %s, user = %s", req.GetLaptopId(), req.GetUsername())
+
+	eventStore, ok := server.ratingStore.(RatingEventStore)
+	if !ok {
+		return nil, logError(status.Errorf(codes.Unimplemented, "cannot list rating events: %v", ErrEventsNotSupported))
+	}
+
+	// page token 是上一页最后一个事件的序号
+	afterSequence, limit, err := parsePage(req.GetPageSize(), req.GetPageToken())
+	if err != nil {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "cannot list rating events: %v", err))
+	}
+
+	events, err := eventStore.ListEvents(RatingEventQuery{
+		LaptopID:      req.GetLaptopId(),
+		Username:      req.GetUsername(),
+		AfterSequence: uint64(afterSequence),
+		Limit:         limit + 1,
+	})
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot list rating events: %v", err))
+	}
+
+	res := &pb.ListRatingEventsResponse{}
+	if len(events) > limit {
+		events = events[:limit]
+		res.NextPageToken = strconv.FormatUint(events[limit-1].Sequence, 10)
+	}
+	for _, event := range events {
+		res.Events = append(res.Events, toPbRatingEvent(event))
+	}
+	return res, nil
+}
+
+// RebuildRatingAggregates 从事件日志重新计算评分汇总的 rpc
+func (server *LaptopServer) RebuildRatingAggregates(ctx context.Context, req *pb.RebuildRatingAggregatesRequest) (*pb.RebuildRatingAggregatesResponse, error) {
+	log.Print("receive a rebuild-rating-aggregates request")
+
+	eventStore, ok := server.ratingStore.(RatingEventStore)
+	if !ok {
+		return nil, logError(status.Errorf(codes.Unimplemented, "cannot rebuild rating aggregates: %v", ErrEventsNotSupported))
+	}
+
+	report, err := eventStore.RebuildAggregates()
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot rebuild rating aggregates: %v", err))
+	}
+
+	log.Printf("replayed %d rating events, %d laptops changed", report.Events, report.ChangedLaptops)
+	res := &pb.RebuildRatingAggregatesResponse{
+		Events:         uint32(report.Events),
+		Laptops:        uint32(report.Laptops),
+		ChangedLaptops: uint32(report.ChangedLaptops),
+	}
+	return res, nil
+}
+
+// ListRatingFlags 获取被怀疑刷分的评分的 rpc
+func (server *LaptopServer) ListRatingFlags(ctx context.Context, req *pb.ListRatingFlagsRequest) (*pb.ListRatingFlagsResponse, error) {
+	log.Printf("receive a list-rating-flags request with include resolved = %t", req.GetIncludeResolved())
+
+	// 只返回当前租户的 laptop 的评分
+	laptops := server.laptops(ctx)
+	res := &pb.ListRatingFlagsResponse{}
+	for _, flag := range server.ratingGuard.ListFlags(req.GetIncludeResolved()) {
+		laptop, err := laptops.Find(flag.LaptopID)
+		if err != nil {
+			return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+		}
+		if laptop == nil {
+			continue
+		}
+		res.Flags = append(res.Flags, toPbRatingFlag(flag))
+	}
+	return res, nil
+}
+
+// ResolveRatingFlag 处理被标记的评分的 rpc, 排除的评分不计入汇总
+func (server *LaptopServer) ResolveRatingFlag(ctx context.Context, req *pb.ResolveRatingFlagRequest) (*pb.ResolveRatingFlagResponse, error) {
+	log.Printf("receive a resolve-rating-flag request: flag = %s, action = %v", req.GetFlagId(), req.GetAction())
+
+	var flagStatus RatingFlagStatus
+	switch req.GetAction() {
+	case pb.ResolveRatingFlagRequest_EXCLUDE:
+		flagStatus = RatingFlagExcluded
+	case pb.ResolveRatingFlagRequest_DISMISS:
+		flagStatus = RatingFlagDismissed
+	default:
+		return nil, logError(status.Errorf(codes.InvalidArgument, "unknown resolve action: %v", req.GetAction()))
+	}
+
+	// 其他租户的 flag 视为不存在
+	if flag := server.ratingGuard.FindFlag(req.GetFlagId()); flag != nil {
+		laptop, err := server.laptops(ctx).Find(flag.LaptopID)
+		if err != nil {
+			return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+		}
+		if laptop == nil {
+			return nil, logError(status.Errorf(codes.NotFound, "cannot resolve rating flag: %v", ErrFlagNotFound))
+		}
+	}
+
+	flag, err := server.ratingGuard.Resolve(req.GetFlagId(), flagStatus)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrFlagNotFound) {
+			code = codes.NotFound
+		}
+		return nil, logError(status.Errorf(code, "cannot resolve rating flag: %v", err))
+	}
+
+	rating, err := server.ratings(ctx).SetExcluded(flag.LaptopID, flag.Username, flagStatus == RatingFlagExcluded)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot exclude rating: %v", err))
+	}
+
+	res := &pb.ResolveRatingFlagResponse{
+		Flag:         toPbRatingFlag(flag),
+		RatedCount:   rating.Count,
+		AverageScore: rating.Average(),
+	}
+	return res, nil
+}
+
+// GetRatingPolicy 获取评分规则的 rpc
+func (server *LaptopServer) GetRatingPolicy(ctx context.Context, req *pb.GetRatingPolicyRequest) (*pb.GetRatingPolicyResponse, error) {
+	res := &pb.GetRatingPolicyResponse{
+		MinScore: server.ratingPolicy.MinScore,
+		MaxScore: server.ratingPolicy.MaxScore,
+		Step:     server.ratingPolicy.Step,
+	}
+	return res, nil
+}
+
+// rejectRating 拒绝流中的一次评分, 流不会中断
+func rejectRating(stream pb.LaptopService_RateLaptopServer, laptopID string, st *status.Status) error {
+	logError(st.Err())
+
+	res := &pb.RateLaptopResponse{
+		LaptopId: laptopID,
+		Error:    st.Proto(),
+	}
+	err := stream.Send(res)
+	if err != nil {
+		return logError(status.Errorf(codes.Unknown, "cannot send stream response: %v", err))
+	}
+	return nil
+}
+
+// quotaError 将超出配额转换为 ResourceExhausted 错误, 并在详情中附带使用量和限制
+func quotaError(err error) error {
+	var quotaErr *QuotaExceededError
+	if !errors.As(err, &quotaErr) {
+		return status.Errorf(codes.Internal, "cannot check quota: %v", err)
+	}
+
+	st := status.Newf(codes.ResourceExhausted, "cannot upload image: %v", err)
+	detailed, detailErr := st.WithDetails(&errdetails.QuotaFailure{
+		Violations: []*errdetails.QuotaFailure_Violation{
+			{
+				Subject:     quotaErr.Subject,
+				Description: quotaErr.Error(),
+			},
+		},
+	})
+	if detailErr != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+func toPbRatingEvent(event *RatingEvent) *pb.RatingEvent {
+	other := &pb.RatingEvent{
+		Sequence:  event.Sequence,
+		LaptopId:  event.LaptopID,
+		Username:  event.Username,
+		Score:     event.Score,
+		Timestamp: timestamppb.New(event.Timestamp),
+	}
+
+	switch event.Type {
+	case RatingEventRated:
+		other.Type = pb.RatingEvent_RATED
+	case RatingEventRemoved:
+		other.Type = pb.RatingEvent_REMOVED
+	case RatingEventExcluded:
+		other.Type = pb.RatingEvent_EXCLUDED
+	case RatingEventIncluded:
+		other.Type = pb.RatingEvent_INCLUDED
+	}
+
+	if event.PreviousScore != nil {
+		other.HasPreviousScore = true
+		other.PreviousScore = *event.PreviousScore
+	}
+	return other
+}
+
+// laptops 返回限定在当前用户租户内的 laptop 存储
+func (server *LaptopServer) laptops(ctx context.Context) LaptopStore {
+	return NewTenantLaptopStore(server.laptopStore, TenantFromContext(ctx))
+}
+
+// ratings 返回限定在当前用户租户内的评分存储
+func (server *LaptopServer) ratings(ctx context.Context) RatingStore {
+	return NewTenantRatingStore(server.ratingStore, server.laptopStore, TenantFromContext(ctx))
+}
+
+// images 返回限定在当前用户租户内的图片存储
+func (server *LaptopServer) images(ctx context.Context) ImageStore {
+	return NewTenantImageStore(server.imageStore, server.laptopStore, TenantFromContext(ctx))
+}
+
+// authorizeImage 检查当前用户能否管理图片所属的 laptop
+func (server *LaptopServer) authorizeImage(ctx context.Context, imageID string) error {
+	if _, ok := ClaimsFromContext(ctx); !ok {
+		return nil
+	}
+
+	info, err := server.images(ctx).Find(imageID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot find image: %v", err)
+	}
+	if info == nil {
+		return status.Errorf(codes.NotFound, "image %s doesn't exist", imageID)
+	}
+
+	laptop, err := server.laptops(ctx).Find(info.LaptopId)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+	}
+	if laptop == nil {
+		// laptop 已经不存在时只有不属于任何组织的 admin 可以清理图片
+		laptop = &pb.Laptop{Id: info.LaptopId}
+	}
+	return authorizeLaptop(ctx, laptop)
+}
+
+// actorFromContext 返回当前用户名, 没有登录时返回空字符串
+func actorFromContext(ctx context.Context) string {
+	if claims, ok := ClaimsFromContext(ctx); ok {
+		return claims.Username
+	}
+	return ""
+}
+
+func toPbPriceChange(change *PriceChange) *pb.PriceChange {
+	return &pb.PriceChange{
+		LaptopId:    change.LaptopID,
+		HasOldPrice: change.HasOldPrice,
+		OldPriceUsd: change.OldPrice,
+		NewPriceUsd: change.NewPrice,
+		Actor:       change.Actor,
+		ChangedAt:   timestamppb.New(change.ChangedAt),
+	}
+}
+
+func toSimilarityWeights(weights *pb.SimilarityWeights) SimilarityWeights {
+	return SimilarityWeights{
+		CPUCores:   weights.GetCpuCores(),
+		CPUGhz:     weights.GetCpuGhz(),
+		RAM:        weights.GetRam(),
+		Storage:    weights.GetStorage(),
+		GPUMemory:  weights.GetGpuMemory(),
+		ScreenSize: weights.GetScreenSize(),
+		Price:      weights.GetPrice(),
+		Weight:     weights.GetWeight(),
+	}
+}
+
+func toPbRatingFlag(flag *RatingFlag) *pb.RatingFlag {
+	other := &pb.RatingFlag{
+		Id:        flag.ID,
+		LaptopId:  flag.LaptopID,
+		Username:  flag.Username,
+		Score:     flag.Score,
+		Reason:    flag.Reason,
+		FlaggedAt: timestamppb.New(flag.FlaggedAt),
+	}
+
+	switch flag.Status {
+	case RatingFlagOpen:
+		other.Status = pb.RatingFlag_OPEN
+	case RatingFlagExcluded:
+		other.Status = pb.RatingFlag_EXCLUDED
+	case RatingFlagDismissed:
+		other.Status = pb.RatingFlag_DISMISSED
+	}
+	return other
+}
+
+func toPbImageIssueKind(kind ImageIssueKind) pb.ImageIssue_Kind {
+	switch kind {
+	case ImageIssueOrphanFile:
+		return pb.ImageIssue_ORPHAN_FILE
+	case ImageIssueDanglingMetadata:
+		return pb.ImageIssue_DANGLING_METADATA
+	case ImageIssueSizeMismatch:
+		return pb.ImageIssue_SIZE_MISMATCH
+	case ImageIssueChecksumMismatch:
+		return pb.ImageIssue_CHECKSUM_MISMATCH
+	case ImageIssueMissingLaptop:
+		return pb.ImageIssue_MISSING_LAPTOP
+	default:
+		return pb.ImageIssue_UNKNOWN
+	}
+}
+
 func logError(err error) error {
 	if err != nil {
 		log.Print(err)
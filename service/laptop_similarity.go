@@ -0,0 +1,225 @@
+package service
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"go-pcbook-micro/pb"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const numLaptopFeatures = 8
+
+// SimilarityWeights 计算距离时每项规格的权重, 0 表示不考虑
+type SimilarityWeights struct {
+	CPUCores   float64
+	CPUGhz     float64
+	RAM        float64
+	Storage    float64
+	GPUMemory  float64
+	ScreenSize float64
+	Price      float64
+	Weight     float64
+}
+
+// DefaultSimilarityWeights 默认所有规格同样重要
+var DefaultSimilarityWeights = SimilarityWeights{
+	CPUCores:   1,
+	CPUGhz:     1,
+	RAM:        1,
+	Storage:    1,
+	GPUMemory:  1,
+	ScreenSize: 1,
+	Price:      1,
+	Weight:     1,
+}
+
+// ParseSimilarityWeights 解析 "name=weight,..." 格式的权重, 没有给出的规格使用默认权重
+func ParseSimilarityWeights(value string) (SimilarityWeights, error) {
+	weights := DefaultSimilarityWeights
+	fields := weights.fields()
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return SimilarityWeights{}, fmt.Errorf("invalid similarity weight %q, expect name=weight", item)
+		}
+
+		name := strings.TrimSpace(parts[0])
+		field := fields[name]
+		if field == nil {
+			return SimilarityWeights{}, fmt.Errorf("unknown similarity weight %q", name)
+		}
+
+		weight, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			return SimilarityWeights{}, fmt.Errorf("invalid similarity weight %q: %w", item, err)
+		}
+		*field = weight
+	}
+
+	err := weights.Validate()
+	if err != nil {
+		return SimilarityWeights{}, err
+	}
+	return weights, nil
+}
+
+// Validate 权重不能为负数, 并且至少有一项大于 0
+func (weights SimilarityWeights) Validate() error {
+	total := 0.0
+	for _, weight := range weights.vector() {
+		if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+			return fmt.Errorf("similarity weight must be a non-negative number, got %v", weight)
+		}
+		total += weight
+	}
+	if total == 0 {
+		return errors.New("at least one similarity weight must be positive")
+	}
+	return nil
+}
+
+func (weights *SimilarityWeights) fields() map[string]*float64 {
+	return map[string]*float64{
+		"cpu_cores":   &weights.CPUCores,
+		"cpu_ghz":     &weights.CPUGhz,
+		"ram":         &weights.RAM,
+		"storage":     &weights.Storage,
+		"gpu_memory":  &weights.GPUMemory,
+		"screen_size": &weights.ScreenSize,
+		"price":       &weights.Price,
+		"weight":      &weights.Weight,
+	}
+}
+
+// vector 与 laptopFeatures 的顺序一致
+func (weights SimilarityWeights) vector() [numLaptopFeatures]float64 {
+	return [numLaptopFeatures]float64{
+		weights.CPUCores,
+		weights.CPUGhz,
+		weights.RAM,
+		weights.Storage,
+		weights.GPUMemory,
+		weights.ScreenSize,
+		weights.Price,
+		weights.Weight,
+	}
+}
+
+// LaptopFeatures 换算为统一单位的 laptop 规格
+type LaptopFeatures struct {
+	LaptopID string
+	values   [numLaptopFeatures]float64
+}
+
+// NewLaptopFeatures 提取计算距离使用的规格
+func NewLaptopFeatures(laptop *pb.Laptop) LaptopFeatures {
+	gpuMemory := 0.0
+	for _, gpu := range laptop.GetGpus() {
+		gpuMemory = math.Max(gpuMemory, toGigabytes(gpu.GetMemory()))
+	}
+
+	return LaptopFeatures{
+		LaptopID: laptop.GetId(),
+		values: [numLaptopFeatures]float64{
+			float64(laptop.GetCpu().GetNumberCores()),
+			laptop.GetCpu().GetMaxGhz(),
+			toGigabytes(laptop.GetRam()),
+			storageGigabytes(laptop.GetStorages()),
+			gpuMemory,
+			float64(laptop.GetScreen().GetSizeInch()),
+			laptop.GetPriceUsd(),
+			weightKg(laptop),
+		},
+	}
+}
+
+// SimilarLaptop 相似的 laptop 及其与目标的距离
+type SimilarLaptop struct {
+	LaptopID string
+	Distance float64
+}
+
+// NearestLaptops 返回与目标距离最近的 k 台 laptop, 距离从小到大
+//
+// 每项规格先除以所有候选中的取值范围, 再计算加权欧氏距离, 使用大小为 k 的堆只保留最近的结果
+func NearestLaptops(target LaptopFeatures, candidates []LaptopFeatures, weights SimilarityWeights, k int) []*SimilarLaptop {
+	if k <= 0 || len(candidates) == 0 {
+		return nil
+	}
+
+	low, high := target.values, target.values
+	for _, candidate := range candidates {
+		for i, value := range candidate.values {
+			low[i] = math.Min(low[i], value)
+			high[i] = math.Max(high[i], value)
+		}
+	}
+
+	scale := weights.vector()
+	for i := range scale {
+		if high[i] > low[i] {
+			scale[i] /= (high[i] - low[i]) * (high[i] - low[i])
+		} else {
+			scale[i] = 0
+		}
+	}
+
+	nearest := &similarHeap{}
+	for _, candidate := range candidates {
+		if candidate.LaptopID == target.LaptopID {
+			continue
+		}
+
+		sum := 0.0
+		for i, value := range candidate.values {
+			diff := value - target.values[i]
+			sum += scale[i] * diff * diff
+		}
+
+		similar := &SimilarLaptop{LaptopID: candidate.LaptopID, Distance: math.Sqrt(sum)}
+		if nearest.Len() < k {
+			heap.Push(nearest, similar)
+		} else if nearest.less(similar, (*nearest)[0]) {
+			(*nearest)[0] = similar
+			heap.Fix(nearest, 0)
+		}
+	}
+
+	result := make([]*SimilarLaptop, nearest.Len())
+	for i := len(result) - 1; i >= 0; i-- {
+		result[i] = heap.Pop(nearest).(*SimilarLaptop)
+	}
+	return result
+}
+
+// similarHeap 堆顶是当前保留的结果中最远的
+type similarHeap []*SimilarLaptop
+
+func (h similarHeap) less(a, b *SimilarLaptop) bool {
+	if a.Distance != b.Distance {
+		return a.Distance < b.Distance
+	}
+	return a.LaptopID < b.LaptopID
+}
+
+func (h similarHeap) Len() int            { return len(h) }
+func (h similarHeap) Less(i, j int) bool  { return h.less(h[j], h[i]) }
+func (h similarHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *similarHeap) Push(x interface{}) { *h = append(*h, x.(*SimilarLaptop)) }
+
+func (h *similarHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
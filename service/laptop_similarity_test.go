@@ -0,0 +1,74 @@
+package service
+
+import (
+	"go-pcbook-micro/pb"
+	"go-pcbook-micro/sample"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSimilarityWeights(t *testing.T) {
+	t.Parallel()
+
+	weights, err := ParseSimilarityWeights("")
+	require.NoError(t, err)
+	require.Equal(t, DefaultSimilarityWeights, weights)
+
+	weights, err = ParseSimilarityWeights("price=3, weight=0")
+	require.NoError(t, err)
+	require.Equal(t, 3.0, weights.Price)
+	require.Equal(t, 0.0, weights.Weight)
+	require.Equal(t, 1.0, weights.RAM)
+
+	for _, value := range []string{"price", "color=1", "price=abc", "price=-1"} {
+		_, err = ParseSimilarityWeights(value)
+		require.Error(t, err, value)
+	}
+
+	err = SimilarityWeights{}.Validate()
+	require.Error(t, err)
+}
+
+func TestNearestLaptops(t *testing.T) {
+	t.Parallel()
+
+	newLaptop := func(price float64, ram uint64) *pb.Laptop {
+		laptop := sample.NewLaptop()
+		laptop.PriceUsd = price
+		laptop.Ram = &pb.Memory{Value: ram, Uint: pb.Memory_GIGABYTE}
+		return laptop
+	}
+
+	target := newLaptop(1500, 16)
+	laptops := []*pb.Laptop{
+		target,
+		newLaptop(3000, 16),
+		newLaptop(1600, 16),
+		newLaptop(1500, 64),
+		newLaptop(1400, 16),
+	}
+
+	var candidates []LaptopFeatures
+	for _, laptop := range laptops {
+		candidates = append(candidates, NewLaptopFeatures(laptop))
+	}
+
+	// 只比较价格
+	weights := SimilarityWeights{Price: 1}
+	nearest := NearestLaptops(NewLaptopFeatures(target), candidates, weights, 3)
+	require.Len(t, nearest, 3)
+	require.Equal(t, 0.0, nearest[0].Distance)
+	require.Equal(t, laptops[3].GetId(), nearest[0].LaptopID)
+	require.InDelta(t, 100.0/1600, nearest[1].Distance, 1e-9)
+	require.InDelta(t, 100.0/1600, nearest[2].Distance, 1e-9)
+
+	// 只比较内存
+	weights = SimilarityWeights{RAM: 1}
+	nearest = NearestLaptops(NewLaptopFeatures(target), candidates, weights, 10)
+	require.Len(t, nearest, 4)
+	require.Equal(t, laptops[3].GetId(), nearest[3].LaptopID)
+	require.Equal(t, 1.0, nearest[3].Distance)
+
+	require.Empty(t, NearestLaptops(NewLaptopFeatures(target), candidates, weights, 0))
+}
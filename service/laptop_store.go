@@ -14,6 +14,9 @@ import (
 // ErrAlreadyExits ID 存在返回此错误
 var ErrAlreadyExits = errors.New("record already exists")
 
+// ErrLaptopNotFound laptop 不存在返回此错误
+var ErrLaptopNotFound = errors.New("laptop not found")
+
 type LaptopStore interface {
 	// 保存
 	Save(laptop *pb.Laptop) error
@@ -21,6 +24,8 @@ type LaptopStore interface {
 	Find(id string) (*pb.Laptop, error)
 	// 搜索
 	Search(ctx context.Context, filter *pb.Filter, found func(laptop *pb.Laptop) error) error
+	// 在锁内修改 laptop, update 返回错误时不保存, 返回修改后的 laptop
+	Update(id string, update func(laptop *pb.Laptop) error) (*pb.Laptop, error)
 }
 
 type InMemoryLaptopStore struct {
@@ -97,6 +102,30 @@ func (store *InMemoryLaptopStore) Search(ctx context.Context, filter *pb.Filter,
 	return nil
 }
 
+func (store *InMemoryLaptopStore) Update(id string, update func(laptop *pb.Laptop) error) (*pb.Laptop, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	laptop := store.data[id]
+	if laptop == nil {
+		return nil, ErrLaptopNotFound
+	}
+
+	// 修改副本, 失败时不影响已保存的数据
+	other, err := deepCopy(laptop)
+	if err != nil {
+		return nil, err
+	}
+	err = update(other)
+	if err != nil {
+		return nil, err
+	}
+	other.Id = id
+	store.data[id] = other
+
+	return deepCopy(other)
+}
+
 func isQualified(filter *pb.Filter, laptop *pb.Laptop) bool {
 	if laptop.GetPriceUsd() > filter.GetMaxPriceUsd() {
 		return false
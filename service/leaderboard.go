@@ -0,0 +1,78 @@
+package service
+
+import (
+	"sort"
+	"time"
+)
+
+// LeaderboardOptions 排行榜的选项
+type LeaderboardOptions struct {
+	Trending   bool          // 按窗口内评分相对之前的上升幅度排序, 否则按贝叶斯平均排序
+	Window     time.Duration // 只统计窗口内的评分, 0 表示所有时间
+	MinRatings uint32        // 窗口内最少的评分数量
+	Limit      int           // 0 表示不限制
+	Now        time.Time
+}
+
+// LeaderboardEntry 排行榜中的一台 laptop
+type LeaderboardEntry struct {
+	LaptopID     string
+	Score        float64 // 排序使用的分数
+	RatedCount   uint32  // 窗口内的评分数量
+	AverageScore float64 // 窗口内的平均分
+}
+
+// RankLaptops 根据每台 laptop 的用户评分生成排行榜
+//
+// 上升幅度为窗口内评分的贝叶斯平均减去窗口之前评分的贝叶斯平均, 窗口之前没有评分时与先验比较
+func RankLaptops(ratings map[string][]*UserRating, prior BayesianPrior, options LeaderboardOptions) []*LeaderboardEntry {
+	since := time.Time{}
+	if options.Window > 0 {
+		since = options.Now.Add(-options.Window)
+	}
+
+	var entries []*LeaderboardEntry
+	for laptopID, userRatings := range ratings {
+		recent := &Rating{}
+		before := &Rating{}
+		for _, userRating := range userRatings {
+			if userRating.RatedAt.Before(since) {
+				before.Count++
+				before.Sum += userRating.Score
+			} else {
+				recent.Count++
+				recent.Sum += userRating.Score
+			}
+		}
+
+		if recent.Count == 0 || recent.Count < options.MinRatings {
+			continue
+		}
+
+		entry := &LeaderboardEntry{
+			LaptopID:     laptopID,
+			Score:        prior.Average(recent),
+			RatedCount:   recent.Count,
+			AverageScore: recent.Average(),
+		}
+		if options.Trending {
+			entry.Score -= prior.Average(before)
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Score != entries[j].Score {
+			return entries[i].Score > entries[j].Score
+		}
+		if entries[i].RatedCount != entries[j].RatedCount {
+			return entries[i].RatedCount > entries[j].RatedCount
+		}
+		return entries[i].LaptopID < entries[j].LaptopID
+	})
+
+	if options.Limit > 0 && len(entries) > options.Limit {
+		entries = entries[:options.Limit]
+	}
+	return entries
+}
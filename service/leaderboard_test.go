@@ -0,0 +1,61 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRankLaptops(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	old := now.Add(-30 * 24 * time.Hour)
+	prior := BayesianPrior{Mean: 5, Weight: 2}
+
+	ratings := map[string][]*UserRating{
+		// 一直很好
+		"laptop-1": {
+			{Score: 9, RatedAt: old},
+			{Score: 9, RatedAt: old},
+			{Score: 9, RatedAt: now},
+			{Score: 9, RatedAt: now},
+		},
+		// 最近明显上升
+		"laptop-2": {
+			{Score: 2, RatedAt: old},
+			{Score: 2, RatedAt: old},
+			{Score: 8, RatedAt: now},
+			{Score: 8, RatedAt: now},
+		},
+		// 只有一个 10 分
+		"laptop-3": {
+			{Score: 10, RatedAt: now},
+		},
+	}
+
+	entries := RankLaptops(ratings, prior, LeaderboardOptions{Now: now})
+	require.Equal(t, []string{"laptop-1", "laptop-3", "laptop-2"}, leaderboardIDs(entries))
+	require.Equal(t, uint32(4), entries[0].RatedCount)
+
+	entries = RankLaptops(ratings, prior, LeaderboardOptions{Now: now, MinRatings: 2})
+	require.Equal(t, []string{"laptop-1", "laptop-2"}, leaderboardIDs(entries))
+
+	week := 7 * 24 * time.Hour
+	entries = RankLaptops(ratings, prior, LeaderboardOptions{Now: now, Window: week, Trending: true})
+	require.Equal(t, []string{"laptop-2", "laptop-3", "laptop-1"}, leaderboardIDs(entries))
+	require.Equal(t, uint32(2), entries[0].RatedCount)
+	require.Equal(t, 8.0, entries[0].AverageScore)
+
+	entries = RankLaptops(ratings, prior, LeaderboardOptions{Now: now, Window: week, Trending: true, Limit: 1})
+	require.Equal(t, []string{"laptop-2"}, leaderboardIDs(entries))
+}
+
+func leaderboardIDs(entries []*LeaderboardEntry) []string {
+	ids := make([]string, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.LaptopID
+	}
+	return ids
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+var validOrgID = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,31}$`)
+
+// ErrOrganizationNotFound 组织不存在返回此错误
+var ErrOrganizationNotFound = errors.New("organization not found")
+
+// 用户在组织内的角色, 组织管理员可以管理组织的成员和 laptop
+const (
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+// Organization 组织, 每个组织是一个租户, 只能访问自己的 laptop, 评分和图片
+type Organization struct {
+	ID        string
+	Name      string
+	CreatedAt time.Time
+}
+
+func (org *Organization) Clone() *Organization {
+	return &Organization{
+		ID:        org.ID,
+		Name:      org.Name,
+		CreatedAt: org.CreatedAt,
+	}
+}
+
+type OrganizationStore interface {
+	// 保存组织, ID 已存在时返回 ErrAlreadyExits
+	Save(org *Organization) error
+	// 通过 ID 查找组织, 不存在时返回 nil
+	Find(id string) (*Organization, error)
+	// 按 ID 排序返回所有组织
+	List() ([]*Organization, error)
+}
+
+type InMemoryOrganizationStore struct {
+	mutex sync.RWMutex
+	orgs  map[string]*Organization
+}
+
+func NewInMemoryOrganizationStore() *InMemoryOrganizationStore {
+	return &InMemoryOrganizationStore{
+		orgs: make(map[string]*Organization),
+	}
+}
+
+func (store *InMemoryOrganizationStore) Save(org *Organization) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.orgs[org.ID] != nil {
+		return ErrAlreadyExits
+	}
+
+	store.orgs[org.ID] = org.Clone()
+	return nil
+}
+
+func (store *InMemoryOrganizationStore) Find(id string) (*Organization, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	org := store.orgs[id]
+	if org == nil {
+		return nil, nil
+	}
+	return org.Clone(), nil
+}
+
+func (store *InMemoryOrganizationStore) List() ([]*Organization, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	orgs := make([]*Organization, 0, len(store.orgs))
+	for _, org := range store.orgs {
+		orgs = append(orgs, org.Clone())
+	}
+	sort.Slice(orgs, func(i, j int) bool {
+		return orgs[i].ID < orgs[j].ID
+	})
+	return orgs, nil
+}
+
+// ValidateOrgID 组织 ID 为 2 到 32 个小写字母, 数字或 -, 不能以 - 开头
+func ValidateOrgID(id string) error {
+	if !validOrgID.MatchString(id) {
+		return errors.New("org id must be 2 to 32 lowercase letters, digits or '-'")
+	}
+	return nil
+}
+
+// ValidateOrgRole 组织内的角色只能是 admin 或 member, 不属于任何组织时为空
+func ValidateOrgRole(orgID string, orgRole string) error {
+	if len(orgID) == 0 {
+		if len(orgRole) > 0 {
+			return fmt.Errorf("org role %q requires an org", orgRole)
+		}
+		return nil
+	}
+	if orgRole != OrgRoleAdmin && orgRole != OrgRoleMember {
+		return fmt.Errorf("unknown org role %q", orgRole)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// PeerRole 客户端证书身份对应的角色和组织
+type PeerRole struct {
+	Role  string
+	OrgID string
+}
+
+// PeerIdentities 客户端证书身份 -> 角色, 用于服务之间只使用 mTLS 而不使用 JWT 的调用
+//
+// 身份的写法:
+//   - spiffe://trust-domain/path 等 URI, 匹配证书的 URI SAN
+//   - dns:name, 匹配证书的 DNS SAN
+//   - cn:name, 匹配证书 subject 的 CN
+type PeerIdentities map[string]PeerRole
+
+// ParsePeerIdentities 解析 identity=role[@org],... 格式的配置
+func ParsePeerIdentities(value string) (PeerIdentities, error) {
+	identities := make(PeerIdentities)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		// URI 中可能有 =, 角色在最后一个 = 之后
+		i := strings.LastIndex(item, "=")
+		if i <= 0 || i == len(item)-1 {
+			return nil, fmt.Errorf("invalid peer identity %q, expect identity=role[@org]", item)
+		}
+		identity := strings.TrimSpace(item[:i])
+		peerRole := PeerRole{Role: strings.TrimSpace(item[i+1:])}
+		if j := strings.Index(peerRole.Role, "@"); j >= 0 {
+			peerRole.OrgID = peerRole.Role[j+1:]
+			peerRole.Role = peerRole.Role[:j]
+		}
+
+		if !strings.Contains(identity, ":") {
+			return nil, fmt.Errorf("invalid peer identity %q, expect a URI, dns:name or cn:name", identity)
+		}
+		if _, ok := identities[identity]; ok {
+			return nil, fmt.Errorf("duplicate peer identity %q", identity)
+		}
+		identities[identity] = peerRole
+	}
+	return identities, nil
+}
+
+// Lookup 查找连接的客户端证书对应的角色, 依次匹配 URI SAN, DNS SAN 和 CN
+//
+// 只使用 TLS 握手时验证过的证书链, 返回匹配的身份
+func (identities PeerIdentities) Lookup(ctx context.Context) (string, PeerRole, bool) {
+	cert := peerCertificate(ctx)
+	if cert == nil {
+		return "", PeerRole{}, false
+	}
+
+	var candidates []string
+	for _, uri := range cert.URIs {
+		candidates = append(candidates, uri.String())
+	}
+	for _, name := range cert.DNSNames {
+		candidates = append(candidates, "dns:"+name)
+	}
+	if len(cert.Subject.CommonName) > 0 {
+		candidates = append(candidates, "cn:"+cert.Subject.CommonName)
+	}
+
+	for _, identity := range candidates {
+		if peerRole, ok := identities[identity]; ok {
+			return identity, peerRole, true
+		}
+	}
+	return "", PeerRole{}, false
+}
+
+// peerCertificate 返回验证过的客户端证书, 没有使用 TLS 或没有验证客户端证书时返回 nil
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
+	chains := tlsInfo.State.VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+	return chains[0][0]
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func contextWithPeerCertificate(cert *x509.Certificate, verified bool) context.Context {
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if verified {
+		state.VerifiedChains = [][]*x509.Certificate{{cert}}
+	}
+	return peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+}
+
+func TestParsePeerIdentities(t *testing.T) {
+	t.Parallel()
+
+	peers, err := ParsePeerIdentities("spiffe://pcbook/worker=admin, cn:ci-runner=user@acme,")
+	require.NoError(t, err)
+	require.Equal(t, PeerIdentities{
+		"spiffe://pcbook/worker": {Role: "admin"},
+		"cn:ci-runner":           {Role: "user", OrgID: "acme"},
+	}, peers)
+
+	invalid := []string{"ci-runner=user", "cn:ci-runner", "cn:ci-runner=", "=user", "cn:a=user,cn:a=admin"}
+	for _, value := range invalid {
+		_, err := ParsePeerIdentities(value)
+		require.Error(t, err, value)
+	}
+}
+
+func TestAuthInterceptorPeerIdentities(t *testing.T) {
+	t.Parallel()
+
+	policy, err := ParseRBACPolicy([]byte(testRBACPolicy))
+	require.NoError(t, err)
+	peers, err := ParsePeerIdentities("spiffe://pcbook/worker=admin,dns:ci.pcbook.local=user@acme,cn:reporter=guest")
+	require.NoError(t, err)
+
+	jwtManager := NewJWTManager("secret", time.Minute)
+	interceptor := NewAuthInterceptor(jwtManager, nil, WithAccessPolicy(policy), WithPeerIdentities(peers))
+
+	spiffeID, err := url.Parse("spiffe://pcbook/worker")
+	require.NoError(t, err)
+	worker := &x509.Certificate{Subject: pkix.Name{CommonName: "ci-runner"}, URIs: []*url.URL{spiffeID}}
+
+	// URI SAN 优先于 CN
+	claims, err := interceptor.authorize(contextWithPeerCertificate(worker, true), "/pcbook.LaptopService/CreateLaptop")
+	require.NoError(t, err)
+	require.Equal(t, "spiffe://pcbook/worker", claims.Username)
+	require.Equal(t, "admin", claims.Role)
+
+	ci := &x509.Certificate{DNSNames: []string{"ci.pcbook.local"}}
+	claims, err = interceptor.authorize(contextWithPeerCertificate(ci, true), "/pcbook.LaptopService/RateLaptop")
+	require.NoError(t, err)
+	require.Equal(t, "acme", claims.OrgID)
+	_, err = interceptor.authorize(contextWithPeerCertificate(ci, true), "/pcbook.LaptopService/CreateLaptop")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// 角色没有权限, 证书没有验证过或没有对应的角色
+	reporter := &x509.Certificate{Subject: pkix.Name{CommonName: "reporter"}}
+	_, err = interceptor.authorize(contextWithPeerCertificate(reporter, true), "/pcbook.LaptopService/RateLaptop")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = interceptor.authorize(contextWithPeerCertificate(worker, false), "/pcbook.LaptopService/RateLaptop")
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	unknown := &x509.Certificate{Subject: pkix.Name{CommonName: "unknown"}}
+	_, err = interceptor.authorize(contextWithPeerCertificate(unknown, true), "/pcbook.LaptopService/RateLaptop")
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// 有 access token 时使用 token 的用户
+	user, err := NewUser("alice", "password1", "user")
+	require.NoError(t, err)
+	accessToken, err := jwtManager.Generate(user)
+	require.NoError(t, err)
+	ctx := metadata.NewIncomingContext(contextWithPeerCertificate(worker, true), metadata.Pairs("authorization", accessToken))
+	claims, err = interceptor.authorize(ctx, "/pcbook.LaptopService/RateLaptop")
+	require.NoError(t, err)
+	require.Equal(t, "alice", claims.Username)
+}
@@ -0,0 +1,175 @@
+package service
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PriceAlert 用户设置的降价提醒, 价格从不低于目标价降到目标价以下时通知
+type PriceAlert struct {
+	Username    string
+	LaptopID    string
+	TargetPrice float64
+	CreatedAt   time.Time
+}
+
+// PriceNotification 一次降价通知
+type PriceNotification struct {
+	ID          string
+	Username    string
+	LaptopID    string
+	OldPrice    float64
+	NewPrice    float64
+	TargetPrice float64
+	NotifiedAt  time.Time
+}
+
+// PriceAlertHub 保存降价提醒, 并把通知发送给正在监听的用户
+//
+// 用户没有在监听时通知暂存起来, 下次开始监听时发送, 每个用户最多暂存 maxPending 条
+type PriceAlertHub struct {
+	mutex       sync.Mutex
+	maxPending  int
+	alerts      map[string]map[string]*PriceAlert // laptop id -> username -> alert
+	subscribers map[string]map[chan *PriceNotification]bool
+	pending     map[string][]*PriceNotification
+}
+
+// NewPriceAlertHub 创建实例
+func NewPriceAlertHub(maxPending int) *PriceAlertHub {
+	return &PriceAlertHub{
+		maxPending:  maxPending,
+		alerts:      make(map[string]map[string]*PriceAlert),
+		subscribers: make(map[string]map[chan *PriceNotification]bool),
+		pending:     make(map[string][]*PriceNotification),
+	}
+}
+
+// SetAlert 设置或替换用户对 laptop 的提醒, 目标价不大于 0 时删除提醒并返回 nil
+func (hub *PriceAlertHub) SetAlert(username string, laptopID string, targetPrice float64) *PriceAlert {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	if targetPrice <= 0 {
+		delete(hub.alerts[laptopID], username)
+		if len(hub.alerts[laptopID]) == 0 {
+			delete(hub.alerts, laptopID)
+		}
+		return nil
+	}
+
+	alert := &PriceAlert{
+		Username:    username,
+		LaptopID:    laptopID,
+		TargetPrice: targetPrice,
+		CreatedAt:   time.Now(),
+	}
+	if hub.alerts[laptopID] == nil {
+		hub.alerts[laptopID] = make(map[string]*PriceAlert)
+	}
+	hub.alerts[laptopID][username] = alert
+
+	other := *alert
+	return &other
+}
+
+// ListAlerts 返回用户的所有提醒, 按 laptop id 排序
+func (hub *PriceAlertHub) ListAlerts(username string) []*PriceAlert {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	var alerts []*PriceAlert
+	for _, users := range hub.alerts {
+		if alert := users[username]; alert != nil {
+			other := *alert
+			alerts = append(alerts, &other)
+		}
+	}
+
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].LaptopID < alerts[j].LaptopID
+	})
+	return alerts
+}
+
+// PriceChanged 价格变更后通知目标价被跌破的用户, 返回发出的通知
+func (hub *PriceAlertHub) PriceChanged(change *PriceChange) []*PriceNotification {
+	if !change.HasOldPrice || change.NewPrice >= change.OldPrice {
+		return nil
+	}
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	var notifications []*PriceNotification
+	for username, alert := range hub.alerts[change.LaptopID] {
+		if change.OldPrice < alert.TargetPrice || change.NewPrice >= alert.TargetPrice {
+			continue
+		}
+
+		notification := &PriceNotification{
+			ID:          uuid.New().String(),
+			Username:    username,
+			LaptopID:    change.LaptopID,
+			OldPrice:    change.OldPrice,
+			NewPrice:    change.NewPrice,
+			TargetPrice: alert.TargetPrice,
+			NotifiedAt:  change.ChangedAt,
+		}
+		hub.notify(notification)
+		notifications = append(notifications, notification)
+	}
+	return notifications
+}
+
+// Subscribe 开始监听用户的通知, 先收到暂存的通知, 不再监听时调用返回的函数
+func (hub *PriceAlertHub) Subscribe(username string) (<-chan *PriceNotification, func()) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	ch := make(chan *PriceNotification, hub.maxPending)
+	for _, notification := range hub.pending[username] {
+		ch <- notification
+	}
+	delete(hub.pending, username)
+
+	if hub.subscribers[username] == nil {
+		hub.subscribers[username] = make(map[chan *PriceNotification]bool)
+	}
+	hub.subscribers[username][ch] = true
+
+	cancel := func() {
+		hub.mutex.Lock()
+		defer hub.mutex.Unlock()
+
+		delete(hub.subscribers[username], ch)
+		if len(hub.subscribers[username]) == 0 {
+			delete(hub.subscribers, username)
+		}
+	}
+	return ch, cancel
+}
+
+// notify 调用方需持有锁, 没有监听者或监听者来不及接收时暂存通知
+func (hub *PriceAlertHub) notify(notification *PriceNotification) {
+	delivered := false
+	for ch := range hub.subscribers[notification.Username] {
+		select {
+		case ch <- notification:
+			delivered = true
+		default:
+		}
+	}
+	if delivered {
+		return
+	}
+
+	pending := append(hub.pending[notification.Username], notification)
+	if len(pending) > hub.maxPending {
+		pending = pending[len(pending)-hub.maxPending:]
+	}
+	hub.pending[notification.Username] = pending
+}
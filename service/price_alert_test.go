@@ -0,0 +1,53 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPriceAlertHub(t *testing.T) {
+	t.Parallel()
+
+	hub := NewPriceAlertHub(2)
+
+	alert := hub.SetAlert("user1", "laptop-1", 1500)
+	require.Equal(t, 1500.0, alert.TargetPrice)
+	hub.SetAlert("user2", "laptop-1", 1000)
+	hub.SetAlert("user1", "laptop-2", 1000)
+	require.Len(t, hub.ListAlerts("user1"), 2)
+
+	notifications, cancel := hub.Subscribe("user1")
+	defer cancel()
+
+	change := &PriceChange{LaptopID: "laptop-1", HasOldPrice: true, OldPrice: 2000, NewPrice: 1400, ChangedAt: time.Now()}
+	sent := hub.PriceChanged(change)
+	require.Len(t, sent, 1)
+	require.Equal(t, "user1", sent[0].Username)
+
+	notification := <-notifications
+	require.Equal(t, "laptop-1", notification.LaptopID)
+	require.Equal(t, 1400.0, notification.NewPrice)
+
+	// 已经低于目标价时继续降价不再通知
+	change = &PriceChange{LaptopID: "laptop-1", HasOldPrice: true, OldPrice: 1400, NewPrice: 1300, ChangedAt: time.Now()}
+	sent = hub.PriceChanged(change)
+	require.Empty(t, sent)
+
+	// 没有监听的用户暂存通知, 超出上限时丢弃最早的
+	for _, price := range []float64{900, 800, 700} {
+		hub.SetAlert("user2", "laptop-1", price+50)
+		change = &PriceChange{LaptopID: "laptop-1", HasOldPrice: true, OldPrice: price + 100, NewPrice: price, ChangedAt: time.Now()}
+		require.Len(t, hub.PriceChanged(change), 1)
+	}
+
+	pending, cancel2 := hub.Subscribe("user2")
+	defer cancel2()
+	require.Len(t, pending, 2)
+	require.Equal(t, 800.0, (<-pending).NewPrice)
+	require.Equal(t, 700.0, (<-pending).NewPrice)
+
+	require.Nil(t, hub.SetAlert("user1", "laptop-1", 0))
+	require.Len(t, hub.ListAlerts("user1"), 1)
+}
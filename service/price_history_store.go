@@ -0,0 +1,56 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// PriceChange laptop 价格的一次变更
+type PriceChange struct {
+	LaptopID    string
+	OldPrice    float64
+	NewPrice    float64
+	HasOldPrice bool // 创建 laptop 时没有之前的价格
+	Actor       string
+	ChangedAt   time.Time
+}
+
+type PriceHistoryStore interface {
+	// 记录一次价格变更
+	Record(change *PriceChange) error
+	// 返回 laptop 的价格变更, 按时间升序
+	List(laptopID string) ([]*PriceChange, error)
+}
+
+type InMemoryPriceHistoryStore struct {
+	mutex   sync.RWMutex
+	changes map[string][]*PriceChange
+}
+
+// NewInMemoryPriceHistoryStore 创建 InMemoryPriceHistoryStore 实例
+func NewInMemoryPriceHistoryStore() *InMemoryPriceHistoryStore {
+	return &InMemoryPriceHistoryStore{
+		changes: make(map[string][]*PriceChange),
+	}
+}
+
+func (store *InMemoryPriceHistoryStore) Record(change *PriceChange) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	other := *change
+	store.changes[change.LaptopID] = append(store.changes[change.LaptopID], &other)
+	return nil
+}
+
+func (store *InMemoryPriceHistoryStore) List(laptopID string) ([]*PriceChange, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var changes []*PriceChange
+	for _, change := range store.changes[laptopID] {
+		other := *change
+		changes = append(changes, &other)
+	}
+	return changes, nil
+}
@@ -0,0 +1,269 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrRateLimited 用户评分过于频繁返回此错误
+	ErrRateLimited = errors.New("too many ratings")
+	// ErrFlagNotFound 标记不存在返回此错误
+	ErrFlagNotFound = errors.New("rating flag not found")
+)
+
+// RatingGuardConfig 评分防刷配置, 0 表示不限制
+type RatingGuardConfig struct {
+	MaxRatingsPerUser int           // 每个用户在 RateWindow 内最多的评分次数
+	RateWindow        time.Duration // 限制评分频率的时间窗口
+	BurstThreshold    int           // 同一台 laptop 在 BurstWindow 内出现这么多极端分数时标记
+	BurstWindow       time.Duration // 检测极端分数的时间窗口
+	ExtremeMargin     float64       // 与最低分或最高分相差不超过此值的分数为极端分数
+	AutoExclude       bool          // 标记的评分自动不计入汇总
+}
+
+// RatingFlagStatus 标记的处理状态
+type RatingFlagStatus int
+
+const (
+	RatingFlagOpen      RatingFlagStatus = iota + 1 // 等待管理员处理
+	RatingFlagExcluded                              // 评分不计入汇总
+	RatingFlagDismissed                             // 误报, 评分计入汇总
+)
+
+func (s RatingFlagStatus) String() string {
+	switch s {
+	case RatingFlagOpen:
+		return "open"
+	case RatingFlagExcluded:
+		return "excluded"
+	case RatingFlagDismissed:
+		return "dismissed"
+	default:
+		return "unknown"
+	}
+}
+
+// RatingFlag 被怀疑刷分的评分
+type RatingFlag struct {
+	ID        string
+	LaptopID  string
+	Username  string
+	Score     float64
+	Reason    string
+	FlaggedAt time.Time
+	Status    RatingFlagStatus
+}
+
+// RatingGuard 限制评分频率并检测短时间内集中出现的极端分数
+type RatingGuard struct {
+	mutex   sync.Mutex
+	config  RatingGuardConfig
+	policy  RatingPolicy
+	users   map[string][]time.Time      // username -> 评分时间
+	extreme map[string][]*extremeRating // laptop id -> 极端评分
+	flags   map[string]*RatingFlag      // flag id -> flag
+	open    map[string]*RatingFlag      // laptop id + username -> 未撤销的 flag
+}
+
+type extremeRating struct {
+	username string
+	score    float64
+	ratedAt  time.Time
+}
+
+// NewRatingGuard 创建实例, policy 用于判断极端分数
+func NewRatingGuard(config RatingGuardConfig, policy RatingPolicy) *RatingGuard {
+	return &RatingGuard{
+		config:  config,
+		policy:  policy,
+		users:   make(map[string][]time.Time),
+		extreme: make(map[string][]*extremeRating),
+		flags:   make(map[string]*RatingFlag),
+		open:    make(map[string]*RatingFlag),
+	}
+}
+
+// Config 返回配置
+func (guard *RatingGuard) Config() RatingGuardConfig {
+	return guard.config
+}
+
+// Allow 检查用户是否可以再评分一次, 可以时记录这次评分
+func (guard *RatingGuard) Allow(username string, now time.Time) error {
+	if guard.config.MaxRatingsPerUser <= 0 || guard.config.RateWindow <= 0 {
+		return nil
+	}
+
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	since := now.Add(-guard.config.RateWindow)
+	times := guard.users[username]
+	for len(times) > 0 && !times[0].After(since) {
+		times = times[1:]
+	}
+
+	if len(times) >= guard.config.MaxRatingsPerUser {
+		guard.users[username] = times
+		retryAfter := times[0].Add(guard.config.RateWindow).Sub(now)
+		return fmt.Errorf("%w: at most %d ratings per %v, retry after %v",
+			ErrRateLimited, guard.config.MaxRatingsPerUser, guard.config.RateWindow, retryAfter.Round(time.Second))
+	}
+
+	guard.users[username] = append(times, now)
+	return nil
+}
+
+// Observe 记录一次成功的评分, 返回新标记的评分
+func (guard *RatingGuard) Observe(laptopID string, username string, score float64, now time.Time) []*RatingFlag {
+	if guard.config.BurstThreshold <= 0 || guard.config.BurstWindow <= 0 {
+		return nil
+	}
+
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	since := now.Add(-guard.config.BurstWindow)
+	var recent []*extremeRating
+	for _, r := range guard.extreme[laptopID] {
+		// 同一个用户重新评分时只保留最后一次
+		if r.ratedAt.After(since) && r.username != username {
+			recent = append(recent, r)
+		}
+	}
+	if guard.isExtreme(score) {
+		recent = append(recent, &extremeRating{username: username, score: score, ratedAt: now})
+	}
+	guard.extreme[laptopID] = recent
+
+	if len(recent) < guard.config.BurstThreshold {
+		return nil
+	}
+
+	reason := fmt.Sprintf("%d extreme scores within %v", len(recent), guard.config.BurstWindow)
+	var flags []*RatingFlag
+	for _, r := range recent {
+		key := ratingKey(laptopID, r.username)
+		if guard.open[key] != nil {
+			continue
+		}
+
+		flag := &RatingFlag{
+			ID:        uuid.New().String(),
+			LaptopID:  laptopID,
+			Username:  r.username,
+			Score:     r.score,
+			Reason:    reason,
+			FlaggedAt: now,
+			Status:    RatingFlagOpen,
+		}
+		if guard.config.AutoExclude {
+			flag.Status = RatingFlagExcluded
+		}
+
+		guard.flags[flag.ID] = flag
+		guard.open[key] = flag
+
+		other := *flag
+		flags = append(flags, &other)
+	}
+	return flags
+}
+
+// addRating 保存一次成功的评分并检测刷分, 自动排除时同时排除被标记的评分, 返回 laptop 的评分
+//
+// 调用方需要先使用 Allow 限制频率
+func (guard *RatingGuard) addRating(ratings RatingStore, laptopID string, username string, score float64, now time.Time) (*Rating, error) {
+	rating, err := ratings.Add(laptopID, username, score)
+	if err != nil {
+		return nil, fmt.Errorf("cannot add rating to the store: %w", err)
+	}
+
+	for _, flag := range guard.Observe(laptopID, username, score, now) {
+		log.Printf("flagged rating: laptop = %s, user = %s, score = %.2f, %s", flag.LaptopID, flag.Username, flag.Score, flag.Reason)
+		if flag.Status != RatingFlagExcluded {
+			continue
+		}
+
+		rating, err = ratings.SetExcluded(flag.LaptopID, flag.Username, true)
+		if err != nil {
+			return nil, fmt.Errorf("cannot exclude rating: %w", err)
+		}
+	}
+	return rating, nil
+}
+
+// ListFlags 返回标记, 按标记时间倒序
+func (guard *RatingGuard) ListFlags(includeResolved bool) []*RatingFlag {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	var flags []*RatingFlag
+	for _, flag := range guard.flags {
+		if !includeResolved && flag.Status != RatingFlagOpen {
+			continue
+		}
+
+		other := *flag
+		flags = append(flags, &other)
+	}
+
+	sort.Slice(flags, func(i, j int) bool {
+		if !flags[i].FlaggedAt.Equal(flags[j].FlaggedAt) {
+			return flags[i].FlaggedAt.After(flags[j].FlaggedAt)
+		}
+		return flags[i].ID < flags[j].ID
+	})
+	return flags
+}
+
+// FindFlag 返回 flag, 不存在时返回 nil
+func (guard *RatingGuard) FindFlag(flagID string) *RatingFlag {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	flag := guard.flags[flagID]
+	if flag == nil {
+		return nil
+	}
+	other := *flag
+	return &other
+}
+
+// Resolve 修改标记的处理状态
+func (guard *RatingGuard) Resolve(flagID string, status RatingFlagStatus) (*RatingFlag, error) {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	flag := guard.flags[flagID]
+	if flag == nil {
+		return nil, ErrFlagNotFound
+	}
+
+	flag.Status = status
+
+	// 误报的标记处理后, 同一个用户的评分可以再次被标记
+	key := ratingKey(flag.LaptopID, flag.Username)
+	if guard.open[key] == flag && status == RatingFlagDismissed {
+		delete(guard.open, key)
+	}
+
+	other := *flag
+	return &other, nil
+}
+
+func (guard *RatingGuard) isExtreme(score float64) bool {
+	return score <= guard.policy.MinScore+guard.config.ExtremeMargin ||
+		score >= guard.policy.MaxScore-guard.config.ExtremeMargin
+}
+
+func ratingKey(laptopID string, username string) string {
+	return laptopID + "/" + username
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRatingGuardAllow(t *testing.T) {
+	t.Parallel()
+
+	guard := NewRatingGuard(RatingGuardConfig{
+		MaxRatingsPerUser: 2,
+		RateWindow:        time.Minute,
+	}, DefaultRatingPolicy)
+
+	now := time.Now()
+	require.NoError(t, guard.Allow("user1", now))
+	require.NoError(t, guard.Allow("user1", now.Add(10*time.Second)))
+	require.ErrorIs(t, guard.Allow("user1", now.Add(20*time.Second)), ErrRateLimited)
+
+	// 其他用户不受影响
+	require.NoError(t, guard.Allow("user2", now.Add(20*time.Second)))
+
+	// 窗口过去后可以再次评分
+	require.NoError(t, guard.Allow("user1", now.Add(61*time.Second)))
+}
+
+func TestRatingGuardObserve(t *testing.T) {
+	t.Parallel()
+
+	guard := NewRatingGuard(RatingGuardConfig{
+		BurstThreshold: 3,
+		BurstWindow:    time.Minute,
+		ExtremeMargin:  1,
+	}, DefaultRatingPolicy)
+
+	now := time.Now()
+	require.Empty(t, guard.Observe("laptop-1", "user1", 1, now))
+	require.Empty(t, guard.Observe("laptop-1", "user2", 5, now))
+	require.Empty(t, guard.Observe("laptop-1", "user3", 2, now))
+	// 其他 laptop 的极端分数不计入
+	require.Empty(t, guard.Observe("laptop-2", "user4", 1, now))
+
+	flags := guard.Observe("laptop-1", "user4", 10, now.Add(time.Second))
+	require.Len(t, flags, 3)
+	for _, flag := range flags {
+		require.Equal(t, "laptop-1", flag.LaptopID)
+		require.Equal(t, RatingFlagOpen, flag.Status)
+		require.NotEqual(t, "user2", flag.Username)
+	}
+
+	// 已标记的评分不会重复标记
+	flags = guard.Observe("laptop-1", "user5", 1, now.Add(2*time.Second))
+	require.Len(t, flags, 1)
+	require.Equal(t, "user5", flags[0].Username)
+
+	require.Len(t, guard.ListFlags(false), 4)
+
+	flag, err := guard.Resolve(flags[0].ID, RatingFlagDismissed)
+	require.NoError(t, err)
+	require.Equal(t, RatingFlagDismissed, flag.Status)
+	require.Len(t, guard.ListFlags(false), 3)
+	require.Len(t, guard.ListFlags(true), 4)
+
+	_, err = guard.Resolve("unknown", RatingFlagExcluded)
+	require.ErrorIs(t, err, ErrFlagNotFound)
+
+	// 窗口过去后重新统计
+	require.Empty(t, guard.Observe("laptop-1", "user6", 1, now.Add(2*time.Minute)))
+}
+
+func TestRatingGuardAutoExclude(t *testing.T) {
+	t.Parallel()
+
+	guard := NewRatingGuard(RatingGuardConfig{
+		BurstThreshold: 2,
+		BurstWindow:    time.Minute,
+		AutoExclude:    true,
+	}, DefaultRatingPolicy)
+
+	now := time.Now()
+	require.Empty(t, guard.Observe("laptop-1", "user1", 10, now))
+	flags := guard.Observe("laptop-1", "user2", 10, now)
+	require.Len(t, flags, 2)
+	for _, flag := range flags {
+		require.Equal(t, RatingFlagExcluded, flag.Status)
+	}
+	require.Empty(t, guard.ListFlags(false))
+}
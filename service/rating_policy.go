@@ -0,0 +1,95 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidScore 分数不符合评分规则返回此错误
+var ErrInvalidScore = errors.New("invalid score")
+
+// RatingPolicy 评分规则, 分数必须在 [MinScore, MaxScore] 之间且是 MinScore 加 Step 的整数倍
+type RatingPolicy struct {
+	MinScore float64
+	MaxScore float64
+	Step     float64 // 0 表示不限制
+}
+
+// DefaultRatingPolicy 默认 1-10 的整数分
+var DefaultRatingPolicy = RatingPolicy{MinScore: 1, MaxScore: 10, Step: 1}
+
+// ParseRatingPolicy 解析 "min-max/step" 格式的评分规则, 如 "1-5/0.5", step 可以省略
+func ParseRatingPolicy(s string) (RatingPolicy, error) {
+	policy := RatingPolicy{}
+
+	scale := s
+	if i := strings.Index(s, "/"); i >= 0 {
+		step, err := strconv.ParseFloat(strings.TrimSpace(s[i+1:]), 64)
+		if err != nil {
+			return policy, fmt.Errorf("invalid rating step %q: %w", s, err)
+		}
+		policy.Step = step
+		scale = s[:i]
+	}
+
+	bounds := strings.SplitN(scale, "-", 2)
+	if len(bounds) != 2 {
+		return policy, fmt.Errorf("invalid rating scale %q: expected min-max", s)
+	}
+
+	minScore, err := strconv.ParseFloat(strings.TrimSpace(bounds[0]), 64)
+	if err != nil {
+		return policy, fmt.Errorf("invalid rating min score %q: %w", s, err)
+	}
+	maxScore, err := strconv.ParseFloat(strings.TrimSpace(bounds[1]), 64)
+	if err != nil {
+		return policy, fmt.Errorf("invalid rating max score %q: %w", s, err)
+	}
+	policy.MinScore = minScore
+	policy.MaxScore = maxScore
+
+	err = policy.validatePolicy()
+	if err != nil {
+		return policy, fmt.Errorf("invalid rating scale %q: %w", s, err)
+	}
+	return policy, nil
+}
+
+// Validate 检查分数是否符合评分规则
+func (policy RatingPolicy) Validate(score float64) error {
+	if math.IsNaN(score) || math.IsInf(score, 0) {
+		return fmt.Errorf("%w: %v is not a finite number", ErrInvalidScore, score)
+	}
+
+	if score < policy.MinScore || score > policy.MaxScore {
+		return fmt.Errorf("%w: %v is out of range [%v, %v]", ErrInvalidScore, score, policy.MinScore, policy.MaxScore)
+	}
+
+	if policy.Step > 0 {
+		steps := (score - policy.MinScore) / policy.Step
+		if math.Abs(steps-math.Round(steps)) > 1e-9 {
+			return fmt.Errorf("%w: %v is not a multiple of step %v", ErrInvalidScore, score, policy.Step)
+		}
+	}
+
+	return nil
+}
+
+func (policy RatingPolicy) validatePolicy() error {
+	for _, v := range []float64{policy.MinScore, policy.MaxScore, policy.Step} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return errors.New("values must be finite numbers")
+		}
+	}
+
+	if policy.MinScore >= policy.MaxScore {
+		return errors.New("min score must be less than max score")
+	}
+	if policy.Step < 0 {
+		return errors.New("step must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package service
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRatingPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy, err := ParseRatingPolicy("1-5/0.5")
+	require.NoError(t, err)
+	require.Equal(t, RatingPolicy{MinScore: 1, MaxScore: 5, Step: 0.5}, policy)
+
+	policy, err = ParseRatingPolicy("0-100")
+	require.NoError(t, err)
+	require.Equal(t, RatingPolicy{MinScore: 0, MaxScore: 100}, policy)
+
+	for _, s := range []string{"", "5", "5-1", "1-5/-1", "a-5", "1-5/x", "1-NaN"} {
+		_, err = ParseRatingPolicy(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestRatingPolicyValidate(t *testing.T) {
+	t.Parallel()
+
+	stars := RatingPolicy{MinScore: 1, MaxScore: 5, Step: 0.5}
+	for _, score := range []float64{1, 1.5, 3, 4.5, 5} {
+		require.NoError(t, stars.Validate(score))
+	}
+	for _, score := range []float64{0, 0.5, 1.25, 5.5, -1, 1e300, math.NaN(), math.Inf(1)} {
+		require.ErrorIs(t, stars.Validate(score), ErrInvalidScore)
+	}
+
+	require.NoError(t, DefaultRatingPolicy.Validate(10))
+	require.ErrorIs(t, DefaultRatingPolicy.Validate(7.5), ErrInvalidScore)
+
+	free := RatingPolicy{MinScore: 0, MaxScore: 1}
+	require.NoError(t, free.Validate(0.123))
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BayesianPrior 贝叶斯平均的先验, 相当于每台 laptop 预先有 Weight 个 Mean 分的评分
+type BayesianPrior struct {
+	Mean   float64
+	Weight float64
+}
+
+// DefaultBayesianPrior 默认以评分区间的中点为先验, 权重为 5 个评分
+func DefaultBayesianPrior(policy RatingPolicy) BayesianPrior {
+	return BayesianPrior{
+		Mean:   (policy.MinScore + policy.MaxScore) / 2,
+		Weight: 5,
+	}
+}
+
+// Average 贝叶斯平均, 评分越少越接近先验
+func (prior BayesianPrior) Average(rating *Rating) float64 {
+	weight := prior.Weight + float64(rating.Count)
+	if weight <= 0 {
+		return 0
+	}
+	return (prior.Weight*prior.Mean + rating.Sum) / weight
+}
+
+// RatingBucket 直方图中一个分数的评分数量
+type RatingBucket struct {
+	Score float64
+	Count uint32
+}
+
+// RatingStats laptop 的评分统计
+type RatingStats struct {
+	Count           uint32
+	Mean            float64
+	Median          float64
+	StdDev          float64 // 总体标准差
+	BayesianAverage float64
+	Histogram       []RatingBucket
+}
+
+// NewRatingStats 根据所有评分计算统计信息
+//
+// 评分规则有 Step 时直方图包含区间内的每个分数, 否则只包含出现过的分数
+func NewRatingStats(scores []float64, policy RatingPolicy, prior BayesianPrior) *RatingStats {
+	sorted := append([]float64(nil), scores...)
+	sort.Float64s(sorted)
+
+	rating := &Rating{Count: uint32(len(sorted))}
+	for _, score := range sorted {
+		rating.Sum += score
+	}
+
+	stats := &RatingStats{
+		Count:           rating.Count,
+		Mean:            rating.Average(),
+		BayesianAverage: prior.Average(rating),
+		Histogram:       ratingHistogram(sorted, policy),
+	}
+
+	n := len(sorted)
+	if n == 0 {
+		return stats
+	}
+
+	if n%2 == 1 {
+		stats.Median = sorted[n/2]
+	} else {
+		stats.Median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+
+	variance := 0.0
+	for _, score := range sorted {
+		variance += (score - stats.Mean) * (score - stats.Mean)
+	}
+	stats.StdDev = math.Sqrt(variance / float64(n))
+
+	return stats
+}
+
+// ratingHistogram sorted 需已排序
+func ratingHistogram(sorted []float64, policy RatingPolicy) []RatingBucket {
+	var histogram []RatingBucket
+
+	if policy.Step > 0 {
+		buckets := int(math.Round((policy.MaxScore-policy.MinScore)/policy.Step)) + 1
+		histogram = make([]RatingBucket, buckets)
+		for i := range histogram {
+			histogram[i].Score = policy.MinScore + float64(i)*policy.Step
+		}
+		for _, score := range sorted {
+			i := int(math.Round((score - policy.MinScore) / policy.Step))
+			if i >= 0 && i < buckets {
+				histogram[i].Count++
+			}
+		}
+		return histogram
+	}
+
+	for _, score := range sorted {
+		last := len(histogram) - 1
+		if last >= 0 && histogram[last].Score == score {
+			histogram[last].Count++
+			continue
+		}
+		histogram = append(histogram, RatingBucket{Score: score, Count: 1})
+	}
+	return histogram
+}
+
+// ParseBayesianPrior 解析 "mean:weight" 格式的先验, 如 "7:10"
+func ParseBayesianPrior(s string) (BayesianPrior, error) {
+	prior := BayesianPrior{}
+
+	values := strings.SplitN(s, ":", 2)
+	if len(values) != 2 {
+		return prior, fmt.Errorf("invalid bayesian prior %q: expected mean:weight", s)
+	}
+
+	mean, err := strconv.ParseFloat(strings.TrimSpace(values[0]), 64)
+	if err != nil || math.IsNaN(mean) || math.IsInf(mean, 0) {
+		return prior, fmt.Errorf("invalid bayesian prior mean %q", s)
+	}
+	weight, err := strconv.ParseFloat(strings.TrimSpace(values[1]), 64)
+	if err != nil || math.IsNaN(weight) || math.IsInf(weight, 0) || weight < 0 {
+		return prior, fmt.Errorf("invalid bayesian prior weight %q", s)
+	}
+
+	prior.Mean = mean
+	prior.Weight = weight
+	return prior, nil
+}
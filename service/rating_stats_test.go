@@ -0,0 +1,63 @@
+package service
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRatingStats(t *testing.T) {
+	t.Parallel()
+
+	policy := RatingPolicy{MinScore: 1, MaxScore: 5, Step: 1}
+	prior := BayesianPrior{Mean: 3, Weight: 2}
+
+	stats := NewRatingStats([]float64{5, 1, 4, 4}, policy, prior)
+	require.Equal(t, uint32(4), stats.Count)
+	require.Equal(t, 3.5, stats.Mean)
+	require.Equal(t, 4.0, stats.Median)
+	require.InDelta(t, math.Sqrt(2.25), stats.StdDev, 1e-9)
+	require.InDelta(t, 20.0/6, stats.BayesianAverage, 1e-9)
+	require.Equal(t, []RatingBucket{
+		{Score: 1, Count: 1},
+		{Score: 2, Count: 0},
+		{Score: 3, Count: 0},
+		{Score: 4, Count: 2},
+		{Score: 5, Count: 1},
+	}, stats.Histogram)
+
+	// 没有评分时贝叶斯平均等于先验
+	stats = NewRatingStats(nil, policy, prior)
+	require.Equal(t, uint32(0), stats.Count)
+	require.Equal(t, 3.0, stats.BayesianAverage)
+
+	// 没有 Step 时只统计出现过的分数
+	stats = NewRatingStats([]float64{0.7, 0.2, 0.7}, RatingPolicy{MinScore: 0, MaxScore: 1}, prior)
+	require.Equal(t, 0.7, stats.Median)
+	require.Equal(t, []RatingBucket{{Score: 0.2, Count: 1}, {Score: 0.7, Count: 2}}, stats.Histogram)
+}
+
+func TestBayesianPriorRanking(t *testing.T) {
+	t.Parallel()
+
+	prior := DefaultBayesianPrior(DefaultRatingPolicy)
+
+	// 一个 10 分的评分排在一千个 9 分的评分之后
+	single := prior.Average(&Rating{Count: 1, Sum: 10})
+	many := prior.Average(&Rating{Count: 1000, Sum: 9000})
+	require.Less(t, single, many)
+}
+
+func TestParseBayesianPrior(t *testing.T) {
+	t.Parallel()
+
+	prior, err := ParseBayesianPrior("7:10")
+	require.NoError(t, err)
+	require.Equal(t, BayesianPrior{Mean: 7, Weight: 10}, prior)
+
+	for _, s := range []string{"", "7", "x:1", "7:-1", "7:NaN"} {
+		_, err = ParseBayesianPrior(s)
+		require.Error(t, err, s)
+	}
+}
@@ -1,43 +1,238 @@
 package service
 
-import "sync"
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRatingNotFound 用户没有评分返回此错误
+var ErrRatingNotFound = errors.New("rating not found")
 
 type RatingStore interface {
-	Add(laptopID string, score float64) (*Rating, error)
+	// 添加或替换用户对 laptop 的评分, 返回 laptop 的评分汇总
+	Add(laptopID string, username string, score float64) (*Rating, error)
+	// 删除用户对 laptop 的评分, 返回 laptop 的评分汇总
+	Remove(laptopID string, username string) (*Rating, error)
+	// 获取 laptop 的评分汇总, 不包括被排除的评分
+	Find(laptopID string) (*Rating, error)
+	// 获取用户对 laptop 的评分, 没有评分时返回 nil
+	FindUserRating(laptopID string, username string) (*UserRating, error)
+	// 获取 laptop 计入汇总的评分
+	Scores(laptopID string) ([]float64, error)
+	// 获取 laptop 计入汇总的用户评分
+	ListUserRatings(laptopID string) ([]*UserRating, error)
+	// 获取有评分的 laptop id
+	RatedLaptops() ([]string, error)
+	// 设置用户对 laptop 的评分是否不计入汇总, 重新评分后仍然有效, 返回 laptop 的评分汇总
+	SetExcluded(laptopID string, username string, excluded bool) (*Rating, error)
 }
 
+// Rating laptop 的评分汇总
 type Rating struct {
 	Count uint32
 	Sum   float64
 }
 
+// Average 平均分, 没有评分时为 0
+func (rating *Rating) Average() float64 {
+	if rating.Count == 0 {
+		return 0
+	}
+	return rating.Sum / float64(rating.Count)
+}
+
+// UserRating 用户对 laptop 的评分
+type UserRating struct {
+	LaptopID string
+	Username string
+	Score    float64
+	RatedAt  time.Time // 最后一次评分的时间
+	Excluded bool      // 不计入汇总
+}
+
 type InMemoryRatingStore struct {
-	mutex  sync.RWMutex
-	rating map[string]*Rating
+	mutex    sync.RWMutex
+	rating   map[string]*Rating
+	scores   map[string]map[string]*UserRating // laptop id -> username -> rating
+	excluded map[string]bool                   // laptop id + username
+	now      func() time.Time
 }
 
 func NewInMemoryRatingStore() *InMemoryRatingStore {
 	return &InMemoryRatingStore{
-		rating: make(map[string]*Rating),
+		rating:   make(map[string]*Rating),
+		scores:   make(map[string]map[string]*UserRating),
+		excluded: make(map[string]bool),
+		now:      time.Now,
 	}
 }
 
-func (store *InMemoryRatingStore) Add(laptopID string, score float64) (*Rating, error) {
+func (store *InMemoryRatingStore) Add(laptopID string, username string, score float64) (*Rating, error) {
+	return store.addAt(laptopID, username, score, store.now())
+}
+
+// addAt 添加或替换在 ratedAt 时的评分
+func (store *InMemoryRatingStore) addAt(laptopID string, username string, score float64, ratedAt time.Time) (*Rating, error) {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
+	scores := store.scores[laptopID]
+	if scores == nil {
+		scores = make(map[string]*UserRating)
+		store.scores[laptopID] = scores
+	}
+
+	// 重复评分时替换之前的分数
+	if previous, ok := scores[username]; ok {
+		store.subtract(previous)
+	}
+
+	userRating := &UserRating{
+		LaptopID: laptopID,
+		Username: username,
+		Score:    score,
+		RatedAt:  ratedAt,
+		Excluded: store.excluded[ratingKey(laptopID, username)],
+	}
+	scores[username] = userRating
+	store.accumulate(userRating)
+
+	return store.find(laptopID), nil
+}
+
+func (store *InMemoryRatingStore) Remove(laptopID string, username string) (*Rating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	previous, ok := store.scores[laptopID][username]
+	if !ok {
+		return nil, ErrRatingNotFound
+	}
+
+	delete(store.scores[laptopID], username)
+	store.subtract(previous)
+
+	return store.find(laptopID), nil
+}
+
+func (store *InMemoryRatingStore) SetExcluded(laptopID string, username string, excluded bool) (*Rating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	key := ratingKey(laptopID, username)
+	if excluded {
+		store.excluded[key] = true
+	} else {
+		delete(store.excluded, key)
+	}
+
+	if userRating, ok := store.scores[laptopID][username]; ok && userRating.Excluded != excluded {
+		store.subtract(userRating)
+		userRating.Excluded = excluded
+		store.accumulate(userRating)
+	}
+
+	return store.find(laptopID), nil
+}
+
+func (store *InMemoryRatingStore) Find(laptopID string) (*Rating, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.find(laptopID), nil
+}
+
+func (store *InMemoryRatingStore) FindUserRating(laptopID string, username string) (*UserRating, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	userRating, ok := store.scores[laptopID][username]
+	if !ok {
+		return nil, nil
+	}
+
+	other := *userRating
+	return &other, nil
+}
+
+func (store *InMemoryRatingStore) Scores(laptopID string) ([]float64, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	scores := make([]float64, 0, len(store.scores[laptopID]))
+	for _, userRating := range store.scores[laptopID] {
+		if !userRating.Excluded {
+			scores = append(scores, userRating.Score)
+		}
+	}
+	return scores, nil
+}
+
+func (store *InMemoryRatingStore) ListUserRatings(laptopID string) ([]*UserRating, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	userRatings := make([]*UserRating, 0, len(store.scores[laptopID]))
+	for _, userRating := range store.scores[laptopID] {
+		if userRating.Excluded {
+			continue
+		}
+
+		other := *userRating
+		userRatings = append(userRatings, &other)
+	}
+	return userRatings, nil
+}
+
+func (store *InMemoryRatingStore) RatedLaptops() ([]string, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	laptopIDs := make([]string, 0, len(store.rating))
+	for laptopID, rating := range store.rating {
+		if rating.Count > 0 {
+			laptopIDs = append(laptopIDs, laptopID)
+		}
+	}
+	return laptopIDs, nil
+}
+
+// find 调用方需持有锁
+func (store *InMemoryRatingStore) find(laptopID string) *Rating {
 	rating := store.rating[laptopID]
 	if rating == nil {
-		rating = &Rating{
-			Count: 1,
-			Sum:   score,
-		}
-	} else {
-		rating.Count += 1
-		rating.Sum += score
+		return &Rating{}
 	}
+	return &Rating{Count: rating.Count, Sum: rating.Sum}
+}
 
-	store.rating[laptopID] = rating
+// accumulate 调用方需持有锁, 把评分计入汇总
+func (store *InMemoryRatingStore) accumulate(userRating *UserRating) {
+	if userRating.Excluded {
+		return
+	}
+
+	rating := store.rating[userRating.LaptopID]
+	if rating == nil {
+		rating = &Rating{}
+		store.rating[userRating.LaptopID] = rating
+	}
+	rating.Count += 1
+	rating.Sum += userRating.Score
+}
+
+// subtract 调用方需持有锁, 把评分从汇总中减去
+func (store *InMemoryRatingStore) subtract(userRating *UserRating) {
+	if userRating.Excluded {
+		return
+	}
 
-	return rating, nil
+	rating := store.rating[userRating.LaptopID]
+	rating.Count -= 1
+	rating.Sum -= userRating.Score
+	if rating.Count == 0 {
+		// 避免浮点误差累积
+		rating.Sum = 0
+	}
 }
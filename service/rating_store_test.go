@@ -0,0 +1,82 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryRatingStore(t *testing.T) {
+	t.Parallel()
+
+	store := NewInMemoryRatingStore()
+
+	rating, err := store.Find("laptop-1")
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), rating.Count)
+	require.Equal(t, 0.0, rating.Average())
+
+	_, err = store.Add("laptop-1", "user1", 8)
+	require.NoError(t, err)
+	rating, err = store.Add("laptop-1", "user2", 6)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), rating.Count)
+	require.Equal(t, 7.0, rating.Average())
+
+	// 重复评分替换之前的分数
+	rating, err = store.Add("laptop-1", "user1", 10)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), rating.Count)
+	require.Equal(t, 8.0, rating.Average())
+
+	userRating, err := store.FindUserRating("laptop-1", "user1")
+	require.NoError(t, err)
+	require.Equal(t, 10.0, userRating.Score)
+
+	userRating, err = store.FindUserRating("laptop-2", "user1")
+	require.NoError(t, err)
+	require.Nil(t, userRating)
+
+	rating, err = store.Remove("laptop-1", "user2")
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), rating.Count)
+	require.Equal(t, 10.0, rating.Average())
+
+	_, err = store.Remove("laptop-1", "user2")
+	require.ErrorIs(t, err, ErrRatingNotFound)
+
+	rating, err = store.Remove("laptop-1", "user1")
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), rating.Count)
+	require.Equal(t, 0.0, rating.Sum)
+}
+
+func TestInMemoryRatingStoreExcluded(t *testing.T) {
+	t.Parallel()
+
+	store := NewInMemoryRatingStore()
+
+	_, err := store.Add("laptop-1", "user1", 8)
+	require.NoError(t, err)
+	_, err = store.Add("laptop-1", "user2", 1)
+	require.NoError(t, err)
+
+	rating, err := store.SetExcluded("laptop-1", "user2", true)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), rating.Count)
+	require.Equal(t, 8.0, rating.Average())
+
+	userRating, err := store.FindUserRating("laptop-1", "user2")
+	require.NoError(t, err)
+	require.True(t, userRating.Excluded)
+
+	// 重新评分后仍然不计入汇总
+	rating, err = store.Add("laptop-1", "user2", 2)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), rating.Count)
+
+	rating, err = store.SetExcluded("laptop-1", "user2", false)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), rating.Count)
+	require.Equal(t, 5.0, rating.Average())
+}
@@ -0,0 +1,349 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RBACPolicyConfig 策略文件的内容, 支持 YAML 和 JSON
+//
+// 角色拥有权限, 权限对应一组 rpc, rpc 可以使用通配符, 例如 /pcbook.LaptopService/*,
+// 通配符的规则与 path.Match 相同, * 不匹配 /
+type RBACPolicyConfig struct {
+	Public      []string              `yaml:"public"`      // 不需要登录就能访问的 rpc
+	Permissions map[string][]string   `yaml:"permissions"` // 权限 -> rpc
+	Roles       map[string]RoleConfig `yaml:"roles"`
+}
+
+// RoleConfig 角色拥有的权限, 并继承其他角色的所有权限
+type RoleConfig struct {
+	Inherits    []string `yaml:"inherits"`
+	Permissions []string `yaml:"permissions"`
+}
+
+// RBACPolicy 展开继承关系后的策略, 没有列出的 rpc 拒绝访问
+type RBACPolicy struct {
+	public      []string
+	permissions []string                   // 所有权限中的 rpc
+	scopes      map[string][]string        // 权限 -> rpc, 用于限定 API key 的访问范围
+	roles       map[string][]string        // 角色 -> 可以访问的 rpc, 包括继承的
+	grants      map[string]map[string]bool // 角色 -> 拥有的权限, 包括继承的
+}
+
+// ParseRBACPolicy 解析并检查策略, 权限和继承的角色必须存在, 继承不能有环
+func ParseRBACPolicy(data []byte) (*RBACPolicy, error) {
+	config := RBACPolicyConfig{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(&config)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse rbac policy: %w", err)
+	}
+
+	policy := &RBACPolicy{
+		scopes: make(map[string][]string),
+		roles:  make(map[string][]string),
+		grants: make(map[string]map[string]bool),
+	}
+
+	for _, pattern := range config.Public {
+		if err := validateMethodPattern(pattern); err != nil {
+			return nil, err
+		}
+		policy.public = append(policy.public, pattern)
+	}
+
+	for name, patterns := range config.Permissions {
+		for _, pattern := range patterns {
+			if err := validateMethodPattern(pattern); err != nil {
+				return nil, fmt.Errorf("permission %s: %w", name, err)
+			}
+			policy.permissions = append(policy.permissions, pattern)
+		}
+		policy.scopes[name] = patterns
+	}
+
+	for role := range config.Roles {
+		patterns, permissions, err := expandRole(config, role, nil)
+		if err != nil {
+			return nil, err
+		}
+		policy.roles[role] = patterns
+		policy.grants[role] = make(map[string]bool)
+		for _, permission := range permissions {
+			policy.grants[role][permission] = true
+		}
+	}
+
+	return policy, nil
+}
+
+// expandRole 递归展开角色继承的 rpc 和权限, visiting 是正在展开的角色, 用于发现环
+func expandRole(config RBACPolicyConfig, role string, visiting []string) ([]string, []string, error) {
+	for _, name := range visiting {
+		if name == role {
+			return nil, nil, fmt.Errorf("rbac role inheritance cycle: %s -> %s", strings.Join(visiting, " -> "), role)
+		}
+	}
+
+	roleConfig, ok := config.Roles[role]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown rbac role %s", role)
+	}
+
+	var patterns []string
+	permissions := append([]string(nil), roleConfig.Permissions...)
+	for _, permission := range roleConfig.Permissions {
+		methods, ok := config.Permissions[permission]
+		if !ok {
+			return nil, nil, fmt.Errorf("rbac role %s has unknown permission %s", role, permission)
+		}
+		patterns = append(patterns, methods...)
+	}
+
+	for _, parent := range roleConfig.Inherits {
+		inheritedPatterns, inheritedPermissions, err := expandRole(config, parent, append(visiting, role))
+		if err != nil {
+			return nil, nil, err
+		}
+		patterns = append(patterns, inheritedPatterns...)
+		permissions = append(permissions, inheritedPermissions...)
+	}
+	return patterns, permissions, nil
+}
+
+func validateMethodPattern(pattern string) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("invalid rpc pattern %q, expect /package.Service/Method", pattern)
+	}
+	_, err := path.Match(pattern, "")
+	if err != nil {
+		return fmt.Errorf("invalid rpc pattern %q: %w", pattern, err)
+	}
+	return nil
+}
+
+func matchMethod(patterns []string, method string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, method); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadRBACPolicy 从文件读取策略
+func LoadRBACPolicy(filename string) (*RBACPolicy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read rbac policy: %w", err)
+	}
+	return ParseRBACPolicy(data)
+}
+
+// IsPublic 不需要登录就能访问
+func (policy *RBACPolicy) IsPublic(method string) bool {
+	return matchMethod(policy.public, method)
+}
+
+// Allow 角色可以访问 rpc
+func (policy *RBACPolicy) Allow(role string, method string) bool {
+	return matchMethod(policy.roles[role], method)
+}
+
+// HasPermission 策略中定义了权限
+func (policy *RBACPolicy) HasPermission(permission string) bool {
+	_, ok := policy.scopes[permission]
+	return ok
+}
+
+// RoleHasPermission 角色拥有权限, 包括继承的
+func (policy *RBACPolicy) RoleHasPermission(role string, permission string) bool {
+	return policy.grants[role][permission]
+}
+
+// AllowScopes 角色可以访问 rpc, 并且 rpc 属于 scopes 中的某个权限
+func (policy *RBACPolicy) AllowScopes(role string, scopes []string, method string) bool {
+	if !policy.Allow(role, method) {
+		return false
+	}
+	for _, scope := range scopes {
+		if matchMethod(policy.scopes[scope], method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check 检查每个 rpc 都在策略中出现, 返回的错误列出遗漏的 rpc
+func (policy *RBACPolicy) Check(methods []string) error {
+	var missing []string
+	for _, method := range methods {
+		if !policy.IsPublic(method) && !matchMethod(policy.permissions, method) {
+			missing = append(missing, method)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("rbac policy has no entry for %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// RBACPolicyFile 文件修改后自动重新加载的策略
+//
+// 新的策略解析失败或遗漏了 rpc 时继续使用原来的策略
+type RBACPolicyFile struct {
+	filename string
+	interval time.Duration
+	policy   atomic.Value // *RBACPolicy
+
+	mutex   sync.Mutex
+	methods []string // 策略必须包含的 rpc
+	modTime time.Time
+	size    int64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewRBACPolicyFile 读取策略, 调用 Start 后每隔 interval 检查文件是否修改
+func NewRBACPolicyFile(filename string, interval time.Duration) (*RBACPolicyFile, error) {
+	file := &RBACPolicyFile{
+		filename: filename,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+
+	err := file.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// IsPublic 使用当前的策略
+func (file *RBACPolicyFile) IsPublic(method string) bool {
+	return file.current().IsPublic(method)
+}
+
+// Allow 使用当前的策略
+func (file *RBACPolicyFile) Allow(role string, method string) bool {
+	return file.current().Allow(role, method)
+}
+
+// HasPermission 使用当前的策略
+func (file *RBACPolicyFile) HasPermission(permission string) bool {
+	return file.current().HasPermission(permission)
+}
+
+// RoleHasPermission 使用当前的策略
+func (file *RBACPolicyFile) RoleHasPermission(role string, permission string) bool {
+	return file.current().RoleHasPermission(role, permission)
+}
+
+// AllowScopes 使用当前的策略
+func (file *RBACPolicyFile) AllowScopes(role string, scopes []string, method string) bool {
+	return file.current().AllowScopes(role, scopes, method)
+}
+
+func (file *RBACPolicyFile) current() *RBACPolicy {
+	return file.policy.Load().(*RBACPolicy)
+}
+
+// Require 设置策略必须包含的 rpc, 当前的策略遗漏时返回错误
+func (file *RBACPolicyFile) Require(methods []string) error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+
+	err := file.current().Check(methods)
+	if err != nil {
+		return err
+	}
+	file.methods = methods
+	return nil
+}
+
+// Reload 重新读取策略, 失败时保留原来的策略
+func (file *RBACPolicyFile) Reload() error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+
+	info, err := os.Stat(file.filename)
+	if err != nil {
+		return fmt.Errorf("cannot read rbac policy: %w", err)
+	}
+	// 失败时也记录, 文件再次修改前不重复加载
+	file.modTime = info.ModTime()
+	file.size = info.Size()
+
+	policy, err := LoadRBACPolicy(file.filename)
+	if err != nil {
+		return err
+	}
+	err = policy.Check(file.methods)
+	if err != nil {
+		return err
+	}
+
+	file.policy.Store(policy)
+	return nil
+}
+
+// modified 文件的修改时间或大小变化
+func (file *RBACPolicyFile) modified() bool {
+	info, err := os.Stat(file.filename)
+	if err != nil {
+		return false
+	}
+
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	return !info.ModTime().Equal(file.modTime) || info.Size() != file.size
+}
+
+// Start 启动后台检查
+func (file *RBACPolicyFile) Start() {
+	file.wg.Add(1)
+
+	go func() {
+		defer file.wg.Done()
+
+		ticker := time.NewTicker(file.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-file.done:
+				return
+			case <-ticker.C:
+				if !file.modified() {
+					continue
+				}
+				err := file.Reload()
+				if err != nil {
+					log.Printf("cannot reload rbac policy, keep the previous one: %v", err)
+					continue
+				}
+				log.Printf("reloaded rbac policy from %s", file.filename)
+			}
+		}
+	}()
+}
+
+// Stop 停止后台检查
+func (file *RBACPolicyFile) Stop() {
+	close(file.done)
+	file.wg.Wait()
+}
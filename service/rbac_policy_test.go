@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"go-pcbook-micro/pb"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const testRBACPolicy = `
+public:
+  - /pcbook.LaptopService/Search*
+permissions:
+  laptop.rate:
+    - /pcbook.LaptopService/RateLaptop
+  laptop.manage:
+    - /pcbook.LaptopService/*
+roles:
+  user:
+    permissions: [laptop.rate]
+  admin:
+    inherits: [user]
+    permissions: [laptop.manage]
+`
+
+func TestRBACPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy, err := ParseRBACPolicy([]byte(testRBACPolicy))
+	require.NoError(t, err)
+
+	require.True(t, policy.IsPublic("/pcbook.LaptopService/SearchLaptop"))
+	require.False(t, policy.IsPublic("/pcbook.LaptopService/RateLaptop"))
+
+	require.True(t, policy.Allow("user", "/pcbook.LaptopService/RateLaptop"))
+	require.False(t, policy.Allow("user", "/pcbook.LaptopService/CreateLaptop"))
+	// admin 继承 user 的权限, 通配符不匹配其他服务
+	require.True(t, policy.Allow("admin", "/pcbook.LaptopService/RateLaptop"))
+	require.True(t, policy.Allow("admin", "/pcbook.LaptopService/CreateLaptop"))
+	require.False(t, policy.Allow("admin", "/pcbook.AuthService/ListUsers"))
+	require.False(t, policy.Allow("unknown", "/pcbook.LaptopService/RateLaptop"))
+
+	require.NoError(t, policy.Check([]string{"/pcbook.LaptopService/CreateLaptop"}))
+	require.Error(t, policy.Check([]string{"/pcbook.AuthService/ListUsers"}))
+
+	invalid := []string{
+		"roles: {admin: {inherits: [user]}, user: {inherits: [admin]}}",
+		"roles: {user: {permissions: [unknown]}}",
+		"roles: {user: {inherits: [unknown]}}",
+		"public: [pcbook.LaptopService/SearchLaptop]",
+		"public: [\"/pcbook.LaptopService/[\"]",
+		"unknown: true",
+	}
+	for _, data := range invalid {
+		_, err := ParseRBACPolicy([]byte(data))
+		require.Error(t, err, data)
+	}
+
+	// JSON 也可以
+	policy, err = ParseRBACPolicy([]byte(`{"public": ["/pcbook.LaptopService/SearchLaptop"]}`))
+	require.NoError(t, err)
+	require.True(t, policy.IsPublic("/pcbook.LaptopService/SearchLaptop"))
+}
+
+func TestRBACPolicyFileReload(t *testing.T) {
+	t.Parallel()
+
+	filename := filepath.Join(t.TempDir(), "rbac.yaml")
+	require.NoError(t, ioutil.WriteFile(filename, []byte(testRBACPolicy), 0644))
+
+	file, err := NewRBACPolicyFile(filename, time.Second)
+	require.NoError(t, err)
+	require.NoError(t, file.Require([]string{"/pcbook.LaptopService/RateLaptop"}))
+	require.Error(t, file.Require([]string{"/pcbook.AuthService/ListUsers"}))
+	require.False(t, file.modified())
+
+	// 新的策略遗漏了 rpc 时保留原来的策略
+	require.NoError(t, ioutil.WriteFile(filename, []byte("public: []"), 0644))
+	require.True(t, file.modified())
+	require.Error(t, file.Reload())
+	require.True(t, file.Allow("user", "/pcbook.LaptopService/RateLaptop"))
+
+	reloaded := testRBACPolicy + "  guest:\n    permissions: [laptop.rate]\n"
+	require.NoError(t, ioutil.WriteFile(filename, []byte(reloaded), 0644))
+	require.NoError(t, file.Reload())
+	require.True(t, file.Allow("guest", "/pcbook.LaptopService/RateLaptop"))
+}
+
+func TestRBACPolicyCoversAllMethods(t *testing.T) {
+	t.Parallel()
+
+	policy, err := LoadRBACPolicy("../policy/rbac.yaml")
+	require.NoError(t, err)
+
+	var methods []string
+	for _, desc := range []grpc.ServiceDesc{pb.AuthService_ServiceDesc, pb.LaptopService_ServiceDesc, pb.ReviewService_ServiceDesc} {
+		for _, method := range desc.Methods {
+			methods = append(methods, "/"+desc.ServiceName+"/"+method.MethodName)
+		}
+		for _, stream := range desc.Streams {
+			methods = append(methods, "/"+desc.ServiceName+"/"+stream.StreamName)
+		}
+	}
+	require.NoError(t, policy.Check(methods))
+
+	// 公开注册的 user 不能创建 laptop, 可以给自己拥有的 laptop 上传图片
+	require.False(t, policy.Allow("user", "/pcbook.LaptopService/CreateLaptop"))
+	require.True(t, policy.Allow("user", "/pcbook.LaptopService/UploadImage"))
+	require.True(t, policy.Allow("admin", "/pcbook.LaptopService/CreateLaptop"))
+
+	// 角色拥有的权限包括继承的
+	require.True(t, policy.RoleHasPermission("superadmin", "user.admin"))
+	require.True(t, policy.RoleHasPermission("superadmin", "laptop.rate"))
+	require.False(t, policy.RoleHasPermission("user", "user.admin"))
+	require.False(t, policy.RoleHasPermission("unknown", "laptop.rate"))
+}
+
+func TestAuthInterceptorAccessPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy, err := ParseRBACPolicy([]byte(testRBACPolicy))
+	require.NoError(t, err)
+
+	jwtManager := NewJWTManager("secret", time.Minute)
+	interceptor := NewAuthInterceptor(jwtManager, nil, WithAccessPolicy(policy))
+
+	user, err := NewUser("alice", "password1", "user")
+	require.NoError(t, err)
+	accessToken, err := jwtManager.Generate(user)
+	require.NoError(t, err)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", accessToken))
+
+	claims, err := interceptor.authorize(context.Background(), "/pcbook.LaptopService/SearchLaptop")
+	require.NoError(t, err)
+	require.Nil(t, claims)
+
+	_, err = interceptor.authorize(ctx, "/pcbook.LaptopService/RateLaptop")
+	require.NoError(t, err)
+
+	// 没有列出的 rpc 拒绝访问
+	_, err = interceptor.authorize(context.Background(), "/pcbook.AuthService/ListUsers")
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = interceptor.authorize(ctx, "/pcbook.AuthService/ListUsers")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
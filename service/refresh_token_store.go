@@ -0,0 +1,146 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RefreshToken 保存的 refresh token, 只保存 token 的哈希
+//
+// 每次刷新都会换发新的 token, 同一次登录换发的 token 属于同一个 family,
+// 已经用过的 token 再次出现说明 token 被盗用, 整个 family 都会被吊销
+type RefreshToken struct {
+	Hash      string
+	Username  string
+	FamilyID  string
+	ExpiresAt time.Time
+	Used      bool
+}
+
+type RefreshTokenStore interface {
+	// 保存新的 token
+	Save(token *RefreshToken) error
+	// 查找 token, 没有时返回 nil
+	Find(hash string) (*RefreshToken, error)
+	// 标记 token 已使用, 返回标记前的 token, 没有时返回 nil
+	Consume(hash string) (*RefreshToken, error)
+	// 删除同一个 family 的所有 token
+	DeleteFamily(familyID string) error
+	// 删除用户的所有 token
+	DeleteByUser(username string) error
+}
+
+// NewRefreshToken 生成随机的 refresh token, 返回明文和需要保存的记录
+func NewRefreshToken(username string, familyID string, duration time.Duration) (string, *RefreshToken, error) {
+	data := make([]byte, 32)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot generate refresh token: %w", err)
+	}
+
+	plaintext := base64.RawURLEncoding.EncodeToString(data)
+	token := &RefreshToken{
+		Hash:      HashRefreshToken(plaintext),
+		Username:  username,
+		FamilyID:  familyID,
+		ExpiresAt: time.Now().Add(duration),
+	}
+	return plaintext, token, nil
+}
+
+// HashRefreshToken 计算 refresh token 的 SHA-256
+func HashRefreshToken(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+type InMemoryRefreshTokenStore struct {
+	mutex  sync.Mutex
+	tokens map[string]*RefreshToken
+	now    func() time.Time
+}
+
+// NewInMemoryRefreshTokenStore 创建 InMemoryRefreshTokenStore 实例
+func NewInMemoryRefreshTokenStore() *InMemoryRefreshTokenStore {
+	return &InMemoryRefreshTokenStore{
+		tokens: make(map[string]*RefreshToken),
+		now:    time.Now,
+	}
+}
+
+func (store *InMemoryRefreshTokenStore) Save(token *RefreshToken) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	// 顺便清理已经过期的 token
+	now := store.now()
+	for hash, other := range store.tokens {
+		if now.After(other.ExpiresAt) {
+			delete(store.tokens, hash)
+		}
+	}
+
+	if store.tokens[token.Hash] != nil {
+		return ErrAlreadyExits
+	}
+
+	other := *token
+	store.tokens[token.Hash] = &other
+	return nil
+}
+
+func (store *InMemoryRefreshTokenStore) Find(hash string) (*RefreshToken, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	token := store.tokens[hash]
+	if token == nil {
+		return nil, nil
+	}
+
+	other := *token
+	return &other, nil
+}
+
+func (store *InMemoryRefreshTokenStore) Consume(hash string) (*RefreshToken, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	token := store.tokens[hash]
+	if token == nil {
+		return nil, nil
+	}
+
+	other := *token
+	token.Used = true
+	return &other, nil
+}
+
+func (store *InMemoryRefreshTokenStore) DeleteFamily(familyID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for hash, token := range store.tokens {
+		if token.FamilyID == familyID {
+			delete(store.tokens, hash)
+		}
+	}
+	return nil
+}
+
+func (store *InMemoryRefreshTokenStore) DeleteByUser(username string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for hash, token := range store.tokens {
+		if token.Username == username {
+			delete(store.tokens, hash)
+		}
+	}
+	return nil
+}
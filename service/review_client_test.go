@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"go-pcbook-micro/pb"
+	"go-pcbook-micro/sample"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClientReview(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := NewInMemoryLaptopStore()
+	ratingStore := NewInMemoryRatingStore()
+	reviewStore := NewInMemoryReviewStore()
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	jwtManager := NewJWTManager("secret", time.Minute)
+	reviewServer := NewReviewServer(reviewStore, laptopStore, ratingStore, DefaultRatingPolicy, nil)
+	serverAddress := startTestReviewServer(t, jwtManager, reviewServer)
+	reviewClient := newTestReviewClient(t, serverAddress)
+
+	user1 := newTestAuthContext(t, jwtManager, "user1", "user")
+	user2 := newTestAuthContext(t, jwtManager, "user2", "user")
+	admin := newTestAuthContext(t, jwtManager, "admin1", "admin")
+
+	req := &pb.CreateReviewRequest{
+		LaptopId: laptop.GetId(),
+		Title:    "Too loud",
+		Body:     "The fan never stops.",
+		Score:    3,
+	}
+	res, err := reviewClient.CreateReview(user1, req)
+	require.NoError(t, err)
+	review := res.GetReview()
+	require.Equal(t, "user1", review.GetAuthor())
+	require.Equal(t, pb.Review_PENDING, review.GetStatus())
+
+	// 评论的分数作为用户的评分
+	userRating, err := ratingStore.FindUserRating(laptop.GetId(), "user1")
+	require.NoError(t, err)
+	require.Equal(t, 3.0, userRating.Score)
+
+	_, err = reviewClient.CreateReview(user1, req)
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	req.Score = 0
+	_, err = reviewClient.CreateReview(user2, req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// 审核通过前不会公开显示
+	list, err := reviewClient.ListReviews(context.Background(), &pb.ListReviewsRequest{LaptopId: laptop.GetId()})
+	require.NoError(t, err)
+	require.Empty(t, list.GetReviews())
+
+	_, err = reviewClient.ListPendingReviews(user1, &pb.ListPendingReviewsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	pending, err := reviewClient.ListPendingReviews(admin, &pb.ListPendingReviewsRequest{})
+	require.NoError(t, err)
+	require.Len(t, pending.GetReviews(), 1)
+
+	moderateReq := &pb.ModerateReviewRequest{ReviewId: review.GetId(), Action: pb.ModerateReviewRequest_APPROVE}
+	_, err = reviewClient.ModerateReview(admin, moderateReq)
+	require.NoError(t, err)
+
+	list, err = reviewClient.ListReviews(context.Background(), &pb.ListReviewsRequest{LaptopId: laptop.GetId()})
+	require.NoError(t, err)
+	require.Len(t, list.GetReviews(), 1)
+	require.Empty(t, list.GetNextPageToken())
+
+	// 不能给自己的评论投票, 每个用户只能投一次
+	voteReq := &pb.VoteReviewHelpfulRequest{ReviewId: review.GetId()}
+	_, err = reviewClient.VoteReviewHelpful(user1, voteReq)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	voted, err := reviewClient.VoteReviewHelpful(user2, voteReq)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), voted.GetReview().GetHelpfulVotes())
+	_, err = reviewClient.VoteReviewHelpful(user2, voteReq)
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	// 拒绝后评分不计入汇总
+	moderateReq.Action = pb.ModerateReviewRequest_REJECT
+	_, err = reviewClient.ModerateReview(admin, moderateReq)
+	require.NoError(t, err)
+	rating, err := ratingStore.Find(laptop.GetId())
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), rating.Count)
+
+	list, err = reviewClient.ListReviews(context.Background(), &pb.ListReviewsRequest{LaptopId: laptop.GetId()})
+	require.NoError(t, err)
+	require.Empty(t, list.GetReviews())
+
+	// 恢复后重新计入
+	moderateReq.Action = pb.ModerateReviewRequest_HIDE
+	_, err = reviewClient.ModerateReview(admin, moderateReq)
+	require.NoError(t, err)
+	rating, err = ratingStore.Find(laptop.GetId())
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), rating.Count)
+}
+
+func startTestReviewServer(t *testing.T, jwtManager *JWTManager, reviewServer *ReviewServer) string {
+	const reviewServicePath = "/pcbook.ReviewService/"
+	accessibleRoles := map[string][]string{
+		reviewServicePath + "CreateReview":       {"admin", "user"},
+		reviewServicePath + "VoteReviewHelpful":  {"admin", "user"},
+		reviewServicePath + "ListPendingReviews": {"admin"},
+		reviewServicePath + "ModerateReview":     {"admin"},
+	}
+	interceptor := NewAuthInterceptor(jwtManager, accessibleRoles)
+
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(interceptor.Unary()))
+	pb.RegisterReviewServiceServer(grpcServer, reviewServer)
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	return listener.Addr().String()
+}
+
+func newTestReviewClient(t *testing.T, address string) pb.ReviewServiceClient {
+	conn, err := grpc.Dial(address, grpc.WithInsecure())
+	require.NoError(t, err)
+	return pb.NewReviewServiceClient(conn)
+}
+
+func TestReviewServerRatingGuard(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := NewInMemoryLaptopStore()
+	ratingStore := NewInMemoryRatingStore()
+	laptop1 := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop1))
+	laptop2 := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop2))
+
+	guard := NewRatingGuard(RatingGuardConfig{
+		MaxRatingsPerUser: 1,
+		RateWindow:        time.Minute,
+		BurstThreshold:    2,
+		BurstWindow:       time.Minute,
+		AutoExclude:       true,
+	}, DefaultRatingPolicy)
+	server := NewReviewServer(NewInMemoryReviewStore(), laptopStore, ratingStore, DefaultRatingPolicy, guard)
+
+	createReview := func(username string, laptopID string) error {
+		ctx := contextWithClaims(context.Background(), &UserClaims{Username: username, Role: "user"})
+		_, err := server.CreateReview(ctx, &pb.CreateReviewRequest{
+			LaptopId: laptopID,
+			Title:    "Best laptop",
+			Body:     "Buy it.",
+			Score:    DefaultRatingPolicy.MaxScore,
+		})
+		return err
+	}
+
+	// 评论与 RateLaptop 一样限制频率, 不存在的 laptop 不占用次数
+	require.Equal(t, codes.NotFound, status.Code(createReview("user1", "unknown")))
+	require.NoError(t, createReview("user1", laptop1.GetId()))
+	require.Equal(t, codes.ResourceExhausted, status.Code(createReview("user1", laptop2.GetId())))
+
+	// 集中出现的极端分数被标记并排除
+	require.NoError(t, createReview("user2", laptop1.GetId()))
+	require.Len(t, guard.ListFlags(true), 2)
+	userRating, err := ratingStore.FindUserRating(laptop1.GetId(), "user2")
+	require.NoError(t, err)
+	require.True(t, userRating.Excluded)
+}
@@ -0,0 +1,392 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"go-pcbook-micro/pb"
+	"log"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	maxReviewTitleLength = 100
+	maxReviewBodyLength  = 5000
+
+	defaultReviewPageSize = 20
+	maxReviewPageSize     = 100
+)
+
+// ReviewServer 提供评论服务, 评论的分数作为用户对 laptop 的评分
+type ReviewServer struct {
+	reviewStore  ReviewStore
+	laptopStore  LaptopStore
+	ratingStore  RatingStore
+	ratingPolicy RatingPolicy
+	ratingGuard  *RatingGuard
+}
+
+// NewReviewServer 创建 ReviewServer 实例, 评论的分数与 RateLaptop 使用同一个 ratingGuard 防刷, 为 nil 时不限制
+func NewReviewServer(reviewStore ReviewStore, laptopStore LaptopStore, ratingStore RatingStore, ratingPolicy RatingPolicy, ratingGuard *RatingGuard) *ReviewServer {
+	if ratingGuard == nil {
+		ratingGuard = NewRatingGuard(RatingGuardConfig{}, ratingPolicy)
+	}
+
+	return &ReviewServer{
+		reviewStore:  reviewStore,
+		laptopStore:  laptopStore,
+		ratingStore:  ratingStore,
+		ratingPolicy: ratingPolicy,
+		ratingGuard:  ratingGuard,
+	}
+}
+
+// CreateReview 创建评论的 rpc, 评论需要审核通过才会公开显示
+func (server *ReviewServer) CreateReview(ctx context.Context, req *pb.CreateReviewRequest) (*pb.CreateReviewResponse, error) {
+	laptopID := req.GetLaptopId()
+
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, logError(status.Errorf(codes.Unauthenticated, "cannot create review: user is not authenticated"))
+	}
+	log.Printf("receive a create-review request: laptop = %s, user = %s", laptopID, claims.Username)
+
+	err := server.validateReview(req)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "cannot create review: %v", err))
+	}
+
+	found, err := NewTenantLaptopStore(server.laptopStore, TenantFromContext(ctx)).Find(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+	}
+	if found == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "laptopID %s is not found", laptopID))
+	}
+
+	now := time.Now()
+	err = server.ratingGuard.Allow(claims.Username, now)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.ResourceExhausted, "cannot create review: %v", err))
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot generate a new review ID: %v", err))
+	}
+
+	review := &Review{
+		ID:        id.String(),
+		LaptopID:  laptopID,
+		Author:    claims.Username,
+		Title:     req.GetTitle(),
+		Body:      req.GetBody(),
+		Score:     req.GetScore(),
+		Status:    ReviewPending,
+		CreatedAt: now,
+	}
+
+	err = server.reviewStore.Save(review)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrReviewAlreadyExists) {
+			code = codes.AlreadyExists
+		}
+		return nil, logError(status.Errorf(code, "cannot save review: %v", err))
+	}
+
+	// 评论的分数替换用户之前的评分
+	_, err = server.ratingGuard.addRating(server.ratings(ctx), laptopID, claims.Username, review.Score, now)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot create review: %v", err))
+	}
+
+	log.Printf("saved review with id: %s", review.ID)
+	return &pb.CreateReviewResponse{Review: toPbReview(review)}, nil
+}
+
+// ListReviews 分页获取 laptop 已审核通过的评论的 rpc
+func (server *ReviewServer) ListReviews(ctx context.Context, req *pb.ListReviewsRequest) (*pb.ListReviewsResponse, error) {
+	log.Printf("receive a list-reviews request: laptop = %s, sort by = %v", req.GetLaptopId(), req.GetSortBy())
+
+	offset, limit, err := parsePage(req.GetPageSize(), req.GetPageToken())
+	if err != nil {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "cannot list reviews: %v", err))
+	}
+
+	sortBy := ReviewSortNewest
+	if req.GetSortBy() == pb.ListReviewsRequest_MOST_HELPFUL {
+		sortBy = ReviewSortMostHelpful
+	}
+
+	// 先取出全部, 过滤掉其他租户的 laptop 的评论后再分页
+	reviews, _, err := server.reviewStore.List(ReviewQuery{
+		LaptopID: req.GetLaptopId(),
+		Status:   ReviewApproved,
+		Sort:     sortBy,
+	})
+	if err == nil {
+		reviews, err = server.visibleReviews(ctx, reviews)
+	}
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot list reviews: %v", err))
+	}
+	total := len(reviews)
+	reviews = paginate(reviews, offset, limit)
+
+	res := &pb.ListReviewsResponse{
+		NextPageToken: nextPageToken(offset, len(reviews), total),
+		TotalSize:     int32(total),
+	}
+	for _, review := range reviews {
+		res.Reviews = append(res.Reviews, toPbReview(review))
+	}
+	return res, nil
+}
+
+// VoteReviewHelpful 投票评论有用的 rpc
+func (server *ReviewServer) VoteReviewHelpful(ctx context.Context, req *pb.VoteReviewHelpfulRequest) (*pb.VoteReviewHelpfulResponse, error) {
+	reviewID := req.GetReviewId()
+
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, logError(status.Errorf(codes.Unauthenticated, "cannot vote review: user is not authenticated"))
+	}
+	log.Printf("receive a vote-review-helpful request: review = %s, user = %s", reviewID, claims.Username)
+
+	review, err := server.reviewStore.Find(reviewID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find review: %v", err))
+	}
+	if review != nil {
+		review, err = server.visibleReview(ctx, review)
+		if err != nil {
+			return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+		}
+	}
+	// 只能给公开显示的评论投票
+	if review == nil || review.Status != ReviewApproved {
+		return nil, logError(status.Errorf(codes.NotFound, "cannot vote review: %v", ErrReviewNotFound))
+	}
+	if review.Author == claims.Username {
+		return nil, logError(status.Errorf(codes.FailedPrecondition, "cannot vote own review"))
+	}
+
+	review, err = server.reviewStore.Vote(reviewID, claims.Username)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrAlreadyVoted) {
+			code = codes.AlreadyExists
+		} else if errors.Is(err, ErrReviewNotFound) {
+			code = codes.NotFound
+		}
+		return nil, logError(status.Errorf(code, "cannot vote review: %v", err))
+	}
+
+	return &pb.VoteReviewHelpfulResponse{Review: toPbReview(review)}, nil
+}
+
+// ListPendingReviews 分页获取等待审核的评论的 rpc, 最早的在前
+func (server *ReviewServer) ListPendingReviews(ctx context.Context, req *pb.ListPendingReviewsRequest) (*pb.ListPendingReviewsResponse, error) {
+	log.Print("receive a list-pending-reviews request")
+
+	offset, limit, err := parsePage(req.GetPageSize(), req.GetPageToken())
+	if err != nil {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "cannot list pending reviews: %v", err))
+	}
+
+	// 先取出全部再倒序, 使等待最久的评论先被审核
+	reviews, _, err := server.reviewStore.List(ReviewQuery{Status: ReviewPending})
+	if err == nil {
+		reviews, err = server.visibleReviews(ctx, reviews)
+	}
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot list pending reviews: %v", err))
+	}
+	for i, j := 0, len(reviews)-1; i < j; i, j = i+1, j-1 {
+		reviews[i], reviews[j] = reviews[j], reviews[i]
+	}
+	total := len(reviews)
+	reviews = paginate(reviews, offset, limit)
+
+	res := &pb.ListPendingReviewsResponse{
+		NextPageToken: nextPageToken(offset, len(reviews), total),
+		TotalSize:     int32(total),
+	}
+	for _, review := range reviews {
+		res.Reviews = append(res.Reviews, toPbReview(review))
+	}
+	return res, nil
+}
+
+// ModerateReview 审核评论的 rpc, 拒绝的评论的分数不计入评分汇总
+func (server *ReviewServer) ModerateReview(ctx context.Context, req *pb.ModerateReviewRequest) (*pb.ModerateReviewResponse, error) {
+	reviewID := req.GetReviewId()
+	log.Printf("receive a moderate-review request: review = %s, action = %v", reviewID, req.GetAction())
+
+	var newStatus ReviewStatus
+	switch req.GetAction() {
+	case pb.ModerateReviewRequest_APPROVE:
+		newStatus = ReviewApproved
+	case pb.ModerateReviewRequest_REJECT:
+		newStatus = ReviewRejected
+	case pb.ModerateReviewRequest_HIDE:
+		newStatus = ReviewHidden
+	default:
+		return nil, logError(status.Errorf(codes.InvalidArgument, "unknown moderation action: %v", req.GetAction()))
+	}
+
+	review, err := server.reviewStore.Find(reviewID)
+	if err == nil && review != nil {
+		review, err = server.visibleReview(ctx, review)
+	}
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find review: %v", err))
+	}
+	if review == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "cannot moderate review: %v", ErrReviewNotFound))
+	}
+
+	oldStatus := review.Status
+	review, err = server.reviewStore.SetStatus(reviewID, newStatus)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrReviewNotFound) {
+			code = codes.NotFound
+		}
+		return nil, logError(status.Errorf(code, "cannot moderate review: %v", err))
+	}
+
+	// 拒绝时撤回评分, 从拒绝恢复时重新计入评分
+	if newStatus == ReviewRejected && oldStatus != ReviewRejected {
+		_, err = server.ratings(ctx).Remove(review.LaptopID, review.Author)
+		if err != nil && !errors.Is(err, ErrRatingNotFound) {
+			return nil, logError(status.Errorf(codes.Internal, "cannot remove rating: %v", err))
+		}
+	} else if newStatus != ReviewRejected && oldStatus == ReviewRejected {
+		// 管理员的操作不限制频率, 但仍然检测刷分
+		_, err = server.ratingGuard.addRating(server.ratings(ctx), review.LaptopID, review.Author, review.Score, time.Now())
+		if err != nil {
+			return nil, logError(status.Errorf(codes.Internal, "cannot moderate review: %v", err))
+		}
+	}
+
+	log.Printf("review %s: %s -> %s", reviewID, oldStatus, newStatus)
+	return &pb.ModerateReviewResponse{Review: toPbReview(review)}, nil
+}
+
+// ratings 返回限定在当前用户租户内的评分存储
+func (server *ReviewServer) ratings(ctx context.Context) RatingStore {
+	return NewTenantRatingStore(server.ratingStore, server.laptopStore, TenantFromContext(ctx))
+}
+
+// visibleReview 评论的 laptop 属于其他租户时返回 nil
+func (server *ReviewServer) visibleReview(ctx context.Context, review *Review) (*Review, error) {
+	hidden, err := TenantFromContext(ctx).hidden(server.laptopStore, review.LaptopID)
+	if err != nil || hidden {
+		return nil, err
+	}
+	return review, nil
+}
+
+// visibleReviews 过滤掉其他租户的 laptop 的评论
+func (server *ReviewServer) visibleReviews(ctx context.Context, reviews []*Review) ([]*Review, error) {
+	visible := reviews[:0]
+	for _, review := range reviews {
+		review, err := server.visibleReview(ctx, review)
+		if err != nil {
+			return nil, err
+		}
+		if review != nil {
+			visible = append(visible, review)
+		}
+	}
+	return visible, nil
+}
+
+func (server *ReviewServer) validateReview(req *pb.CreateReviewRequest) error {
+	titleLength := utf8.RuneCountInString(req.GetTitle())
+	if titleLength == 0 || titleLength > maxReviewTitleLength {
+		return errors.New("title must be 1 to 100 characters")
+	}
+	if utf8.RuneCountInString(req.GetBody()) > maxReviewBodyLength {
+		return errors.New("body must not exceed 5000 characters")
+	}
+	return server.ratingPolicy.Validate(req.GetScore())
+}
+
+// parsePage 解析分页参数, page token 是下一页的偏移量
+func parsePage(pageSize int32, pageToken string) (int, int, error) {
+	limit := int(pageSize)
+	if limit <= 0 {
+		limit = defaultReviewPageSize
+	}
+	if limit > maxReviewPageSize {
+		limit = maxReviewPageSize
+	}
+
+	if len(pageToken) == 0 {
+		return 0, limit, nil
+	}
+
+	offset, err := strconv.Atoi(pageToken)
+	if err != nil || offset < 0 {
+		return 0, 0, errors.New("invalid page token")
+	}
+	return offset, limit, nil
+}
+
+// paginate 返回 offset 开始的最多 limit 条评论
+func paginate(reviews []*Review, offset int, limit int) []*Review {
+	if offset > len(reviews) {
+		offset = len(reviews)
+	}
+	reviews = reviews[offset:]
+	if len(reviews) > limit {
+		reviews = reviews[:limit]
+	}
+	return reviews
+}
+
+// nextPageToken 没有下一页时返回空字符串
+func nextPageToken(offset int, count int, total int) string {
+	if offset+count >= total {
+		return ""
+	}
+	return strconv.Itoa(offset + count)
+}
+
+func toPbReview(review *Review) *pb.Review {
+	return &pb.Review{
+		Id:           review.ID,
+		LaptopId:     review.LaptopID,
+		Author:       review.Author,
+		Title:        review.Title,
+		Body:         review.Body,
+		Score:        review.Score,
+		Status:       toPbReviewStatus(review.Status),
+		HelpfulVotes: review.HelpfulVotes,
+		CreatedAt:    timestamppb.New(review.CreatedAt),
+	}
+}
+
+func toPbReviewStatus(s ReviewStatus) pb.Review_Status {
+	switch s {
+	case ReviewPending:
+		return pb.Review_PENDING
+	case ReviewApproved:
+		return pb.Review_APPROVED
+	case ReviewRejected:
+		return pb.Review_REJECTED
+	case ReviewHidden:
+		return pb.Review_HIDDEN
+	default:
+		return pb.Review_UNKNOWN
+	}
+}
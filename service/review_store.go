@@ -0,0 +1,231 @@
+package service
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrReviewNotFound 评论不存在返回此错误
+	ErrReviewNotFound = errors.New("review not found")
+	// ErrReviewAlreadyExists 用户已经评论过这台 laptop 返回此错误
+	ErrReviewAlreadyExists = errors.New("review already exists")
+	// ErrAlreadyVoted 用户已经投过票返回此错误
+	ErrAlreadyVoted = errors.New("already voted")
+)
+
+// ReviewStatus 评论的审核状态
+type ReviewStatus int
+
+const (
+	ReviewPending  ReviewStatus = iota + 1 // 等待审核
+	ReviewApproved                         // 审核通过, 公开显示
+	ReviewRejected                         // 审核拒绝, 评分不计入汇总
+	ReviewHidden                           // 隐藏, 评分仍计入汇总
+)
+
+func (s ReviewStatus) String() string {
+	switch s {
+	case ReviewPending:
+		return "pending"
+	case ReviewApproved:
+		return "approved"
+	case ReviewRejected:
+		return "rejected"
+	case ReviewHidden:
+		return "hidden"
+	default:
+		return "unknown"
+	}
+}
+
+// ReviewSort 评论的排序方式
+type ReviewSort int
+
+const (
+	ReviewSortNewest      ReviewSort = iota // 最新的在前
+	ReviewSortMostHelpful                   // 有用票数多的在前
+)
+
+// Review 用户对 laptop 的评论
+type Review struct {
+	ID           string
+	LaptopID     string
+	Author       string
+	Title        string
+	Body         string
+	Score        float64
+	Status       ReviewStatus
+	HelpfulVotes uint32
+	CreatedAt    time.Time
+}
+
+// ReviewQuery 查询评论的条件, Limit 为 0 时返回所有结果
+type ReviewQuery struct {
+	LaptopID string // 为空时不限制
+	Status   ReviewStatus
+	Sort     ReviewSort
+	Offset   int
+	Limit    int
+}
+
+type ReviewStore interface {
+	// 保存新评论, 每个用户对每台 laptop 只能有一条评论
+	Save(review *Review) error
+	// 根据 id 查找评论, 没有时返回 nil
+	Find(id string) (*Review, error)
+	// 查找用户对 laptop 的评论, 没有时返回 nil
+	FindByAuthor(laptopID string, author string) (*Review, error)
+	// 按条件查询评论, 返回当前页和总数
+	List(query ReviewQuery) ([]*Review, int, error)
+	// 用户投票评论有用, 每个用户只能投一次
+	Vote(id string, username string) (*Review, error)
+	// 修改审核状态
+	SetStatus(id string, status ReviewStatus) (*Review, error)
+}
+
+// InMemoryReviewStore 在内存中保存评论
+type InMemoryReviewStore struct {
+	mutex   sync.RWMutex
+	reviews map[string]*Review
+	authors map[string]string          // laptop id + author -> review id
+	voters  map[string]map[string]bool // review id -> username
+}
+
+// NewInMemoryReviewStore 创建实例
+func NewInMemoryReviewStore() *InMemoryReviewStore {
+	return &InMemoryReviewStore{
+		reviews: make(map[string]*Review),
+		authors: make(map[string]string),
+		voters:  make(map[string]map[string]bool),
+	}
+}
+
+func (store *InMemoryReviewStore) Save(review *Review) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.reviews[review.ID] != nil {
+		return ErrAlreadyExits
+	}
+
+	key := reviewAuthorKey(review.LaptopID, review.Author)
+	if _, ok := store.authors[key]; ok {
+		return ErrReviewAlreadyExists
+	}
+
+	other := *review
+	store.reviews[review.ID] = &other
+	store.authors[key] = review.ID
+	return nil
+}
+
+func (store *InMemoryReviewStore) Find(id string) (*Review, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	review := store.reviews[id]
+	if review == nil {
+		return nil, nil
+	}
+
+	other := *review
+	return &other, nil
+}
+
+func (store *InMemoryReviewStore) FindByAuthor(laptopID string, author string) (*Review, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	id, ok := store.authors[reviewAuthorKey(laptopID, author)]
+	if !ok {
+		return nil, nil
+	}
+
+	other := *store.reviews[id]
+	return &other, nil
+}
+
+func (store *InMemoryReviewStore) List(query ReviewQuery) ([]*Review, int, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var reviews []*Review
+	for _, review := range store.reviews {
+		if len(query.LaptopID) > 0 && review.LaptopID != query.LaptopID {
+			continue
+		}
+		if review.Status != query.Status {
+			continue
+		}
+
+		other := *review
+		reviews = append(reviews, &other)
+	}
+
+	sort.Slice(reviews, func(i, j int) bool {
+		if query.Sort == ReviewSortMostHelpful && reviews[i].HelpfulVotes != reviews[j].HelpfulVotes {
+			return reviews[i].HelpfulVotes > reviews[j].HelpfulVotes
+		}
+		if !reviews[i].CreatedAt.Equal(reviews[j].CreatedAt) {
+			return reviews[i].CreatedAt.After(reviews[j].CreatedAt)
+		}
+		return reviews[i].ID < reviews[j].ID
+	})
+
+	total := len(reviews)
+	if query.Offset >= total {
+		return nil, total, nil
+	}
+	reviews = reviews[query.Offset:]
+	if query.Limit > 0 && len(reviews) > query.Limit {
+		reviews = reviews[:query.Limit]
+	}
+	return reviews, total, nil
+}
+
+func (store *InMemoryReviewStore) Vote(id string, username string) (*Review, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	review := store.reviews[id]
+	if review == nil {
+		return nil, ErrReviewNotFound
+	}
+
+	voters := store.voters[id]
+	if voters == nil {
+		voters = make(map[string]bool)
+		store.voters[id] = voters
+	}
+	if voters[username] {
+		return nil, ErrAlreadyVoted
+	}
+
+	voters[username] = true
+	review.HelpfulVotes++
+
+	other := *review
+	return &other, nil
+}
+
+func (store *InMemoryReviewStore) SetStatus(id string, status ReviewStatus) (*Review, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	review := store.reviews[id]
+	if review == nil {
+		return nil, ErrReviewNotFound
+	}
+
+	review.Status = status
+
+	other := *review
+	return &other, nil
+}
+
+func reviewAuthorKey(laptopID string, author string) string {
+	return laptopID + "/" + author
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryReviewStore(t *testing.T) {
+	t.Parallel()
+
+	store := NewInMemoryReviewStore()
+	now := time.Now()
+
+	reviews := []*Review{
+		{ID: "review-1", LaptopID: "laptop-1", Author: "user1", Status: ReviewApproved, CreatedAt: now.Add(-2 * time.Hour)},
+		{ID: "review-2", LaptopID: "laptop-1", Author: "user2", Status: ReviewApproved, CreatedAt: now.Add(-time.Hour)},
+		{ID: "review-3", LaptopID: "laptop-1", Author: "user3", Status: ReviewApproved, CreatedAt: now},
+		{ID: "review-4", LaptopID: "laptop-1", Author: "user4", Status: ReviewPending, CreatedAt: now},
+		{ID: "review-5", LaptopID: "laptop-2", Author: "user1", Status: ReviewApproved, CreatedAt: now},
+	}
+	for _, review := range reviews {
+		require.NoError(t, store.Save(review))
+	}
+
+	// 每个用户对每台 laptop 只能有一条评论
+	err := store.Save(&Review{ID: "review-6", LaptopID: "laptop-1", Author: "user1"})
+	require.ErrorIs(t, err, ErrReviewAlreadyExists)
+
+	found, err := store.FindByAuthor("laptop-2", "user1")
+	require.NoError(t, err)
+	require.Equal(t, "review-5", found.ID)
+
+	// 按时间倒序分页
+	page, total, err := store.List(ReviewQuery{LaptopID: "laptop-1", Status: ReviewApproved, Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, 3, total)
+	require.Equal(t, []string{"review-3", "review-2"}, reviewIDs(page))
+
+	page, _, err = store.List(ReviewQuery{LaptopID: "laptop-1", Status: ReviewApproved, Offset: 2, Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, []string{"review-1"}, reviewIDs(page))
+
+	// 按有用票数排序
+	_, err = store.Vote("review-1", "user2")
+	require.NoError(t, err)
+	review, err := store.Vote("review-1", "user3")
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), review.HelpfulVotes)
+	_, err = store.Vote("review-1", "user3")
+	require.ErrorIs(t, err, ErrAlreadyVoted)
+	_, err = store.Vote("review-2", "user3")
+	require.NoError(t, err)
+
+	page, _, err = store.List(ReviewQuery{LaptopID: "laptop-1", Status: ReviewApproved, Sort: ReviewSortMostHelpful})
+	require.NoError(t, err)
+	require.Equal(t, []string{"review-1", "review-2", "review-3"}, reviewIDs(page))
+
+	review, err = store.SetStatus("review-4", ReviewApproved)
+	require.NoError(t, err)
+	require.Equal(t, ReviewApproved, review.Status)
+
+	_, err = store.SetStatus("review-0", ReviewApproved)
+	require.ErrorIs(t, err, ErrReviewNotFound)
+}
+
+func reviewIDs(reviews []*Review) []string {
+	ids := make([]string, len(reviews))
+	for i, review := range reviews {
+		ids[i] = review.ID
+	}
+	return ids
+}
@@ -0,0 +1,473 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// errS3NotFound 对象不存在
+	errS3NotFound = errors.New("s3 object not found")
+	// errS3PreconditionFailed 条件写入时对象已被修改
+	errS3PreconditionFailed = errors.New("s3 precondition failed")
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3TimeFormat      = "20060102T150405Z"
+	s3DateFormat      = "20060102"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// s3Client 兼容 S3 API 的最小客户端, 使用 path-style 地址和 AWS Signature V4 签名
+type s3Client struct {
+	endpoint   *url.URL
+	bucket     string
+	signer     *sigV4Signer
+	httpClient *http.Client
+}
+
+func newS3Client(endpoint string, region string, bucket string, accessKey string, secretKey string) (*s3Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", endpoint)
+	}
+	if len(bucket) == 0 {
+		return nil, fmt.Errorf("s3 bucket is not provided")
+	}
+
+	client := &s3Client{
+		endpoint: u,
+		bucket:   bucket,
+		signer: &sigV4Signer{
+			accessKey: accessKey,
+			secretKey: secretKey,
+			region:    region,
+			service:   "s3",
+		},
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	return client, nil
+}
+
+func (client *s3Client) objectURL(key string, query url.Values) *url.URL {
+	u := *client.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + client.bucket
+	if len(key) > 0 {
+		u.Path += "/" + key
+	}
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+func (client *s3Client) do(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, client.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create s3 request: %w", err)
+	}
+	req.ContentLength = int64(len(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	client.signer.sign(req, body, time.Now())
+
+	res, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot send s3 request: %w", err)
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, errS3NotFound
+	}
+	// 409 表示同时有其他条件写入, 与 412 一样需要重新读取
+	if res.StatusCode == http.StatusPreconditionFailed || res.StatusCode == http.StatusConflict {
+		res.Body.Close()
+		return nil, errS3PreconditionFailed
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		defer res.Body.Close()
+		return nil, s3ResponseError(res)
+	}
+
+	return res, nil
+}
+
+func (client *s3Client) putObject(key string, data []byte) error {
+	return client.putObjectIfMatch(key, data, "")
+}
+
+// putObjectIfMatch 只在对象的 ETag 仍为 etag 时写入, etag 为空时直接写入
+//
+// 对象已被修改返回 errS3PreconditionFailed, 对象已被删除返回 errS3NotFound
+func (client *s3Client) putObjectIfMatch(key string, data []byte, etag string) error {
+	var header http.Header
+	if len(etag) > 0 {
+		header = http.Header{"If-Match": []string{etag}}
+	}
+
+	res, err := client.do(http.MethodPut, key, nil, header, data)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (client *s3Client) getObject(key string) ([]byte, error) {
+	data, _, err := client.getObjectETag(key)
+	return data, err
+}
+
+// getObjectETag 读取对象内容和 ETag, 用于之后的条件写入
+func (client *s3Client) getObjectETag(key string) ([]byte, string, error) {
+	res, err := client.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot read s3 object: %w", err)
+	}
+	return data, res.Header.Get("ETag"), nil
+}
+
+func (client *s3Client) deleteObject(key string) error {
+	res, err := client.do(http.MethodDelete, key, nil, nil, nil)
+	if errors.Is(err, errS3NotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// listObjects 列出指定前缀的对象, maxKeys 为 0 时列出全部
+func (client *s3Client) listObjects(prefix string, maxKeys int) ([]string, error) {
+	var keys []string
+	token := ""
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if maxKeys > 0 {
+			query.Set("max-keys", strconv.Itoa(maxKeys))
+		}
+		if len(token) > 0 {
+			query.Set("continuation-token", token)
+		}
+
+		// 列出 bucket 时 key 为空
+		res, err := client.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		result := &s3ListBucketResult{}
+		err = xml.NewDecoder(res.Body).Decode(result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode s3 list result: %w", err)
+		}
+
+		for _, content := range result.Contents {
+			keys = append(keys, content.Key)
+		}
+
+		if !result.IsTruncated || len(result.NextContinuationToken) == 0 || maxKeys > 0 && len(keys) >= maxKeys {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+// putObjectMultipart 使用分片上传对象
+func (client *s3Client) putObjectMultipart(key string, data []byte, partSize int) error {
+	query := url.Values{}
+	query.Set("uploads", "")
+	res, err := client.do(http.MethodPost, key, query, nil, nil)
+	if err != nil {
+		return fmt.Errorf("cannot create multipart upload: %w", err)
+	}
+
+	initiate := &s3InitiateMultipartUploadResult{}
+	err = xml.NewDecoder(res.Body).Decode(initiate)
+	res.Body.Close()
+	if err != nil {
+		return fmt.Errorf("cannot decode multipart upload result: %w", err)
+	}
+
+	complete := &s3CompleteMultipartUpload{}
+	for offset, partNumber := 0, 1; offset < len(data); offset, partNumber = offset+partSize, partNumber+1 {
+		end := offset + partSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		query := url.Values{}
+		query.Set("partNumber", strconv.Itoa(partNumber))
+		query.Set("uploadId", initiate.UploadID)
+		res, err := client.do(http.MethodPut, key, query, nil, data[offset:end])
+		if err != nil {
+			client.abortMultipartUpload(key, initiate.UploadID)
+			return fmt.Errorf("cannot upload part %d: %w", partNumber, err)
+		}
+		res.Body.Close()
+
+		complete.Parts = append(complete.Parts, s3CompletedPart{
+			PartNumber: partNumber,
+			ETag:       res.Header.Get("ETag"),
+		})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return fmt.Errorf("cannot encode multipart upload parts: %w", err)
+	}
+
+	query = url.Values{}
+	query.Set("uploadId", initiate.UploadID)
+	res, err = client.do(http.MethodPost, key, query, nil, body)
+	if err != nil {
+		client.abortMultipartUpload(key, initiate.UploadID)
+		return fmt.Errorf("cannot complete multipart upload: %w", err)
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+func (client *s3Client) abortMultipartUpload(key string, uploadID string) {
+	query := url.Values{}
+	query.Set("uploadId", uploadID)
+	res, err := client.do(http.MethodDelete, key, query, nil, nil)
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+}
+
+// presignGetObject 生成对象的预签名下载地址
+func (client *s3Client) presignGetObject(key string, expires time.Duration) string {
+	return client.signer.presign(http.MethodGet, client.objectURL(key, nil), expires, time.Now())
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func s3ResponseError(res *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<16))
+
+	e := &s3Error{}
+	if xml.Unmarshal(body, e) != nil || len(e.Code) == 0 {
+		return fmt.Errorf("s3 request failed with status %d", res.StatusCode)
+	}
+	return fmt.Errorf("s3 request failed with status %d: %s: %s", res.StatusCode, e.Code, e.Message)
+}
+
+// sigV4Signer AWS Signature Version 4 签名
+type sigV4Signer struct {
+	accessKey string
+	secretKey string
+	region    string
+	service   string
+}
+
+// sign 在请求头中添加签名
+func (signer *sigV4Signer) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           now.Format(s3TimeFormat),
+	}
+	canonicalHeaders, signedHeaders := canonicalHeaders(headers)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := signer.scope(now)
+	signature := signer.signature(now, scope, canonicalRequest)
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, signer.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+// presign 生成预签名地址
+func (signer *sigV4Signer) presign(method string, u *url.URL, expires time.Duration, now time.Time) string {
+	now = now.UTC()
+	scope := signer.scope(now)
+
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", s3Algorithm)
+	query.Set("X-Amz-Credential", signer.accessKey+"/"+scope)
+	query.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalHeaders, signedHeaders := canonicalHeaders(map[string]string{"host": u.Host})
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalURI(u),
+		canonicalQuery(query),
+		canonicalHeaders,
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+
+	query.Set("X-Amz-Signature", signer.signature(now, scope, canonicalRequest))
+
+	signed := *u
+	signed.RawQuery = canonicalQuery(query)
+	return signed.String()
+}
+
+func (signer *sigV4Signer) scope(now time.Time) string {
+	return strings.Join([]string{now.Format(s3DateFormat), signer.region, signer.service, "aws4_request"}, "/")
+}
+
+func (signer *sigV4Signer) signature(now time.Time, scope string, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		now.Format(s3TimeFormat),
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+signer.secretKey), now.Format(s3DateFormat))
+	key = hmacSHA256(key, signer.region)
+	key = hmacSHA256(key, signer.service)
+	key = hmacSHA256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func canonicalHeaders(headers map[string]string) (string, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+	for _, name := range names {
+		builder.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	return builder.String(), strings.Join(names, ";")
+}
+
+func canonicalURI(u *url.URL) string {
+	if len(u.Path) == 0 {
+		return "/"
+	}
+
+	segments := strings.Split(u.Path, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key)+"="+uriEncode(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode 按 RFC 3986 编码, 只保留非保留字符
+func uriEncode(value string) string {
+	var builder strings.Builder
+	for _, b := range []byte(value) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' ||
+			b == '-' || b == '_' || b == '.' || b == '~' {
+			builder.WriteByte(b)
+		} else {
+			fmt.Fprintf(&builder, "%%%02X", b)
+		}
+	}
+	return builder.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
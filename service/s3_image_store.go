@@ -0,0 +1,311 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// 默认分片上传大小, S3 要求除最后一片外每片不小于 5M
+	defaultS3PartSize = 5 << 20
+	// 图片信息条件写入失败时最多尝试的次数
+	s3SaveInfoAttempts = 5
+)
+
+// S3Config S3 图片存储配置
+type S3Config struct {
+	Endpoint  string // 如 http://127.0.0.1:9000
+	Region    string
+	Bucket    string
+	Prefix    string // 对象 key 的前缀
+	AccessKey string
+	SecretKey string
+	PartSize  int // 超过此大小的图片使用分片上传
+}
+
+// S3ImageStore 兼容 S3 API 的对象存储, 多个服务器实例可共享同一个 bucket
+//
+// 对象布局:
+//
+//	<prefix>images/<image id>.json                              图片信息
+//	<prefix>blobs/<image id>/<checksum><type>                   原图内容
+//	<prefix>blobs/<image id>/<variant>/<checksum><type>         缩放版本内容
+//
+// 图片内容的 key 只属于一张图片且写入后不再修改, 不同实例之间不需要引用计数;
+// 图片信息使用 ETag 条件写入, 其他实例同时修改时重新读取后重试
+type S3ImageStore struct {
+	client   *s3Client
+	prefix   string
+	partSize int
+}
+
+// NewS3ImageStore 创建 S3 存储实例
+func NewS3ImageStore(config S3Config) (*S3ImageStore, error) {
+	client, err := newS3Client(config.Endpoint, config.Region, config.Bucket, config.AccessKey, config.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	partSize := config.PartSize
+	if partSize <= 0 {
+		partSize = defaultS3PartSize
+	}
+
+	store := &S3ImageStore{
+		client:   client,
+		prefix:   config.Prefix,
+		partSize: partSize,
+	}
+	return store, nil
+}
+
+func (store *S3ImageStore) Save(laptopID string, imageType string, imageData bytes.Buffer) (string, error) {
+	imageID, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("cannot generate image id: %w", err)
+	}
+
+	checksum := sha256Hex(imageData.Bytes())
+	key := store.blobKey(imageID.String(), "", checksum, imageType)
+	err = store.putBlob(key, imageData.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	info := &ImageInfo{
+		LaptopId: laptopID,
+		Type:     imageType,
+		Path:     key,
+		Size:     int64(imageData.Len()),
+		Checksum: checksum,
+		Variants: make(map[string]*ImageVariantInfo),
+	}
+
+	err = store.saveInfo(imageID.String(), info, "")
+	if err != nil {
+		return "", err
+	}
+
+	return imageID.String(), nil
+}
+
+func (store *S3ImageStore) SaveVariant(imageID string, variant string, imageType string, imageData bytes.Buffer) error {
+	info, etag, err := store.findInfo(imageID)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return ErrImageNotFound
+	}
+
+	checksum := sha256Hex(imageData.Bytes())
+	key := store.blobKey(imageID, variant, checksum, imageType)
+	err = store.putBlob(key, imageData.Bytes())
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		old := info.Variants[variant]
+		info.Variants[variant] = &ImageVariantInfo{
+			Type:     imageType,
+			Path:     key,
+			Size:     int64(imageData.Len()),
+			Checksum: checksum,
+		}
+
+		err = store.saveInfo(imageID, info, etag)
+		if err == nil {
+			// 替换已有的缩放版本
+			if old != nil && old.Path != key {
+				return store.deleteBlob(old.Path)
+			}
+			return nil
+		}
+		if !errors.Is(err, errS3PreconditionFailed) || attempt >= s3SaveInfoAttempts {
+			break
+		}
+
+		// 其他实例同时修改了图片信息, 重新读取后重试
+		info, etag, err = store.findInfo(imageID)
+		if err != nil {
+			break
+		}
+		if info == nil {
+			err = ErrImageNotFound
+			break
+		}
+	}
+
+	// 图片已被删除或没有写入图片信息, 删除刚上传的内容
+	if errors.Is(err, errS3NotFound) {
+		err = ErrImageNotFound
+	}
+	if deleteErr := store.deleteBlob(key); deleteErr != nil {
+		log.Printf("cannot delete unused image object %s: %v", key, deleteErr)
+	}
+	return err
+}
+
+func (store *S3ImageStore) Find(imageID string) (*ImageInfo, error) {
+	info, _, err := store.findInfo(imageID)
+	return info, err
+}
+
+func (store *S3ImageStore) Load(imageID string, variant string) ([]byte, error) {
+	key, err := store.objectKey(imageID, variant)
+	if err != nil || len(key) == 0 {
+		return nil, err
+	}
+
+	data, err := store.client.getObject(key)
+	if errors.Is(err, errS3NotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot get image object: %w", err)
+	}
+
+	return data, nil
+}
+
+func (store *S3ImageStore) Delete(imageID string) error {
+	info, err := store.Find(imageID)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return ErrImageNotFound
+	}
+
+	// 先删除图片信息, 之后其他实例写入缩放版本时条件写入失败, 由写入方删除上传的内容
+	err = store.client.deleteObject(store.infoKey(imageID))
+	if err != nil {
+		return fmt.Errorf("cannot delete image info: %w", err)
+	}
+
+	keys, err := store.client.listObjects(store.prefix+"blobs/"+imageID+"/", 0)
+	if err != nil {
+		return fmt.Errorf("cannot list image objects: %w", err)
+	}
+	for _, key := range keys {
+		err = store.deleteBlob(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PresignURL 生成图片的预签名下载地址, 客户端可直接从对象存储下载
+func (store *S3ImageStore) PresignURL(imageID string, variant string, expires time.Duration) (string, error) {
+	key, err := store.objectKey(imageID, variant)
+	if err != nil {
+		return "", err
+	}
+	if len(key) == 0 {
+		return "", ErrImageNotFound
+	}
+
+	return store.client.presignGetObject(key, expires), nil
+}
+
+// objectKey 返回图片内容的对象 key, 图片或缩放版本不存在时返回空
+func (store *S3ImageStore) objectKey(imageID string, variant string) (string, error) {
+	info, err := store.Find(imageID)
+	if err != nil || info == nil {
+		return "", err
+	}
+
+	if len(variant) == 0 {
+		return info.Path, nil
+	}
+
+	v := info.Variants[variant]
+	if v == nil {
+		return "", nil
+	}
+	return v.Path, nil
+}
+
+// findInfo 读取图片信息和 ETag, 图片不存在时返回 nil
+func (store *S3ImageStore) findInfo(imageID string) (*ImageInfo, string, error) {
+	// 避免构造出其他对象的 key
+	_, err := uuid.Parse(imageID)
+	if err != nil {
+		return nil, "", nil
+	}
+
+	data, etag, err := store.client.getObjectETag(store.infoKey(imageID))
+	if errors.Is(err, errS3NotFound) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot get image info: %w", err)
+	}
+
+	info := &ImageInfo{}
+	err = json.Unmarshal(data, info)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot decode image info: %w", err)
+	}
+	if info.Variants == nil {
+		info.Variants = make(map[string]*ImageVariantInfo)
+	}
+
+	return info, etag, nil
+}
+
+// saveInfo 写入图片信息, etag 不为空时只在图片信息没有被修改时写入
+func (store *S3ImageStore) saveInfo(imageID string, info *ImageInfo, etag string) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("cannot encode image info: %w", err)
+	}
+
+	err = store.client.putObjectIfMatch(store.infoKey(imageID), data, etag)
+	if err != nil {
+		return fmt.Errorf("cannot put image info: %w", err)
+	}
+	return nil
+}
+
+// putBlob 上传图片内容, 超过分片大小时使用分片上传
+func (store *S3ImageStore) putBlob(key string, data []byte) error {
+	var err error
+	if len(data) > store.partSize {
+		err = store.client.putObjectMultipart(key, data, store.partSize)
+	} else {
+		err = store.client.putObject(key, data)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot put image object: %w", err)
+	}
+	return nil
+}
+
+func (store *S3ImageStore) deleteBlob(key string) error {
+	err := store.client.deleteObject(key)
+	if err != nil {
+		return fmt.Errorf("cannot delete image object: %w", err)
+	}
+	return nil
+}
+
+func (store *S3ImageStore) infoKey(imageID string) string {
+	return store.prefix + "images/" + imageID + ".json"
+}
+
+// blobKey 返回图片内容的 key, variant 为空时为原图
+func (store *S3ImageStore) blobKey(imageID string, variant string, checksum string, imageType string) string {
+	if len(variant) == 0 {
+		return store.prefix + "blobs/" + imageID + "/" + checksum + imageType
+	}
+	return store.prefix + "blobs/" + imageID + "/" + variant + "/" + checksum + imageType
+}
@@ -0,0 +1,258 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go-pcbook-micro/pb"
+)
+
+// RoleSuperAdmin 可以访问所有租户的超级管理员
+const RoleSuperAdmin = "superadmin"
+
+// ErrOtherTenant 资源属于其他租户
+var ErrOtherTenant = errors.New("resource belongs to another tenant")
+
+// Tenant 查询所属的租户, 每个组织是一个租户, 不属于任何组织的用户和 laptop 属于 OrgID 为空的租户
+type Tenant struct {
+	OrgID string
+	All   bool // 超级管理员可以访问所有租户
+}
+
+// TenantFromContext 当前用户所属的租户, 未登录的用户只能访问 OrgID 为空的租户
+func TenantFromContext(ctx context.Context) Tenant {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return Tenant{}
+	}
+	return Tenant{OrgID: claims.OrgID, All: claims.Role == RoleSuperAdmin}
+}
+
+// Contains 租户可以访问组织的数据
+func (tenant Tenant) Contains(orgID string) bool {
+	return tenant.All || tenant.OrgID == orgID
+}
+
+// hidden laptop 属于其他租户, 无法确认所属租户的 laptop (例如已删除) 也视为其他租户
+func (tenant Tenant) hidden(laptops LaptopStore, laptopID string) (bool, error) {
+	if tenant.All {
+		return false, nil
+	}
+	laptop, err := laptops.Find(laptopID)
+	if err != nil {
+		return false, err
+	}
+	return laptop == nil || !tenant.Contains(laptop.GetOrgId()), nil
+}
+
+// tenantLaptopStore 只能访问租户内的 laptop, 其他租户的 laptop 视为不存在
+type tenantLaptopStore struct {
+	LaptopStore
+	tenant Tenant
+}
+
+// NewTenantLaptopStore 返回限定在租户内的 laptop 存储
+func NewTenantLaptopStore(store LaptopStore, tenant Tenant) LaptopStore {
+	return &tenantLaptopStore{store, tenant}
+}
+
+func (store *tenantLaptopStore) Save(laptop *pb.Laptop) error {
+	if !store.tenant.Contains(laptop.GetOrgId()) {
+		return fmt.Errorf("cannot save laptop to org %q: %w", laptop.GetOrgId(), ErrOtherTenant)
+	}
+	return store.LaptopStore.Save(laptop)
+}
+
+func (store *tenantLaptopStore) Find(id string) (*pb.Laptop, error) {
+	laptop, err := store.LaptopStore.Find(id)
+	if err != nil || laptop == nil || !store.tenant.Contains(laptop.GetOrgId()) {
+		return nil, err
+	}
+	return laptop, nil
+}
+
+func (store *tenantLaptopStore) Search(ctx context.Context, filter *pb.Filter, found func(laptop *pb.Laptop) error) error {
+	return store.LaptopStore.Search(ctx, filter, func(laptop *pb.Laptop) error {
+		if !store.tenant.Contains(laptop.GetOrgId()) {
+			return nil
+		}
+		return found(laptop)
+	})
+}
+
+func (store *tenantLaptopStore) Update(id string, update func(laptop *pb.Laptop) error) (*pb.Laptop, error) {
+	return store.LaptopStore.Update(id, func(laptop *pb.Laptop) error {
+		if !store.tenant.Contains(laptop.GetOrgId()) {
+			return ErrLaptopNotFound
+		}
+		return update(laptop)
+	})
+}
+
+// tenantRatingStore 只能访问租户内 laptop 的评分, 其他租户的 laptop 没有评分, 也不能评分
+type tenantRatingStore struct {
+	RatingStore
+	laptops LaptopStore
+	tenant  Tenant
+}
+
+// NewTenantRatingStore 返回限定在租户内的评分存储, laptops 用于查找 laptop 所属的租户
+func NewTenantRatingStore(store RatingStore, laptops LaptopStore, tenant Tenant) RatingStore {
+	return &tenantRatingStore{store, laptops, tenant}
+}
+
+func (store *tenantRatingStore) check(laptopID string) error {
+	hidden, err := store.tenant.hidden(store.laptops, laptopID)
+	if err != nil {
+		return err
+	}
+	if hidden {
+		return ErrLaptopNotFound
+	}
+	return nil
+}
+
+func (store *tenantRatingStore) Add(laptopID string, username string, score float64) (*Rating, error) {
+	if err := store.check(laptopID); err != nil {
+		return nil, err
+	}
+	return store.RatingStore.Add(laptopID, username, score)
+}
+
+func (store *tenantRatingStore) Remove(laptopID string, username string) (*Rating, error) {
+	if err := store.check(laptopID); err != nil {
+		return nil, err
+	}
+	return store.RatingStore.Remove(laptopID, username)
+}
+
+func (store *tenantRatingStore) SetExcluded(laptopID string, username string, excluded bool) (*Rating, error) {
+	if err := store.check(laptopID); err != nil {
+		return nil, err
+	}
+	return store.RatingStore.SetExcluded(laptopID, username, excluded)
+}
+
+func (store *tenantRatingStore) Find(laptopID string) (*Rating, error) {
+	hidden, err := store.tenant.hidden(store.laptops, laptopID)
+	if err != nil || hidden {
+		return &Rating{}, err
+	}
+	return store.RatingStore.Find(laptopID)
+}
+
+func (store *tenantRatingStore) FindUserRating(laptopID string, username string) (*UserRating, error) {
+	hidden, err := store.tenant.hidden(store.laptops, laptopID)
+	if err != nil || hidden {
+		return nil, err
+	}
+	return store.RatingStore.FindUserRating(laptopID, username)
+}
+
+func (store *tenantRatingStore) Scores(laptopID string) ([]float64, error) {
+	hidden, err := store.tenant.hidden(store.laptops, laptopID)
+	if err != nil || hidden {
+		return []float64{}, err
+	}
+	return store.RatingStore.Scores(laptopID)
+}
+
+func (store *tenantRatingStore) ListUserRatings(laptopID string) ([]*UserRating, error) {
+	hidden, err := store.tenant.hidden(store.laptops, laptopID)
+	if err != nil || hidden {
+		return []*UserRating{}, err
+	}
+	return store.RatingStore.ListUserRatings(laptopID)
+}
+
+func (store *tenantRatingStore) RatedLaptops() ([]string, error) {
+	laptopIDs, err := store.RatingStore.RatedLaptops()
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make([]string, 0, len(laptopIDs))
+	for _, laptopID := range laptopIDs {
+		hidden, err := store.tenant.hidden(store.laptops, laptopID)
+		if err != nil {
+			return nil, err
+		}
+		if !hidden {
+			visible = append(visible, laptopID)
+		}
+	}
+	return visible, nil
+}
+
+// tenantImageStore 只能访问租户内 laptop 的图片, 其他租户的图片视为不存在
+type tenantImageStore struct {
+	ImageStore
+	laptops LaptopStore
+	tenant  Tenant
+}
+
+// NewTenantImageStore 返回限定在租户内的图片存储, laptops 用于查找 laptop 所属的租户
+func NewTenantImageStore(store ImageStore, laptops LaptopStore, tenant Tenant) ImageStore {
+	return &tenantImageStore{store, laptops, tenant}
+}
+
+// check 图片不存在或属于其他租户时返回 ErrImageNotFound
+func (store *tenantImageStore) check(imageID string) error {
+	info, err := store.Find(imageID)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return ErrImageNotFound
+	}
+	return nil
+}
+
+func (store *tenantImageStore) Save(laptopID string, imageType string, imageData bytes.Buffer) (string, error) {
+	hidden, err := store.tenant.hidden(store.laptops, laptopID)
+	if err != nil {
+		return "", err
+	}
+	if hidden {
+		return "", ErrLaptopNotFound
+	}
+	return store.ImageStore.Save(laptopID, imageType, imageData)
+}
+
+func (store *tenantImageStore) SaveVariant(imageID string, variant string, imageType string, imageData bytes.Buffer) error {
+	if err := store.check(imageID); err != nil {
+		return err
+	}
+	return store.ImageStore.SaveVariant(imageID, variant, imageType, imageData)
+}
+
+func (store *tenantImageStore) Find(imageID string) (*ImageInfo, error) {
+	info, err := store.ImageStore.Find(imageID)
+	if err != nil || info == nil {
+		return nil, err
+	}
+
+	hidden, err := store.tenant.hidden(store.laptops, info.LaptopId)
+	if err != nil || hidden {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (store *tenantImageStore) Load(imageID string, variant string) ([]byte, error) {
+	if err := store.check(imageID); err != nil {
+		if errors.Is(err, ErrImageNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return store.ImageStore.Load(imageID, variant)
+}
+
+func (store *tenantImageStore) Delete(imageID string) error {
+	if err := store.check(imageID); err != nil {
+		return err
+	}
+	return store.ImageStore.Delete(imageID)
+}
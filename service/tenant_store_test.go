@@ -0,0 +1,199 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"go-pcbook-micro/pb"
+	"go-pcbook-micro/sample"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestTenantStores(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := NewInMemoryLaptopStore()
+	ratingStore := NewInMemoryRatingStore()
+	imageStore := NewDiskImageStore(t.TempDir())
+
+	acmeLaptop := sample.NewLaptop()
+	acmeLaptop.OrgId = "acme"
+	require.NoError(t, laptopStore.Save(acmeLaptop))
+	globexLaptop := sample.NewLaptop()
+	globexLaptop.OrgId = "globex"
+	require.NoError(t, laptopStore.Save(globexLaptop))
+
+	_, err := ratingStore.Add(globexLaptop.GetId(), "bob", 5)
+	require.NoError(t, err)
+	imageID, err := imageStore.Save(globexLaptop.GetId(), ".jpg", bytes.Buffer{})
+	require.NoError(t, err)
+
+	acme := Tenant{OrgID: "acme"}
+	laptops := NewTenantLaptopStore(laptopStore, acme)
+	ratings := NewTenantRatingStore(ratingStore, laptopStore, acme)
+	images := NewTenantImageStore(imageStore, laptopStore, acme)
+
+	// 其他租户的 laptop 视为不存在
+	found, err := laptops.Find(globexLaptop.GetId())
+	require.NoError(t, err)
+	require.Nil(t, found)
+	found, err = laptops.Find(acmeLaptop.GetId())
+	require.NoError(t, err)
+	require.NotNil(t, found)
+
+	var ids []string
+	err = laptops.Search(context.Background(), &pb.Filter{MaxPriceUsd: 1e6}, func(laptop *pb.Laptop) error {
+		ids = append(ids, laptop.GetId())
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{acmeLaptop.GetId()}, ids)
+
+	_, err = laptops.Update(globexLaptop.GetId(), func(laptop *pb.Laptop) error { return nil })
+	require.ErrorIs(t, err, ErrLaptopNotFound)
+	require.ErrorIs(t, laptops.Save(globexLaptop), ErrOtherTenant)
+
+	rating, err := ratings.Find(globexLaptop.GetId())
+	require.NoError(t, err)
+	require.Zero(t, rating.Count)
+	_, err = ratings.Add(globexLaptop.GetId(), "alice", 1)
+	require.ErrorIs(t, err, ErrLaptopNotFound)
+	rated, err := ratings.RatedLaptops()
+	require.NoError(t, err)
+	require.Empty(t, rated)
+
+	info, err := images.Find(imageID)
+	require.NoError(t, err)
+	require.Nil(t, info)
+	require.ErrorIs(t, images.Delete(imageID), ErrImageNotFound)
+	_, err = images.Save(globexLaptop.GetId(), ".jpg", bytes.Buffer{})
+	require.ErrorIs(t, err, ErrLaptopNotFound)
+
+	// 找不到 laptop 时无法确认所属租户, 同样视为其他租户
+	_, err = ratingStore.Add("deleted-laptop", "bob", 4)
+	require.NoError(t, err)
+	orphanID, err := imageStore.Save("deleted-laptop", ".jpg", bytes.Buffer{})
+	require.NoError(t, err)
+	rating, err = ratings.Find("deleted-laptop")
+	require.NoError(t, err)
+	require.Zero(t, rating.Count)
+	rated, err = ratings.RatedLaptops()
+	require.NoError(t, err)
+	require.Empty(t, rated)
+	info, err = images.Find(orphanID)
+	require.NoError(t, err)
+	require.Nil(t, info)
+
+	// 超级管理员可以访问所有租户
+	all := Tenant{All: true}
+	found, err = NewTenantLaptopStore(laptopStore, all).Find(globexLaptop.GetId())
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	rating, err = NewTenantRatingStore(ratingStore, laptopStore, all).Find(globexLaptop.GetId())
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), rating.Count)
+	info, err = NewTenantImageStore(imageStore, laptopStore, all).Find(imageID)
+	require.NoError(t, err)
+	require.NotNil(t, info)
+	info, err = NewTenantImageStore(imageStore, laptopStore, all).Find(orphanID)
+	require.NoError(t, err)
+	require.NotNil(t, info)
+}
+
+func TestLaptopServerTenantIsolation(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := NewInMemoryLaptopStore()
+	server := NewLaptopServer(laptopStore, NewDiskImageStore(t.TempDir()), nil)
+
+	acmeAdmin := contextWithClaims(context.Background(), &UserClaims{Username: "admin1", Role: "user", OrgID: "acme", OrgRole: OrgRoleAdmin})
+	globexAdmin := contextWithClaims(context.Background(), &UserClaims{Username: "admin2", Role: "admin", OrgID: "globex"})
+	superAdmin := contextWithClaims(context.Background(), &UserClaims{Username: "root", Role: RoleSuperAdmin})
+
+	res, err := server.CreateLaptop(acmeAdmin, &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+	require.NoError(t, err)
+
+	updatePrice := func(ctx context.Context) error {
+		_, err := server.UpdateLaptopPrice(ctx, &pb.UpdateLaptopPriceRequest{LaptopId: res.GetId(), PriceUsd: 1000})
+		return err
+	}
+	require.NoError(t, updatePrice(acmeAdmin))
+	require.Equal(t, codes.NotFound, status.Code(updatePrice(globexAdmin)))
+	require.NoError(t, updatePrice(superAdmin))
+
+	// 超级管理员可以在任何组织创建 laptop, 其他用户使用自己的组织
+	laptop := sample.NewLaptop()
+	laptop.OrgId = "globex"
+	res, err = server.CreateLaptop(superAdmin, &pb.CreateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+	found, err := laptopStore.Find(res.GetId())
+	require.NoError(t, err)
+	require.Equal(t, "globex", found.GetOrgId())
+}
+
+func TestClientSearchLaptopTenant(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := NewInMemoryLaptopStore()
+	laptopIDs := make(map[string]string) // org -> laptop
+	for _, orgID := range []string{"", "acme", "globex"} {
+		laptop := sample.NewLaptop()
+		laptop.OrgId = orgID
+		require.NoError(t, laptopStore.Save(laptop))
+		laptopIDs[orgID] = laptop.GetId()
+	}
+
+	jwtManager := NewJWTManager("secret", time.Minute)
+	serverAddress := startTestAuthLaptopServer(t, jwtManager, laptopStore, nil, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	orgContext := func(orgID string) context.Context {
+		accessToken, err := jwtManager.Generate(&User{Username: "alice", Role: "user", OrgID: orgID})
+		require.NoError(t, err)
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", accessToken)
+	}
+	search := func(ctx context.Context) []string {
+		req := &pb.SearchLaptopRequest{Filter: &pb.Filter{MaxPriceUsd: 1e6}}
+		stream, err := laptopClient.SearchLaptop(ctx, req)
+		require.NoError(t, err)
+
+		var found []string
+		for {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				return found
+			}
+			require.NoError(t, err)
+			found = append(found, res.GetLaptop().GetId())
+		}
+	}
+
+	// 公开的 rpc 也使用登录用户的租户, 没有登录时只能看到不属于任何组织的 laptop
+	acme := orgContext("acme")
+	require.Equal(t, []string{laptopIDs["acme"]}, search(acme))
+	require.Equal(t, []string{laptopIDs[""]}, search(context.Background()))
+
+	_, err := laptopClient.GetPriceHistory(acme, &pb.GetPriceHistoryRequest{LaptopId: laptopIDs["acme"]})
+	require.NoError(t, err)
+	_, err = laptopClient.GetPriceHistory(acme, &pb.GetPriceHistoryRequest{LaptopId: laptopIDs["globex"]})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// 公开的 rpc 带了无效或过期的 token 时当作未登录, 其他 rpc 仍然拒绝
+	invalid := metadata.AppendToOutgoingContext(context.Background(), "authorization", "invalid")
+	require.Equal(t, []string{laptopIDs[""]}, search(invalid))
+	_, err = laptopClient.GetPriceHistory(invalid, &pb.GetPriceHistoryRequest{LaptopId: laptopIDs[""]})
+	require.NoError(t, err)
+	_, err = laptopClient.GetMyRating(invalid, &pb.GetMyRatingRequest{LaptopId: laptopIDs[""]})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	expiredToken, err := NewJWTManager("secret", -time.Minute).Generate(&User{Username: "alice", Role: "user", OrgID: "acme"})
+	require.NoError(t, err)
+	expired := metadata.AppendToOutgoingContext(context.Background(), "authorization", expiredToken)
+	require.Equal(t, []string{laptopIDs[""]}, search(expired))
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// RevocationList 按 jti 记录被吊销的 access token, token 过期后不再保存
+type RevocationList struct {
+	mutex   sync.RWMutex
+	revoked map[string]time.Time // jti -> token 的过期时间
+	now     func() time.Time
+}
+
+// NewRevocationList 创建实例
+func NewRevocationList() *RevocationList {
+	return &RevocationList{
+		revoked: make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+// Revoke 吊销 token, expiresAt 之后 token 本身已经无效
+func (list *RevocationList) Revoke(jti string, expiresAt time.Time) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	// 顺便清理已经过期的记录
+	now := list.now()
+	for id, expiry := range list.revoked {
+		if now.After(expiry) {
+			delete(list.revoked, id)
+		}
+	}
+
+	if now.After(expiresAt) {
+		return
+	}
+	list.revoked[jti] = expiresAt
+}
+
+// IsRevoked 检查 token 是否被吊销
+func (list *RevocationList) IsRevoked(jti string) bool {
+	list.mutex.RLock()
+	defer list.mutex.RUnlock()
+
+	_, ok := list.revoked[jti]
+	return ok
+}
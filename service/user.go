@@ -1,15 +1,31 @@
 package service
 
 import (
+	"errors"
 	"fmt"
+	"regexp"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+const minPasswordLength = 6
+
+var validUsername = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,32}$`)
+
+// 可以分配给用户的角色
+var validRoles = map[string]bool{
+	"admin":        true,
+	"user":         true,
+	RoleSuperAdmin: true,
+}
+
 type User struct {
 	Username       string
 	HashedPassword string
 	Role           string
+	Disabled       bool   // 禁用的用户不能登录, 已有的 token 也会被拒绝
+	OrgID          string // 所属的组织, admin 只能管理同一组织的 laptop
+	OrgRole        string // 在组织内的角色, 不属于任何组织时为空
 }
 
 func NewUser(username string, password string, role string) (*User, error) {
@@ -25,6 +41,16 @@ func NewUser(username string, password string, role string) (*User, error) {
 	return user, nil
 }
 
+// SetPassword 修改密码
+func (user *User) SetPassword(password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("cannot hash password: %w", err)
+	}
+	user.HashedPassword = string(hashedPassword)
+	return nil
+}
+
 func (user *User) IsCorrectPassword(password string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(user.HashedPassword), []byte(password))
 	return err == nil
@@ -35,5 +61,32 @@ func (user *User) Clone() *User {
 		Username:       user.Username,
 		HashedPassword: user.HashedPassword,
 		Role:           user.Role,
+		Disabled:       user.Disabled,
+		OrgID:          user.OrgID,
+		OrgRole:        user.OrgRole,
+	}
+}
+
+// ValidateUsername 用户名为 3 到 32 个字母, 数字或 _ . -
+func ValidateUsername(username string) error {
+	if !validUsername.MatchString(username) {
+		return errors.New("username must be 3 to 32 letters, digits, '_', '.' or '-'")
+	}
+	return nil
+}
+
+// ValidatePassword 密码至少 6 个字符, bcrypt 最多使用 72 个字节
+func ValidatePassword(password string) error {
+	if len(password) < minPasswordLength || len(password) > 72 {
+		return fmt.Errorf("password must be %d to 72 bytes", minPasswordLength)
+	}
+	return nil
+}
+
+// ValidateRole 角色只能是 user, admin 或 superadmin
+func ValidateRole(role string) error {
+	if !validRoles[role] {
+		return fmt.Errorf("unknown role %q", role)
 	}
+	return nil
 }
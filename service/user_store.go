@@ -1,12 +1,25 @@
 package service
 
-import "sync"
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrUserNotFound 用户不存在返回此错误
+var ErrUserNotFound = errors.New("user not found")
 
 type UserStore interface {
 	// 保存用户
 	Save(user *User) error
 	// 通过姓名查找用户
 	Find(username string) (*User, error)
+	// 替换已有用户的信息
+	Update(user *User) error
+	// 删除用户
+	Delete(username string) error
+	// 按用户名排序分页返回用户和用户总数, limit 为 0 时返回所有用户
+	List(offset int, limit int) ([]*User, int, error)
 }
 
 type InMemoryUserStore struct {
@@ -42,3 +55,53 @@ func (store *InMemoryUserStore) Find(username string) (*User, error) {
 	}
 	return user.Clone(), nil
 }
+
+func (store *InMemoryUserStore) Update(user *User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.users[user.Username] == nil {
+		return ErrUserNotFound
+	}
+
+	store.users[user.Username] = user.Clone()
+	return nil
+}
+
+func (store *InMemoryUserStore) Delete(username string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.users[username] == nil {
+		return ErrUserNotFound
+	}
+
+	delete(store.users, username)
+	return nil
+}
+
+func (store *InMemoryUserStore) List(offset int, limit int) ([]*User, int, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	usernames := make([]string, 0, len(store.users))
+	for username := range store.users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	total := len(usernames)
+	if offset > total {
+		offset = total
+	}
+	usernames = usernames[offset:]
+	if limit > 0 && len(usernames) > limit {
+		usernames = usernames[:limit]
+	}
+
+	users := make([]*User, 0, len(usernames))
+	for _, username := range usernames {
+		users = append(users, store.users[username].Clone())
+	}
+	return users, total, nil
+}